@@ -32,6 +32,7 @@ func main() {
 	}
 
 	web.StartWebServer(svcMgr)
+	web.StartMetricsServer(svcMgr)
 
 	log.Println("所有服务已启动")
 
@@ -0,0 +1,239 @@
+package blocklist
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/util"
+)
+
+type list struct {
+	name string
+	url  string
+	path string
+
+	rules     *ruleSet
+	updatedAt time.Time
+	lastErr   string
+	hits      atomic.Int64
+}
+
+// Manager holds the compiled subscriptions. Lists are recompiled in place
+// after a download, so updates take effect without reloading the router.
+type Manager struct {
+	action string
+
+	mu    sync.RWMutex
+	lists []*list
+
+	updateMu sync.Mutex
+}
+
+// New returns nil when blocking is disabled or no list is configured; all
+// methods treat a nil *Manager as an empty blocklist.
+func New(cfg config.BlocklistConfig, dir string) *Manager {
+	if !cfg.Enabled || len(cfg.Lists) == 0 {
+		return nil
+	}
+
+	m := &Manager{action: strings.ToLower(cfg.Action)}
+	if m.action == "" {
+		m.action = "reject"
+	}
+
+	for _, src := range cfg.Lists {
+		if src.URL == "" {
+			continue
+		}
+		name := src.Name
+		if name == "" {
+			name = src.URL
+		}
+		m.lists = append(m.lists, &list{
+			name: name,
+			url:  src.URL,
+			path: filepath.Join(dir, listFileName(src.URL)),
+		})
+	}
+
+	return m
+}
+
+func listFileName(url string) string {
+	h := fnv.New64a()
+	h.Write([]byte(url))
+	return fmt.Sprintf("%x.txt", h.Sum64())
+}
+
+// Action returns the configured reject target for matches.
+func (m *Manager) Action() string {
+	if m == nil {
+		return ""
+	}
+	return m.action
+}
+
+// Load compiles every list from its local file.
+func (m *Manager) Load() {
+	if m == nil {
+		return
+	}
+	for _, l := range m.lists {
+		m.loadList(l)
+	}
+}
+
+func (m *Manager) loadList(l *list) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.setError(l, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	rs, err := parse(f)
+	if err != nil {
+		m.setError(l, err)
+		return
+	}
+
+	var updatedAt time.Time
+	if fi, err := f.Stat(); err == nil {
+		updatedAt = fi.ModTime()
+	}
+
+	m.mu.Lock()
+	l.rules = rs
+	l.updatedAt = updatedAt
+	m.mu.Unlock()
+}
+
+func (m *Manager) setError(l *list, err error) {
+	log.Printf("拦截列表 %s 加载失败: %v", l.name, err)
+	m.mu.Lock()
+	l.lastErr = err.Error()
+	m.mu.Unlock()
+}
+
+// Update downloads lists and recompiles them. Without force only lists that
+// have no local copy yet are fetched.
+func (m *Manager) Update(force bool) {
+	if m == nil {
+		return
+	}
+
+	m.updateMu.Lock()
+	defer m.updateMu.Unlock()
+
+	for _, l := range m.lists {
+		if !force {
+			if _, err := os.Stat(l.path); err == nil {
+				continue
+			}
+		}
+
+		if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+			m.setError(l, err)
+			continue
+		}
+
+		log.Printf("正在更新拦截列表 %s ...", l.name)
+		if err := util.DownloadFile(l.path, l.url, Verify); err != nil {
+			m.setError(l, err)
+			continue
+		}
+
+		m.mu.Lock()
+		l.lastErr = ""
+		m.mu.Unlock()
+		m.loadList(l)
+	}
+}
+
+// Outdated reports whether any list has not been refreshed since t.
+func (m *Manager) Outdated(t time.Time) bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, l := range m.lists {
+		if l.updatedAt.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports the name of the first list blocking domain. Allow rules
+// ("@@||domain^") from any list take precedence over block rules.
+func (m *Manager) Match(domain string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, l := range m.lists {
+		if l.rules == nil {
+			continue
+		}
+		if _, ok := l.rules.allow.Lookup(domain); ok {
+			return "", false
+		}
+	}
+
+	for _, l := range m.lists {
+		if l.rules == nil {
+			continue
+		}
+		if _, ok := l.rules.block.Lookup(domain); ok {
+			l.hits.Add(1)
+			return l.name, true
+		}
+	}
+	return "", false
+}
+
+func (m *Manager) Stats() []interface{} {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var stats []interface{}
+	for _, l := range m.lists {
+		rules := 0
+		if l.rules != nil {
+			rules = l.rules.block.Len() + l.rules.allow.Len()
+		}
+		var updatedAt interface{}
+		if !l.updatedAt.IsZero() {
+			updatedAt = l.updatedAt
+		}
+		stats = append(stats, map[string]interface{}{
+			"name":       l.name,
+			"url":        l.url,
+			"rules":      rules,
+			"hits":       l.hits.Load(),
+			"updated_at": updatedAt,
+			"error":      l.lastErr,
+		})
+	}
+	return stats
+}
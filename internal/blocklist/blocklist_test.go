@@ -0,0 +1,126 @@
+package blocklist
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+)
+
+func TestParseSupportsHostsAdGuardAndDomainLists(t *testing.T) {
+	list := `
+! AdGuard header
+[Adblock Plus 2.0]
+||ads.example.com^
+||tracker.example.net^$important
+||script.example.org^$third-party
+@@||good.ads.example.com^
+127.0.0.1 localhost
+0.0.0.0 hosts.example.com other.example.com # inline comment
+plain.example.io
+*.wild.example.io
+/regex.*/
+example.com##.banner
+`
+	rs, err := parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("parse returned error: %v", err)
+	}
+
+	blocked := []string{
+		"ads.example.com", "sub.ads.example.com", "tracker.example.net",
+		"hosts.example.com", "other.example.com",
+		"plain.example.io", "www.plain.example.io", "cdn.wild.example.io",
+	}
+	for _, name := range blocked {
+		if _, ok := rs.block.Lookup(name); !ok {
+			t.Fatalf("expected %s to be blocked", name)
+		}
+	}
+
+	notBlocked := []string{"localhost", "www.hosts.example.com", "script.example.org", "wild.example.io", "example.com"}
+	for _, name := range notBlocked {
+		if _, ok := rs.block.Lookup(name); ok {
+			t.Fatalf("expected %s not to be blocked", name)
+		}
+	}
+
+	if _, ok := rs.allow.Lookup("good.ads.example.com"); !ok {
+		t.Fatal("expected exception rule to be parsed into the allow list")
+	}
+}
+
+func TestManagerDownloadsAndMatchesLists(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ads.txt":
+			fmt.Fprintln(w, "||ads.example.com^")
+			fmt.Fprintln(w, "@@||ok.ads.example.com^")
+		case "/hosts":
+			fmt.Fprintln(w, "0.0.0.0 ads.example.com")
+			fmt.Fprintln(w, "0.0.0.0 malware.example.com")
+		default:
+			fmt.Fprintln(w, "<html>not a list</html>")
+		}
+	}))
+	defer srv.Close()
+
+	m := New(config.BlocklistConfig{
+		Enabled: true,
+		Lists: []config.BlocklistSource{
+			{Name: "ads", URL: srv.URL + "/ads.txt"},
+			{Name: "hosts", URL: srv.URL + "/hosts"},
+			{Name: "broken", URL: srv.URL + "/broken"},
+		},
+	}, t.TempDir())
+
+	start := time.Now().Add(-time.Minute)
+	m.Update(false)
+
+	if name, ok := m.Match("www.ads.example.com"); !ok || name != "ads" {
+		t.Fatalf("expected first matching list to win, got %q %v", name, ok)
+	}
+	if name, ok := m.Match("malware.example.com"); !ok || name != "hosts" {
+		t.Fatalf("expected hosts list match, got %q %v", name, ok)
+	}
+	if _, ok := m.Match("ok.ads.example.com"); ok {
+		t.Fatal("expected allow rule to override block rules")
+	}
+	if m.Action() != "reject" {
+		t.Fatalf("expected default action reject, got %q", m.Action())
+	}
+	if !m.Outdated(start) {
+		t.Fatal("expected failed list to be reported as outdated")
+	}
+
+	stats := m.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("expected stats for 3 lists, got %d", len(stats))
+	}
+	ads := stats[0].(map[string]interface{})
+	if ads["rules"].(int) != 2 || ads["hits"].(int64) != 1 {
+		t.Fatalf("unexpected stats for ads list: %v", ads)
+	}
+	broken := stats[2].(map[string]interface{})
+	if broken["error"].(string) == "" {
+		t.Fatalf("expected validation error for broken list, got %v", broken)
+	}
+}
+
+func TestNilManagerIsNoop(t *testing.T) {
+	m := New(config.BlocklistConfig{Enabled: true}, t.TempDir())
+	if m != nil {
+		t.Fatal("expected no manager without lists")
+	}
+	if _, ok := m.Match("ads.example.com"); ok {
+		t.Fatal("expected nil manager never to match")
+	}
+	m.Update(true)
+	if m.Outdated(time.Now()) {
+		t.Fatal("expected nil manager never to be outdated")
+	}
+}
@@ -0,0 +1,153 @@
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"doh-autoproxy/internal/domaintrie"
+
+	"github.com/miekg/dns"
+)
+
+type ruleSet struct {
+	block *domaintrie.Trie
+	allow *domaintrie.Trie
+}
+
+// hosts 文件中常见的本机条目，不视为拦截规则
+var hostsSkipNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// Verify is a util.Validator that rejects downloads containing no usable
+// rules, e.g. an HTML error page served with status 200.
+func Verify(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rs, err := parse(f)
+	if err != nil {
+		return err
+	}
+	if rs.block.Len() == 0 && rs.allow.Len() == 0 {
+		return fmt.Errorf("未解析到任何有效规则")
+	}
+	return nil
+}
+
+// parse reads a rule list line by line. Hosts-file, AdGuard/ABP
+// ("||domain^", "@@||domain^") and plain domain-list lines may be mixed;
+// anything else (cosmetic rules, regexps, unsupported modifiers) is skipped.
+func parse(r io.Reader) (*ruleSet, error) {
+	rs := &ruleSet{block: domaintrie.New(), allow: domaintrie.New()}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "@@") {
+			if domain, mode, ok := parseAdGuardRule(line[2:]); ok {
+				rs.allow.Insert(domain, mode, "")
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "||") {
+			if domain, mode, ok := parseAdGuardRule(line); ok {
+				rs.block.Insert(domain, mode, "")
+			}
+			continue
+		}
+
+		// 行尾注释需以空白分隔，避免误截 example.com##.banner 这类元素隐藏规则
+		if idx := strings.IndexAny(line, " \t"); idx >= 0 {
+			if c := strings.Index(line[idx:], "#"); c >= 0 {
+				line = line[:idx+c]
+			}
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 2 && net.ParseIP(fields[0]) != nil:
+			for _, name := range fields[1:] {
+				name = strings.ToLower(strings.TrimSuffix(name, "."))
+				if hostsSkipNames[name] || !validDomain(name) {
+					continue
+				}
+				rs.block.Insert(name, domaintrie.MatchExact, "")
+			}
+		case len(fields) == 1:
+			name := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+			mode := domaintrie.MatchDomain
+			if strings.HasPrefix(name, "*.") {
+				name = name[2:]
+				mode = domaintrie.MatchSubdomains
+			}
+			if validDomain(name) {
+				rs.block.Insert(name, mode, "")
+			}
+		}
+	}
+
+	return rs, scanner.Err()
+}
+
+// parseAdGuardRule handles the "||domain^" subset of the AdGuard/ABP syntax
+// that can be expressed at the DNS level.
+func parseAdGuardRule(rule string) (string, domaintrie.Mode, bool) {
+	if !strings.HasPrefix(rule, "||") {
+		return "", 0, false
+	}
+	rule = rule[2:]
+
+	if idx := strings.Index(rule, "$"); idx >= 0 {
+		// 仅支持不改变语义的 important 修饰符
+		for _, modifier := range strings.Split(rule[idx+1:], ",") {
+			if modifier != "important" {
+				return "", 0, false
+			}
+		}
+		rule = rule[:idx]
+	}
+
+	rule = strings.TrimSuffix(rule, "|")
+	if !strings.HasSuffix(rule, "^") {
+		return "", 0, false
+	}
+	domain := strings.ToLower(strings.TrimSuffix(rule, "^"))
+	if !validDomain(domain) {
+		return "", 0, false
+	}
+	return domain, domaintrie.MatchDomain, true
+}
+
+func validDomain(name string) bool {
+	if name == "" || !strings.Contains(name, ".") || net.ParseIP(name) != nil {
+		return false
+	}
+	if strings.ContainsAny(name, "*/|^$#") {
+		return false
+	}
+	_, ok := dns.IsDomainName(name)
+	return ok
+}
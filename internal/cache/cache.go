@@ -0,0 +1,560 @@
+package cache
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultSize           = 4096
+	defaultMaxTTL         = 86400
+	defaultNegativeTTL    = 30
+	defaultMaxNegativeTTL = 3600
+	defaultStaleTTL       = 30
+	defaultStaleMaxAge    = 86400
+	defaultPrefetchHits   = 2
+)
+
+// Key identifies a cached answer. Route is the routing decision that produced
+// the answer, so the same name resolved through different upstream groups
+// never shares an entry. Subnet is set on answers an upstream scoped to a
+// client network with ECS (RFC 7871 section 7.3.1); Set fills it in.
+type Key struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	DO     bool
+	Route  string
+	Subnet string
+}
+
+func NewKey(req *dns.Msg, route string) Key {
+	q := req.Question[0]
+	key := Key{
+		Name:   strings.ToLower(dns.Fqdn(q.Name)),
+		Qtype:  q.Qtype,
+		Qclass: q.Qclass,
+		Route:  route,
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		key.DO = opt.Do()
+	}
+	return key
+}
+
+type entry struct {
+	key         Key
+	msg         *dns.Msg
+	upstream    string
+	ttl         uint32
+	storedAt    time.Time
+	expireAt    time.Time
+	hits        int64
+	prefetching bool
+}
+
+type Cache struct {
+	mu    sync.Mutex
+	cfg   config.CacheConfig
+	ll    *list.List
+	items map[Key]*list.Element
+	now   func() time.Time
+
+	// scopes 记录每个 Key 下已缓存的 ECS 作用域前缀长度及条目数，供 Match 查找
+	scopes map[Key]map[scopeLen]int
+
+	hits       int64
+	misses     int64
+	evictions  int64
+	staleHits  int64
+	prefetches int64
+}
+
+// New returns nil when caching is disabled; all methods treat a nil *Cache
+// as an always-empty cache.
+func New(cfg config.CacheConfig) *Cache {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Size <= 0 {
+		cfg.Size = defaultSize
+	}
+	if cfg.MaxTTL == 0 {
+		cfg.MaxTTL = defaultMaxTTL
+	}
+	if cfg.NegativeTTL == 0 {
+		cfg.NegativeTTL = defaultNegativeTTL
+	}
+	if cfg.MaxNegativeTTL == 0 {
+		cfg.MaxNegativeTTL = defaultMaxNegativeTTL
+	}
+	if cfg.MinTTL > cfg.MaxTTL {
+		cfg.MinTTL = cfg.MaxTTL
+	}
+	if cfg.StaleTTL == 0 {
+		cfg.StaleTTL = defaultStaleTTL
+	}
+	if cfg.StaleMaxAge == 0 {
+		cfg.StaleMaxAge = defaultStaleMaxAge
+	}
+	if cfg.PrefetchMinHits <= 0 {
+		cfg.PrefetchMinHits = defaultPrefetchHits
+	}
+
+	return &Cache{
+		cfg:    cfg,
+		ll:     list.New(),
+		items:  make(map[Key]*list.Element),
+		now:    time.Now,
+		scopes: make(map[Key]map[scopeLen]int),
+	}
+}
+
+// SetClock replaces the time source, letting tests in other packages age
+// entries without sleeping.
+func (c *Cache) SetClock(now func() time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+type scopeLen struct {
+	bits, ones int
+}
+
+// Match returns the key of the entry that answers key for a client at addr:
+// the most specific ECS-scoped entry whose network contains addr, or key
+// itself for answers valid everywhere.
+func (c *Cache) Match(key Key, addr net.IP) Key {
+	if c == nil || addr == nil {
+		return key
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	best, bestOnes := key, -1
+	for scope := range c.scopes[key] {
+		if scope.ones <= bestOnes {
+			continue
+		}
+		network := maskAddr(addr, scope)
+		if network == "" {
+			continue
+		}
+		scoped := key
+		scoped.Subnet = network
+		if _, ok := c.items[scoped]; ok {
+			best, bestOnes = scoped, scope.ones
+		}
+	}
+	return best
+}
+
+// responseScope returns the network an answer is limited to by the ECS
+// option an upstream echoed, if the scope prefix is not zero.
+func responseScope(resp *dns.Msg) (string, scopeLen, bool) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return "", scopeLen{}, false
+	}
+	for _, o := range opt.Option {
+		subnet, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok || subnet.SourceScope == 0 {
+			continue
+		}
+		scope := scopeLen{bits: 32, ones: int(subnet.SourceScope)}
+		if subnet.Family == 2 {
+			scope.bits = 128
+		}
+		// 作用域比请求的前缀更长时只能精确到请求的前缀
+		if int(subnet.SourceNetmask) < scope.ones {
+			scope.ones = int(subnet.SourceNetmask)
+		}
+		if scope.ones == 0 || scope.ones > scope.bits {
+			return "", scopeLen{}, false
+		}
+		network := maskAddr(subnet.Address, scope)
+		return network, scope, network != ""
+	}
+	return "", scopeLen{}, false
+}
+
+func maskAddr(addr net.IP, scope scopeLen) string {
+	if scope.bits == 32 {
+		addr = addr.To4()
+	} else if addr.To4() != nil {
+		return ""
+	}
+	if addr == nil {
+		return ""
+	}
+	network := net.IPNet{IP: addr.Mask(net.CIDRMask(scope.ones, scope.bits)), Mask: net.CIDRMask(scope.ones, scope.bits)}
+	return network.String()
+}
+
+// Get returns a copy of the cached response with TTLs reduced by the time
+// spent in the cache, together with the upstream label it was stored with.
+func (c *Cache) Get(key Key) (*dns.Msg, string, bool) {
+	if c == nil {
+		return nil, "", false
+	}
+
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, "", false
+	}
+
+	e := elem.Value.(*entry)
+	if !now.Before(e.expireAt) {
+		// 过期条目在 serve-stale 窗口内保留，供上游故障时兜底
+		if !c.retainable(e, now) {
+			c.removeElement(elem)
+		}
+		c.misses++
+		return nil, "", false
+	}
+
+	c.ll.MoveToFront(elem)
+	c.hits++
+	e.hits++
+
+	elapsed := uint32(now.Sub(e.storedAt) / time.Second)
+	return ageMsg(e.msg, elapsed), e.upstream, true
+}
+
+// GetStale returns an expired answer that is still inside the serve-stale
+// window (RFC 8767). All TTLs are rewritten to the configured stale TTL so
+// clients come back soon for a fresh answer.
+func (c *Cache) GetStale(key Key) (*dns.Msg, string, bool) {
+	if c == nil || !c.cfg.ServeStale {
+		return nil, "", false
+	}
+
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, "", false
+	}
+
+	e := elem.Value.(*entry)
+	if now.Before(e.expireAt) {
+		return nil, "", false
+	}
+	if !c.retainable(e, now) {
+		c.removeElement(elem)
+		return nil, "", false
+	}
+
+	c.staleHits++
+	return staleMsg(e.msg, c.cfg.StaleTTL), e.upstream, true
+}
+
+// ShouldPrefetch reports whether a popular entry is close to expiry and
+// claims the refresh for the caller. Callers that get true must call
+// PrefetchDone once the background refresh finishes.
+func (c *Cache) ShouldPrefetch(key Key) bool {
+	if c == nil || !c.cfg.Prefetch {
+		return false
+	}
+
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return false
+	}
+
+	e := elem.Value.(*entry)
+	if e.prefetching || e.hits < int64(c.cfg.PrefetchMinHits) {
+		return false
+	}
+
+	remaining := e.expireAt.Sub(now)
+	threshold := time.Duration(e.ttl) * time.Second / 10
+	if threshold < time.Second {
+		threshold = time.Second
+	}
+	if remaining <= 0 || remaining > threshold {
+		return false
+	}
+
+	e.prefetching = true
+	c.prefetches++
+	return true
+}
+
+func (c *Cache) PrefetchDone(key Key) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*entry).prefetching = false
+	}
+}
+
+// Set stores resp under key if it is cacheable. Positive answers use the
+// smallest record TTL; negative answers (NXDOMAIN/NODATA) follow RFC 2308 and
+// use the SOA minimum from the authority section. Answers with a non-zero
+// ECS scope are only served to clients inside that network.
+func (c *Cache) Set(key Key, resp *dns.Msg, upstream string) {
+	if c == nil || resp == nil {
+		return
+	}
+
+	ttl, ok := c.ttlFor(resp)
+	if !ok {
+		return
+	}
+
+	key.Subnet = ""
+	network, scope, scoped := responseScope(resp)
+	base := key
+	if scoped {
+		key.Subnet = network
+	}
+
+	now := c.now()
+	e := &entry{
+		key:      key,
+		msg:      resp.Copy(),
+		upstream: upstream,
+		ttl:      ttl,
+		storedAt: now,
+		expireAt: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		// 保留命中计数，热门条目刷新后仍可继续预取
+		e.hits = elem.Value.(*entry).hits
+		elem.Value = e
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(e)
+	if scoped {
+		if c.scopes[base] == nil {
+			c.scopes[base] = make(map[scopeLen]int)
+		}
+		c.scopes[base][scope]++
+	}
+	for c.ll.Len() > c.cfg.Size {
+		c.removeElement(c.ll.Back())
+		c.evictions++
+	}
+}
+
+func (c *Cache) Flush() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[Key]*list.Element)
+	c.scopes = make(map[Key]map[scopeLen]int)
+}
+
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *Cache) Stats() map[string]interface{} {
+	if c == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hitRatio := float64(0)
+	if total := c.hits + c.misses; total > 0 {
+		hitRatio = float64(c.hits) / float64(total)
+	}
+
+	return map[string]interface{}{
+		"enabled":    true,
+		"size":       c.ll.Len(),
+		"capacity":   c.cfg.Size,
+		"hits":       c.hits,
+		"misses":     c.misses,
+		"evictions":  c.evictions,
+		"stale_hits": c.staleHits,
+		"prefetches": c.prefetches,
+		"hit_ratio":  hitRatio,
+	}
+}
+
+func (c *Cache) retainable(e *entry, now time.Time) bool {
+	if !c.cfg.ServeStale {
+		return false
+	}
+	return now.Before(e.expireAt.Add(time.Duration(c.cfg.StaleMaxAge) * time.Second))
+}
+
+func (c *Cache) removeElement(elem *list.Element) {
+	if elem == nil {
+		return
+	}
+	c.ll.Remove(elem)
+	key := elem.Value.(*entry).key
+	delete(c.items, key)
+	if key.Subnet == "" {
+		return
+	}
+
+	_, scope, _ := responseScope(elem.Value.(*entry).msg)
+	key.Subnet = ""
+	if counts := c.scopes[key]; counts != nil {
+		if counts[scope]--; counts[scope] <= 0 {
+			delete(counts, scope)
+		}
+		if len(counts) == 0 {
+			delete(c.scopes, key)
+		}
+	}
+}
+
+func (c *Cache) ttlFor(resp *dns.Msg) (uint32, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && hasAnswerRecords(resp):
+		ttl, ok := minTTL(resp.Answer)
+		if !ok {
+			return 0, false
+		}
+		if ttl < c.cfg.MinTTL {
+			ttl = c.cfg.MinTTL
+		}
+		if ttl > c.cfg.MaxTTL {
+			ttl = c.cfg.MaxTTL
+		}
+		return ttl, ttl > 0
+	case resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError:
+		ttl := c.cfg.NegativeTTL
+		if soaTTL, ok := negativeTTL(resp); ok {
+			ttl = soaTTL
+		}
+		if ttl > c.cfg.MaxNegativeTTL {
+			ttl = c.cfg.MaxNegativeTTL
+		}
+		return ttl, ttl > 0
+	default:
+		// SERVFAIL/REFUSED 等属于临时错误，不缓存
+		return 0, false
+	}
+}
+
+func hasAnswerRecords(resp *dns.Msg) bool {
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			return true
+		}
+	}
+	return false
+}
+
+func minTTL(rrs []dns.RR) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		if !found || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			found = true
+		}
+	}
+	return ttl, found
+}
+
+// negativeTTL implements RFC 2308 section 5: the negative TTL is the minimum
+// of the SOA record's own TTL and its MINIMUM field.
+func negativeTTL(resp *dns.Msg) (uint32, bool) {
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+func ageMsg(msg *dns.Msg, elapsed uint32) *dns.Msg {
+	aged := msg.Copy()
+	for _, section := range [][]dns.RR{aged.Answer, aged.Ns, aged.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return aged
+}
+
+func staleMsg(msg *dns.Msg, ttl uint32) *dns.Msg {
+	stale := msg.Copy()
+	for _, section := range [][]dns.RR{stale.Answer, stale.Ns, stale.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = ttl
+		}
+	}
+	return stale
+}
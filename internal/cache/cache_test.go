@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+func newTestCache(size int) *Cache {
+	return New(config.CacheConfig{
+		Enabled:        true,
+		Size:           size,
+		MaxTTL:         3600,
+		NegativeTTL:    30,
+		MaxNegativeTTL: 600,
+	})
+}
+
+func answerFor(req *dns.Msg, ttl uint32) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("1.2.3.4").To4(),
+	})
+	return resp
+}
+
+func TestCacheKeySeparatesRouteAndDOBit(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("Example.COM.", dns.TypeA)
+
+	c := newTestCache(16)
+	c.Set(NewKey(req, "Rule(CN)"), answerFor(req, 300), "Rule(CN)")
+
+	if _, _, ok := c.Get(NewKey(req, "Rule(CN)")); !ok {
+		t.Fatal("expected cache hit for same question and route")
+	}
+	if _, _, ok := c.Get(NewKey(req, "Rule(Overseas)")); ok {
+		t.Fatal("expected cache miss for a different routing decision")
+	}
+
+	doReq := req.Copy()
+	doReq.SetEdns0(4096, true)
+	if _, _, ok := c.Get(NewKey(doReq, "Rule(CN)")); ok {
+		t.Fatal("expected cache miss when DO bit differs")
+	}
+}
+
+func TestCacheUsesSOAMinimumForNegativeAnswers(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("missing.example.com.", dns.TypeA)
+
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeNameError)
+	resp.Ns = append(resp.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 120,
+	})
+
+	c := newTestCache(16)
+	ttl, ok := c.ttlFor(resp)
+	if !ok || ttl != 120 {
+		t.Fatalf("expected negative TTL 120 from SOA minimum, got %d (ok=%v)", ttl, ok)
+	}
+
+	resp.Ns = nil
+	ttl, ok = c.ttlFor(resp)
+	if !ok || ttl != 30 {
+		t.Fatalf("expected configured negative TTL without SOA, got %d (ok=%v)", ttl, ok)
+	}
+
+	resp.Rcode = dns.RcodeServerFailure
+	if _, ok := c.ttlFor(resp); ok {
+		t.Fatal("expected SERVFAIL not to be cacheable")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTestCache(2)
+
+	names := []string{"a.example.", "b.example.", "c.example."}
+	keys := make([]Key, len(names))
+	for i, name := range names {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		keys[i] = NewKey(req, "GeoIP")
+		c.Set(keys[i], answerFor(req, 300), "GeoIP(Overseas)")
+		if i == 1 {
+			c.Get(keys[0])
+		}
+	}
+
+	if c.Len() != 2 {
+		t.Fatalf("expected cache to be bounded at 2 entries, got %d", c.Len())
+	}
+	if _, _, ok := c.Get(keys[1]); ok {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+	if _, _, ok := c.Get(keys[0]); !ok {
+		t.Fatal("expected recently used entry to survive eviction")
+	}
+}
+
+func TestNilCacheIsNoop(t *testing.T) {
+	var c *Cache
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	c.Set(NewKey(req, "GeoIP"), answerFor(req, 300), "GeoIP(Overseas)")
+	if _, _, ok := c.Get(NewKey(req, "GeoIP")); ok {
+		t.Fatal("expected nil cache to never hit")
+	}
+	c.Flush()
+}
+
+func TestCacheServesStaleWithinWindow(t *testing.T) {
+	c := New(config.CacheConfig{
+		Enabled:     true,
+		ServeStale:  true,
+		StaleTTL:    30,
+		StaleMaxAge: 600,
+	})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	req := new(dns.Msg)
+	req.SetQuestion("stale.example.", dns.TypeA)
+	key := NewKey(req, "GeoIP")
+	c.Set(key, answerFor(req, 60), "GeoIP(Overseas)")
+
+	if _, _, ok := c.GetStale(key); ok {
+		t.Fatal("expected fresh entry not to be returned as stale")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, _, ok := c.Get(key); ok {
+		t.Fatal("expected expired entry to miss on Get")
+	}
+	resp, upstream, ok := c.GetStale(key)
+	if !ok {
+		t.Fatal("expected expired entry to be served stale")
+	}
+	if upstream != "GeoIP(Overseas)" {
+		t.Fatalf("unexpected upstream label %q", upstream)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 30 {
+		t.Fatalf("expected stale TTL 30, got %d", ttl)
+	}
+
+	now = now.Add(time.Hour)
+	if _, _, ok := c.GetStale(key); ok {
+		t.Fatal("expected entry past the stale window to be dropped")
+	}
+}
+
+func TestCachePrefetchesPopularEntriesNearExpiry(t *testing.T) {
+	c := New(config.CacheConfig{Enabled: true, Prefetch: true, PrefetchMinHits: 2})
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	req := new(dns.Msg)
+	req.SetQuestion("popular.example.", dns.TypeA)
+	key := NewKey(req, "GeoIP")
+	c.Set(key, answerFor(req, 100), "GeoIP(Overseas)")
+
+	c.Get(key)
+	c.Get(key)
+	if c.ShouldPrefetch(key) {
+		t.Fatal("expected no prefetch while plenty of TTL remains")
+	}
+
+	now = now.Add(95 * time.Second)
+	if !c.ShouldPrefetch(key) {
+		t.Fatal("expected popular entry near expiry to be prefetched")
+	}
+	if c.ShouldPrefetch(key) {
+		t.Fatal("expected concurrent prefetch of the same entry to be suppressed")
+	}
+	c.PrefetchDone(key)
+}
+
+func TestCacheHonoursECSScope(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("cdn.example.", dns.TypeA)
+	key := NewKey(req, "GeoIP")
+
+	scoped := func(addr string, source, scope uint8) *dns.Msg {
+		resp := answerFor(req, 300)
+		resp.SetEdns0(1232, false)
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: source, SourceScope: scope,
+			Address: net.ParseIP(addr).To4(),
+		})
+		return resp
+	}
+
+	c := newTestCache(16)
+	c.Set(key, scoped("203.0.113.0", 24, 16), "GeoIP")
+
+	if got := c.Match(key, net.ParseIP("203.0.200.9")); got.Subnet != "203.0.0.0/16" {
+		t.Fatalf("expected the /16 scoped entry for a client in scope, got %+v", got)
+	}
+	if _, _, ok := c.Get(c.Match(key, net.ParseIP("198.51.100.1"))); ok {
+		t.Fatal("expected no answer for a client outside the scope")
+	}
+	if _, _, ok := c.Get(key); ok {
+		t.Fatal("expected scoped answers not to be stored globally")
+	}
+
+	// 作用域为 0 的应答对所有客户端有效
+	c.Set(key, scoped("198.51.100.0", 24, 0), "GeoIP")
+	if got := c.Match(key, net.ParseIP("198.51.100.1")); got != key {
+		t.Fatalf("expected the global entry, got %+v", got)
+	}
+	if got := c.Match(key, net.ParseIP("203.0.113.1")); got.Subnet != "203.0.0.0/16" {
+		t.Fatalf("expected the scoped entry to win for its network, got %+v", got)
+	}
+
+	c.Flush()
+	if len(c.scopes) != 0 {
+		t.Fatalf("expected flush to forget scopes, got %v", c.scopes)
+	}
+}
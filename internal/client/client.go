@@ -3,9 +3,9 @@ package client
 import (
 	"context"
 	"fmt"
-	"net"
 
 	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/edns"
 	"doh-autoproxy/internal/resolver"
 
 	"github.com/miekg/dns"
@@ -20,70 +20,88 @@ type lifecycleDNSClient interface {
 }
 
 func NewDNSClient(cfg config.UpstreamServer, bootstrapper *resolver.Bootstrapper) (DNSClient, error) {
+	var c DNSClient
 	switch cfg.Protocol {
 	case "udp":
-		return NewUDPClient(cfg, bootstrapper), nil
+		c = NewUDPClient(cfg, bootstrapper)
 	case "tcp":
-		return NewTCPClient(cfg, bootstrapper), nil
+		c = NewTCPClient(cfg, bootstrapper)
 	case "dot":
-		return NewDoTClient(cfg, bootstrapper), nil
+		c = NewDoTClient(cfg, bootstrapper)
 	case "doh":
-		return NewDoHClient(cfg, bootstrapper), nil
+		c = NewDoHClient(cfg, bootstrapper)
 	case "doq":
-		return NewDoQClient(cfg, bootstrapper), nil
+		c = NewDoQClient(cfg, bootstrapper)
 	default:
 		return nil, fmt.Errorf("不支持的上游协议: %s", cfg.Protocol)
 	}
-}
 
-func CloseDNSClient(c DNSClient) error {
-	if c == nil {
-		return nil
+	wrapped := &ednsClient{
+		DNSClient: c,
+		ecs:       newECSPolicy(cfg),
+		padding:   cfg.Padding && cfg.Protocol != "udp" && cfg.Protocol != "tcp",
 	}
-	if closer, ok := c.(lifecycleDNSClient); ok {
-		return closer.Close()
+	if wrapped.ecs.mode == config.ECSPassthrough && !wrapped.padding {
+		return c, nil
 	}
-	return nil
+	return wrapped, nil
 }
 
-func ensureECS(req *dns.Msg, ecsIP string) {
-	if ecsIP == "" {
-		return
-	}
+// ednsClient prepares the EDNS options of every query to one upstream: the
+// ECS policy first, then padding on encrypted transports, which must come
+// last so the padded length is final.
+type ednsClient struct {
+	DNSClient
+	ecs     ecsPolicy
+	padding bool
+}
 
-	ip := net.ParseIP(ecsIP)
-	if ip == nil {
-		return
+func (c *ednsClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	hadOPT := req.IsEdns0() != nil
+	scoped := c.ecs.apply(ctx, req)
+	if c.padding {
+		if req.IsEdns0() == nil {
+			req.SetEdns0(1232, false)
+		}
+		edns.Pad(req, edns.QueryBlockSize)
 	}
 
-	opt := req.IsEdns0()
-	if opt == nil {
-		req.SetEdns0(4096, false)
-		opt = req.IsEdns0()
+	resp, err := c.DNSClient.Resolve(ctx, req)
+	if resp == nil {
+		return resp, err
 	}
-
-	if opt == nil {
-		return
+	if !hadOPT {
+		// OPT 是为 ECS 或填充加上的，客户端没有协商 EDNS
+		removeOPT(resp)
+	} else if opt := resp.IsEdns0(); opt != nil {
+		// 填充只在本跳有效；不取自客户端的 ECS 对所有客户端都一样，去掉后应答可全局缓存
+		edns.Strip(opt, func(code uint16) bool {
+			return code != dns.EDNS0PADDING && (scoped || code != dns.EDNS0SUBNET)
+		})
 	}
+	return resp, err
+}
+
+func (c *ednsClient) Close() error {
+	return CloseDNSClient(c.DNSClient)
+}
 
-	var newOptions []dns.EDNS0
-	for _, o := range opt.Option {
-		if o.Option() != dns.EDNS0SUBNET {
-			newOptions = append(newOptions, o)
+func removeOPT(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
 		}
 	}
+	msg.Extra = extra
+}
 
-	e := new(dns.EDNS0_SUBNET)
-	e.Code = dns.EDNS0SUBNET
-	if ipv4 := ip.To4(); ipv4 != nil {
-		e.Family = 1
-		e.SourceNetmask = 24
-		e.Address = ipv4
-	} else {
-		e.Family = 2
-		e.SourceNetmask = 56
-		e.Address = ip
+func CloseDNSClient(c DNSClient) error {
+	if c == nil {
+		return nil
 	}
-	newOptions = append(newOptions, e)
-	opt.Option = newOptions
+	if closer, ok := c.(lifecycleDNSClient); ok {
+		return closer.Close()
+	}
+	return nil
 }
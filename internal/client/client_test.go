@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestEDNSClientPadsEncryptedQueries(t *testing.T) {
+	c := &ednsClient{
+		DNSClient: echoClient{},
+		ecs:       newECSPolicy(config.UpstreamServer{ECS: config.ECSPassthrough}),
+		padding:   true,
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp, err := c.Resolve(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Len()%128 != 0 {
+		t.Fatalf("expected query padded to a multiple of 128, got %d", req.Len())
+	}
+	if resp.IsEdns0() != nil {
+		t.Fatalf("expected OPT added for padding removed for a non-EDNS client, got %v", resp.IsEdns0())
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	resp, _ = c.Resolve(context.Background(), req)
+	if opt := resp.IsEdns0(); opt == nil || len(opt.Option) != 0 {
+		t.Fatalf("expected echoed padding stripped from the response, got %v", opt)
+	}
+}
+
+func TestNewDNSClientPadsOnlyEncryptedProtocols(t *testing.T) {
+	for protocol, want := range map[string]bool{"udp": false, "tcp": false, "dot": true, "doh": true, "doq": true} {
+		c, err := NewDNSClient(config.UpstreamServer{Address: "127.0.0.1:53", Protocol: protocol, ECS: config.ECSPassthrough, Padding: true}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped, ok := c.(*ednsClient)
+		if got := ok && wrapped.padding; got != want {
+			t.Errorf("%s: padding = %v, want %v", protocol, got, want)
+		}
+		CloseDNSClient(c)
+	}
+}
@@ -138,8 +138,6 @@ func (c *DoHClient) getOrCreateQUICTransport() (*quic.Transport, error) {
 }
 
 func (c *DoHClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	ensureECS(req, c.cfg.ECSIP)
-
 	msgBuf, err := req.Pack()
 	if err != nil {
 		return nil, fmt.Errorf("打包DNS消息失败: %w", err)
@@ -4,10 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"doh-autoproxy/internal/config"
@@ -17,90 +19,241 @@ import (
 	"github.com/quic-go/quic-go"
 )
 
+// DoQ 错误码 (RFC 9250 section 4.3)
+const (
+	doqNoError          = 0x0
+	doqRequestCancelled = 0x3
+)
+
+var errDoQClosed = errors.New("DoQ 客户端已关闭")
+
+// DoQClient keeps one QUIC connection per upstream and sends every query on
+// its own stream (RFC 9250 section 5.5). The connection is redialled after
+// an idle timeout or error, resuming the TLS session with 0-RTT when the
+// server allows it.
 type DoQClient struct {
 	cfg          config.UpstreamServer
 	bootstrapper *resolver.Bootstrapper
+	tlsConfig    *tls.Config
+	quicConfig   *quic.Config
+
+	// lifetime 在 Close 时取消，中止进行中的拨号
+	lifetime context.Context
+	cancel   context.CancelFunc
+
+	mu      sync.Mutex
+	conn    *quic.Conn
+	dialing *doqDial
+	closed  bool
+}
+
+// doqDial is a dial in progress, shared by every query waiting for it.
+type doqDial struct {
+	done chan struct{}
+	conn *quic.Conn
+	err  error
 }
 
 func NewDoQClient(cfg config.UpstreamServer, b *resolver.Bootstrapper) *DoQClient {
+	host, _, _ := net.SplitHostPort(doqAddress(cfg.Address))
+	lifetime, cancel := context.WithCancel(context.Background())
 	return &DoQClient{
 		cfg:          cfg,
 		bootstrapper: b,
+		tlsConfig: &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+			NextProtos:         []string{"doq"},
+			// 重连时恢复会话，服务端允许时可直接发送 0-RTT 数据
+			ClientSessionCache: tls.NewLRUClientSessionCache(4),
+		},
+		quicConfig: &quic.Config{
+			MaxIdleTimeout: 30 * time.Second,
+		},
+		lifetime: lifetime,
+		cancel:   cancel,
 	}
 }
 
-func (c *DoQClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	ensureECS(req, c.cfg.ECSIP)
+func doqAddress(address string) string {
+	addr := strings.TrimPrefix(address, "quic://")
+	if !strings.Contains(addr, ":") {
+		addr = net.JoinHostPort(addr, "853")
+	}
+	return addr
+}
 
-	msgBuf, err := req.Pack()
+func (c *DoQClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// QUIC 上的查询 ID 必须为 0，应答由流对应 (RFC 9250 section 4.2.1)
+	query := req.Copy()
+	query.Id = 0
+	msgBuf, err := query.Pack()
 	if err != nil {
 		return nil, fmt.Errorf("打包DNS消息失败: %w", err)
 	}
 
-	addrStr := strings.TrimPrefix(c.cfg.Address, "quic://")
-	if !strings.Contains(addrStr, ":") {
-		addrStr = net.JoinHostPort(addrStr, "853")
-	}
-
-	host, port, err := net.SplitHostPort(addrStr)
+	conn, err := c.getConn(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	ip, err := c.bootstrapper.LookupIP(ctx, host)
+	resp, err := c.exchange(ctx, conn, msgBuf)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// 0-RTT 数据被拒时等握手完成后在同一连接上重发
+		if _, err = conn.NextConnection(ctx); err == nil {
+			resp, err = c.exchange(ctx, conn, msgBuf)
+		}
+	}
+	if err != nil && ctx.Err() == nil && conn.Context().Err() != nil {
+		// 连接已失效（空闲超时、服务端关闭），换新连接重试一次
+		c.dropConn(conn)
+		if conn, err = c.getConn(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = c.exchange(ctx, conn, msgBuf)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	targetAddr := net.JoinHostPort(ip, port)
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// getConn returns the shared connection, joining or starting a dial when
+// there is none. The dial is not tied to the query that started it, so a
+// cancelled query does not abort it for the others waiting.
+func (c *DoQClient) getConn(ctx context.Context) (*quic.Conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errDoQClosed
+	}
+	if c.conn != nil && c.conn.Context().Err() == nil {
+		conn := c.conn
+		c.mu.Unlock()
+		return conn, nil
+	}
+	d := c.dialing
+	if d == nil {
+		d = &doqDial{done: make(chan struct{})}
+		c.dialing = d
+		go c.dial(d)
+	}
+	c.mu.Unlock()
 
-	tlsConfig := &tls.Config{
-		ServerName:         host,
-		InsecureSkipVerify: c.cfg.InsecureSkipVerify,
-		NextProtos:         []string{"doq"},
+	select {
+	case <-d.done:
+		return d.conn, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+}
+
+func (c *DoQClient) dial(d *doqDial) {
+	ctx, cancel := context.WithTimeout(c.lifetime, 5*time.Second)
+	defer cancel()
+	conn, err := c.connect(ctx)
 
-	quicConfig := &quic.Config{
-		MaxIdleTimeout: 10 * time.Second,
+	c.mu.Lock()
+	c.dialing = nil
+	if err == nil {
+		if c.closed {
+			conn.CloseWithError(doqNoError, "")
+			conn, err = nil, errDoQClosed
+		} else {
+			c.conn = conn
+		}
 	}
+	d.conn, d.err = conn, err
+	c.mu.Unlock()
+	close(d.done)
+}
 
-	conn, err := quic.DialAddr(ctx, targetAddr, tlsConfig, quicConfig)
+func (c *DoQClient) connect(ctx context.Context) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(doqAddress(c.cfg.Address))
+	if err != nil {
+		return nil, err
+	}
+	ip, err := c.bootstrapper.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := quic.DialAddrEarly(ctx, net.JoinHostPort(ip, port), c.tlsConfig, c.quicConfig)
 	if err != nil {
 		return nil, fmt.Errorf("建立QUIC连接失败: %w", err)
 	}
-	defer conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "Connection closed")
+	return conn, nil
+}
 
+func (c *DoQClient) dropConn(conn *quic.Conn) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+	conn.CloseWithError(doqNoError, "")
+}
+
+func (c *DoQClient) exchange(ctx context.Context, conn *quic.Conn, msgBuf []byte) (*dns.Msg, error) {
 	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("打开QUIC流失败: %w", err)
 	}
-	defer stream.Close()
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelWrite(doqRequestCancelled)
+		stream.CancelRead(doqRequestCancelled)
+	})
+	defer stop()
 
-	length := make([]byte, 2)
-	binary.BigEndian.PutUint16(length, uint16(len(msgBuf)))
-	if _, err := stream.Write(length); err != nil {
-		return nil, fmt.Errorf("写入DNS消息长度失败: %w", err)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
 	}
-	if _, err := stream.Write(msgBuf); err != nil {
+	stream.SetDeadline(deadline)
+
+	packet := make([]byte, 2+len(msgBuf))
+	binary.BigEndian.PutUint16(packet, uint16(len(msgBuf)))
+	copy(packet[2:], msgBuf)
+	if _, err := stream.Write(packet); err != nil {
+		stream.CancelRead(doqRequestCancelled)
 		return nil, fmt.Errorf("写入DNS消息失败: %w", err)
 	}
+	// 查询发送完毕即关闭写方向 (RFC 9250 section 4.2)
+	stream.Close()
 
 	responseLengthBytes := make([]byte, 2)
 	if _, err := io.ReadFull(stream, responseLengthBytes); err != nil {
+		stream.CancelRead(doqRequestCancelled)
 		return nil, fmt.Errorf("读取DoQ响应长度失败: %w", err)
 	}
 	responseLength := binary.BigEndian.Uint16(responseLengthBytes)
 
 	respBuf := make([]byte, responseLength)
 	if _, err := io.ReadFull(stream, respBuf); err != nil {
+		stream.CancelRead(doqRequestCancelled)
 		return nil, fmt.Errorf("读取DoQ响应体失败: %w", err)
 	}
 
 	responseMsg := new(dns.Msg)
-	err = responseMsg.Unpack(respBuf)
-	if err != nil {
+	if err := responseMsg.Unpack(respBuf); err != nil {
 		return nil, fmt.Errorf("解包DoQ响应消息失败: %w", err)
 	}
 
 	return responseMsg, nil
 }
+
+// Close closes the shared connection and aborts a dial in progress; queries
+// after Close fail.
+func (c *DoQClient) Close() error {
+	c.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.CloseWithError(doqNoError, "")
+	c.conn = nil
+	return err
+}
@@ -0,0 +1,239 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+type doqTestServer struct {
+	listener *quic.EarlyListener
+
+	mu      sync.Mutex
+	conns   []*quic.Conn
+	ids     []uint16
+	resumed []bool
+}
+
+func newDoQTestServer(t *testing.T) *doqTestServer {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"doq"},
+	}, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &doqTestServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *doqTestServer) serve(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			// 读到 FIN 说明客户端按 RFC 9250 关闭了写方向
+			buf, err := io.ReadAll(stream)
+			if err != nil || len(buf) < 2 {
+				return
+			}
+			req := new(dns.Msg)
+			if err := req.Unpack(buf[2:]); err != nil {
+				return
+			}
+			<-conn.HandshakeComplete()
+			s.mu.Lock()
+			s.ids = append(s.ids, req.Id)
+			s.resumed = append(s.resumed, conn.ConnectionState().TLS.DidResume)
+			s.mu.Unlock()
+
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1").To4(),
+			})
+			packed, _ := resp.Pack()
+			out := make([]byte, 2+len(packed))
+			binary.BigEndian.PutUint16(out, uint16(len(packed)))
+			copy(out[2:], packed)
+			stream.Write(out)
+		}()
+	}
+}
+
+func (s *doqTestServer) connCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func TestDoQClientReusesConnection(t *testing.T) {
+	server := newDoQTestServer(t)
+	c := NewDoQClient(config.UpstreamServer{
+		Address:            "quic://" + server.listener.Addr().String(),
+		Protocol:           "doq",
+		InsecureSkipVerify: true,
+	}, nil)
+	defer c.Close()
+
+	resolve := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		resp, err := c.Resolve(ctx, req)
+		if err != nil {
+			return err
+		}
+		if resp.Id != req.Id || len(resp.Answer) != 1 {
+			return errors.New("unexpected response: " + resp.String())
+		}
+		return nil
+	}
+
+	if err := resolve(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- resolve()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.connCount(); n != 1 {
+		t.Fatalf("expected concurrent queries to share one connection, got %d", n)
+	}
+
+	// 服务端关闭连接后下次查询自动重连，并恢复 TLS 会话
+	server.mu.Lock()
+	server.conns[0].CloseWithError(doqNoError, "")
+	server.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if err := resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.connCount(); n != 2 {
+		t.Fatalf("expected a reconnect, got %d connections", n)
+	}
+
+	server.mu.Lock()
+	for _, id := range server.ids {
+		if id != 0 {
+			t.Fatalf("expected message ID 0 on the wire, got %d", id)
+		}
+	}
+	if !server.resumed[len(server.resumed)-1] {
+		t.Fatal("expected the reconnect to resume the TLS session")
+	}
+	server.mu.Unlock()
+
+	c.Close()
+	if err := resolve(); !errors.Is(err, errDoQClosed) {
+		t.Fatalf("expected queries after Close to fail, got %v", err)
+	}
+}
+
+func TestDoQClientDialSurvivesCancelledCaller(t *testing.T) {
+	server := newDoQTestServer(t)
+	c := NewDoQClient(config.UpstreamServer{
+		Address:            "quic://" + server.listener.Addr().String(),
+		Protocol:           "doq",
+		InsecureSkipVerify: true,
+	}, nil)
+	defer c.Close()
+
+	// 竞速落败被取消的查询不应中止其他查询共用的拨号
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Resolve(cancelled, testQuery())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := c.Resolve(ctx, testQuery())
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.connCount(); n != 1 {
+		t.Fatalf("expected one shared dial, got %d connections", n)
+	}
+
+	// 关闭后的查询立即失败，不再拨号
+	c.Close()
+	if _, err := c.Resolve(context.Background(), testQuery()); !errors.Is(err, errDoQClosed) {
+		t.Fatalf("expected queries after Close to fail, got %v", err)
+	}
+}
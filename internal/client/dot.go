@@ -31,8 +31,6 @@ func NewDoTClient(cfg config.UpstreamServer, b *resolver.Bootstrapper) *DoTClien
 }
 
 func (c *DoTClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	ensureECS(req, c.cfg.ECSIP)
-
 	if c.cfg.EnablePipeline {
 		return c.resolvePipeline(ctx, req)
 	}
@@ -1,27 +1,19 @@
 package client
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"net"
+	"strings"
+
+	"doh-autoproxy/internal/config"
 
 	"github.com/miekg/dns"
 )
 
 func ExtractECS(req *dns.Msg) string {
-	opt := req.IsEdns0()
-	if opt == nil {
-		return ""
-	}
-
-	for _, option := range opt.Option {
-		subnet, ok := option.(*dns.EDNS0_SUBNET)
-		if !ok {
-			continue
-		}
-		return formatECS(subnet)
-	}
-
-	return ""
+	return formatECS(findECS(req))
 }
 
 func formatECS(subnet *dns.EDNS0_SUBNET) string {
@@ -51,3 +43,181 @@ func formatECS(subnet *dns.EDNS0_SUBNET) string {
 
 	return fmt.Sprintf("%s/%d", masked.String(), prefix)
 }
+
+const (
+	defaultECSPrefixV4 = 24
+	defaultECSPrefixV6 = 56
+)
+
+type clientKey struct{}
+
+type clientInfo struct {
+	ip     net.IP
+	subnet *net.IPNet
+}
+
+// WithClient records the address of the querying client, and the subnet
+// configured for it if any, for upstreams that derive ECS from the client.
+func WithClient(ctx context.Context, ip net.IP, subnet *net.IPNet) context.Context {
+	return context.WithValue(ctx, clientKey{}, clientInfo{ip: ip, subnet: subnet})
+}
+
+// ClientFrom returns what WithClient recorded in ctx.
+func ClientFrom(ctx context.Context) (net.IP, *net.IPNet) {
+	info, _ := ctx.Value(clientKey{}).(clientInfo)
+	return info.ip, info.subnet
+}
+
+// ClientAddr returns the address an ECS option sent for this query would
+// cover: the client's own ECS, the configured subnet or the client IP. Cached
+// answers scoped to a subnet are matched against it.
+func ClientAddr(ctx context.Context, req *dns.Msg) net.IP {
+	if subnet := findECS(req); subnet != nil && subnet.SourceNetmask > 0 {
+		return subnet.Address
+	}
+	ip, subnet := ClientFrom(ctx)
+	if subnet != nil {
+		return subnet.IP
+	}
+	return ip
+}
+
+// ecsPolicy decides the ECS option an upstream receives.
+type ecsPolicy struct {
+	mode             string
+	static           *net.IPNet
+	prefix4, prefix6 int
+}
+
+func newECSPolicy(cfg config.UpstreamServer) ecsPolicy {
+	p := ecsPolicy{
+		mode:    strings.ToLower(strings.TrimSpace(cfg.ECS)),
+		prefix4: cfg.ECSPrefixV4,
+		prefix6: cfg.ECSPrefixV6,
+	}
+	if p.prefix4 <= 0 || p.prefix4 > 32 {
+		p.prefix4 = defaultECSPrefixV4
+	}
+	if p.prefix6 <= 0 || p.prefix6 > 128 {
+		p.prefix6 = defaultECSPrefixV6
+	}
+
+	if cfg.ECSIP != "" {
+		if _, network, err := net.ParseCIDR(cfg.ECSIP); err == nil {
+			p.static = network
+		} else if ip := net.ParseIP(cfg.ECSIP); ip != nil {
+			p.static = p.truncate(ip)
+		} else {
+			log.Printf("忽略无效的 ECS 地址: %s (%s)", cfg.ECSIP, cfg.Address)
+		}
+	}
+
+	switch p.mode {
+	case config.ECSStrip, config.ECSPassthrough, config.ECSClient:
+	case config.ECSStatic:
+		if p.static == nil {
+			log.Printf("上游 %s 的 ECS 为 static 但没有有效的 ecs_ip，改为 strip", cfg.Address)
+			p.mode = config.ECSStrip
+		}
+	default:
+		if p.mode != "" {
+			log.Printf("未知的 ECS 策略 %s (%s)，按默认处理", cfg.ECS, cfg.Address)
+		}
+		p.mode = config.ECSPassthrough
+		if p.static != nil {
+			p.mode = config.ECSStatic
+		}
+	}
+	return p
+}
+
+// truncate masks ip to the prefix length configured for its family.
+func (p ecsPolicy) truncate(ip net.IP) *net.IPNet {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		mask := net.CIDRMask(p.prefix4, 32)
+		return &net.IPNet{IP: ipv4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(p.prefix6, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// apply rewrites the ECS option of req and reports whether the option now
+// depends on the client, in which case the scope of the answer matters.
+func (p ecsPolicy) apply(ctx context.Context, req *dns.Msg) bool {
+	if p.mode == config.ECSPassthrough {
+		return true
+	}
+	// 客户端以 /0 表示不希望透露子网 (RFC 7871 section 7.1.2)
+	if subnet := findECS(req); subnet != nil && subnet.SourceNetmask == 0 && p.mode != config.ECSStrip {
+		return true
+	}
+
+	var subnet *net.IPNet
+	fromClient := false
+	if p.mode != config.ECSStrip {
+		ip, override := ClientFrom(ctx)
+		switch {
+		case override != nil:
+			subnet, fromClient = override, true
+		case p.mode == config.ECSClient && isPublicIP(ip):
+			subnet, fromClient = p.truncate(ip), true
+		default:
+			subnet = p.static
+		}
+	}
+	setECS(req, subnet)
+	return fromClient
+}
+
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// setECS replaces the ECS option of req with subnet, or removes it when
+// subnet is nil.
+func setECS(req *dns.Msg, subnet *net.IPNet) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		if subnet == nil {
+			return
+		}
+		req.SetEdns0(4096, false)
+		opt = req.IsEdns0()
+	}
+
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	if subnet != nil {
+		ones, _ := subnet.Mask.Size()
+		e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(ones)}
+		if ipv4 := subnet.IP.To4(); ipv4 != nil {
+			e.Family = 1
+			e.Address = ipv4
+		} else {
+			e.Family = 2
+			e.Address = subnet.IP
+		}
+		options = append(options, e)
+	}
+	opt.Option = options
+}
+
+func findECS(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if msg == nil {
+		return nil
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package client
 
 import (
+	"context"
 	"net"
 	"testing"
 
+	"doh-autoproxy/internal/config"
+
 	"github.com/miekg/dns"
 )
 
@@ -33,3 +36,86 @@ func TestExtractECSReturnsEmptyWhenMissing(t *testing.T) {
 		t.Fatalf("expected empty ECS, got %q", got)
 	}
 }
+
+func TestECSPolicyModes(t *testing.T) {
+	publicClient := WithClient(context.Background(), net.ParseIP("198.51.100.77"), nil)
+	privateClient := WithClient(context.Background(), net.ParseIP("192.168.1.5"), nil)
+	_, branch, _ := net.ParseCIDR("192.0.2.0/24")
+	branchClient := WithClient(context.Background(), net.ParseIP("10.8.0.3"), branch)
+
+	withClientECS := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(1232, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("203.0.113.0").To4(),
+		})
+		return req
+	}
+
+	for _, tc := range []struct {
+		name   string
+		cfg    config.UpstreamServer
+		ctx    context.Context
+		want   string
+		scoped bool
+	}{
+		{"default passthrough", config.UpstreamServer{}, publicClient, "203.0.113.0/24", true},
+		{"legacy ecs_ip is static", config.UpstreamServer{ECSIP: "114.114.114.114"}, publicClient, "114.114.114.0/24", false},
+		{"strip", config.UpstreamServer{ECS: "strip", ECSIP: "114.114.114.114"}, branchClient, "", false},
+		{"client", config.UpstreamServer{ECS: "client", ECSPrefixV4: 20}, publicClient, "198.51.96.0/20", true},
+		{"client private falls back", config.UpstreamServer{ECS: "client", ECSIP: "1.2.3.0/24"}, privateClient, "1.2.3.0/24", false},
+		{"client private without static", config.UpstreamServer{ECS: "client"}, privateClient, "", false},
+		{"client override", config.UpstreamServer{ECS: "client"}, branchClient, "192.0.2.0/24", true},
+		{"static override", config.UpstreamServer{ECS: "static", ECSIP: "1.2.3.4"}, branchClient, "192.0.2.0/24", true},
+	} {
+		policy := newECSPolicy(tc.cfg)
+		req := withClientECS()
+		scoped := policy.apply(tc.ctx, req)
+		if got := ExtractECS(req); got != tc.want || scoped != tc.scoped {
+			t.Errorf("%s: got %q scoped=%v, want %q scoped=%v", tc.name, got, scoped, tc.want, tc.scoped)
+		}
+	}
+
+	// 客户端以 /0 拒绝透露子网时不再生成 ECS
+	req := withClientECS()
+	req.IsEdns0().Option[0].(*dns.EDNS0_SUBNET).SourceNetmask = 0
+	newECSPolicy(config.UpstreamServer{ECS: "client"}).apply(publicClient, req)
+	if subnet := findECS(req); subnet == nil || subnet.SourceNetmask != 0 {
+		t.Fatalf("expected the /0 opt-out to be kept, got %v", req.IsEdns0())
+	}
+}
+
+type echoClient struct{}
+
+func (echoClient) Resolve(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Extra = append(resp.Extra, dns.Copy(req.IsEdns0()))
+	return resp, nil
+}
+
+func TestECSClientDropsEchoOfStaticSubnet(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+
+	c := &ednsClient{DNSClient: echoClient{}, ecs: newECSPolicy(config.UpstreamServer{ECSIP: "114.114.114.114"})}
+	resp, err := c.Resolve(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ExtractECS(req) != "114.114.114.0/24" || ExtractECS(resp) != "" {
+		t.Fatalf("expected static ECS sent and its echo dropped, got %q / %q", ExtractECS(req), ExtractECS(resp))
+	}
+
+	c.ecs = newECSPolicy(config.UpstreamServer{ECS: "client"})
+	req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	resp, _ = c.Resolve(WithClient(context.Background(), net.ParseIP("198.51.100.77"), nil), req)
+	if ExtractECS(resp) != "198.51.100.0/24" {
+		t.Fatalf("expected client-derived echo kept for scoped caching, got %q", ExtractECS(resp))
+	}
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// Group spreads the queries of one upstream group over its members according
+// to the group's strategy. Except for race, members are tried one at a time:
+// an error, timeout, SERVFAIL or REFUSED moves on to the next one, and members
+// that failed max_fails times in a row are skipped for fail_timeout, as are
+// members whose circuit breaker is open, unless every member is in that state.
+type Group struct {
+	strategy string
+	members  []*StatsClient
+	weights  []int
+
+	maxFails       int
+	failTimeout    time.Duration
+	attemptTimeout time.Duration
+
+	mu      sync.Mutex
+	next    uint32
+	current []int
+}
+
+func NewGroup(policy config.UpstreamPolicy, members []*StatsClient, weights []int) *Group {
+	g := &Group{
+		strategy:       policy.Strategy,
+		members:        members,
+		weights:        make([]int, len(members)),
+		current:        make([]int, len(members)),
+		maxFails:       policy.MaxFails,
+		failTimeout:    time.Duration(policy.FailTimeout) * time.Second,
+		attemptTimeout: time.Duration(policy.AttemptTimeoutMs) * time.Millisecond,
+	}
+
+	switch g.strategy {
+	case config.StrategyRace, config.StrategyFastest, config.StrategyRoundRobin, config.StrategyWeighted, config.StrategyFailover:
+	case "":
+		g.strategy = config.StrategyRace
+	default:
+		log.Printf("无效的上游选择策略: %s，将使用 %s", policy.Strategy, config.StrategyRace)
+		g.strategy = config.StrategyRace
+	}
+
+	for i := range g.weights {
+		g.weights[i] = 1
+		if i < len(weights) && weights[i] > 0 {
+			g.weights[i] = weights[i]
+		}
+	}
+	if g.maxFails <= 0 {
+		g.maxFails = 3
+	}
+	if g.failTimeout <= 0 {
+		g.failTimeout = 30 * time.Second
+	}
+	if g.attemptTimeout <= 0 {
+		g.attemptTimeout = 2 * time.Second
+	}
+	return g
+}
+
+// Strategy returns the effective strategy name.
+func (g *Group) Strategy() string {
+	return g.strategy
+}
+
+func (g *Group) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if g.strategy == config.StrategyRace {
+		clients := make([]DNSClient, len(g.members))
+		for i, m := range g.members {
+			clients[i] = m
+		}
+		return RaceResolve(ctx, req, clients)
+	}
+
+	order := g.order(time.Now())
+	if len(order) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	var (
+		bestFail       *dns.Msg
+		bestFailMember *StatsClient
+		lastErr        error
+	)
+	for n, i := range order {
+		if ctx.Err() != nil {
+			break
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, g.attemptFor(ctx, len(order)-n))
+		resp, err := g.members[i].Resolve(attemptCtx, req.Copy())
+		cancel()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			if bestFail == nil {
+				bestFail, bestFailMember = resp, g.members[i]
+			}
+			continue
+		}
+		noteWinner(ctx, g.members[i], nil)
+		return resp, nil
+	}
+
+	if bestFail != nil {
+		noteWinner(ctx, bestFailMember, nil)
+		return bestFail, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("所有上游查询均失败: %w", lastErr)
+}
+
+// attemptFor caps one attempt so the members still left share what remains
+// of the query deadline, instead of the first slow ones using it all up.
+func (g *Group) attemptFor(ctx context.Context, left int) time.Duration {
+	timeout := g.attemptTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if share := time.Until(deadline) / time.Duration(left); share < timeout {
+			timeout = share
+		}
+	}
+	return timeout
+}
+
+// order returns member indexes in the order they should be tried.
+func (g *Group) order(now time.Time) []int {
+	var healthy, ejected []int
+	for i, m := range g.members {
+		if fails, last := m.Failures(); !m.Available() || (fails >= g.maxFails && now.Sub(last) < g.failTimeout) {
+			ejected = append(ejected, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) == 0 {
+		// 全部被剔除时仍按原顺序尝试，总比直接失败好
+		healthy = ejected
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	switch g.strategy {
+	case config.StrategyFastest:
+		// 尚无延迟样本的上游排在最前，以便尽快测得其延迟
+		latency := make(map[int]time.Duration, len(healthy))
+		for _, i := range healthy {
+			latency[i] = g.members[i].Latency()
+		}
+		sort.SliceStable(healthy, func(a, b int) bool {
+			return latency[healthy[a]] < latency[healthy[b]]
+		})
+	case config.StrategyRoundRobin:
+		g.mu.Lock()
+		start := int(g.next % uint32(len(healthy)))
+		g.next++
+		g.mu.Unlock()
+		rotated := append([]int(nil), healthy[start:]...)
+		healthy = append(rotated, healthy[:start]...)
+	case config.StrategyWeighted:
+		first := g.pickWeighted(healthy)
+		ordered := []int{healthy[first]}
+		ordered = append(ordered, healthy[:first]...)
+		healthy = append(ordered, healthy[first+1:]...)
+	}
+	return healthy
+}
+
+// pickWeighted runs one round of smooth weighted round-robin (as in nginx)
+// over the candidates and returns the position of the chosen one.
+func (g *Group) pickWeighted(candidates []int) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	best, total := 0, 0
+	for pos, i := range candidates {
+		g.current[i] += g.weights[i]
+		total += g.weights[i]
+		if g.current[i] > g.current[candidates[best]] {
+			best = pos
+		}
+	}
+	g.current[candidates[best]] -= total
+	return best
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+type scriptedClient struct {
+	mu    sync.Mutex
+	rcode int
+	err   error
+	delay time.Duration
+	calls int
+}
+
+func (c *scriptedClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	c.mu.Lock()
+	c.calls++
+	rcode, err, delay := c.rcode, c.err, c.delay
+	c.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	return resp, nil
+}
+
+func (c *scriptedClient) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+func newTestGroup(policy config.UpstreamPolicy, weights []int, clients ...*scriptedClient) *Group {
+	members := make([]*StatsClient, len(clients))
+	for i, c := range clients {
+		members[i] = NewStatsClient(c, "test", "udp", "test")
+	}
+	return NewGroup(policy, members, weights)
+}
+
+func testQuery() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	return req
+}
+
+func TestGroupFailoverEjectsFailingUpstream(t *testing.T) {
+	primary := &scriptedClient{err: errors.New("connection refused")}
+	backup := &scriptedClient{}
+	g := newTestGroup(config.UpstreamPolicy{Strategy: config.StrategyFailover, MaxFails: 2}, nil, primary, backup)
+
+	for i := 0; i < 5; i++ {
+		if _, err := g.Resolve(context.Background(), testQuery()); err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+	}
+	if primary.count() != 2 || backup.count() != 5 {
+		t.Fatalf("expected primary to be ejected after 2 failures, got primary=%d backup=%d", primary.count(), backup.count())
+	}
+
+	// 剔除期过后重新尝试主上游
+	g.failTimeout = 0
+	primary.mu.Lock()
+	primary.err = nil
+	primary.mu.Unlock()
+	if _, err := g.Resolve(context.Background(), testQuery()); err != nil || primary.count() != 3 || backup.count() != 5 {
+		t.Fatalf("expected recovered primary to be used again, got primary=%d backup=%d (err=%v)", primary.count(), backup.count(), err)
+	}
+}
+
+func TestGroupMovesOnAfterServfailAndTimeout(t *testing.T) {
+	servfail := &scriptedClient{rcode: dns.RcodeServerFailure}
+	slow := &scriptedClient{delay: time.Second}
+	good := &scriptedClient{rcode: dns.RcodeNameError}
+	g := newTestGroup(config.UpstreamPolicy{Strategy: config.StrategyFailover, AttemptTimeoutMs: 20}, nil, servfail, slow, good)
+
+	resp, err := g.Resolve(context.Background(), testQuery())
+	if err != nil || resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN from the third upstream, got %v (err=%v)", resp, err)
+	}
+
+	good.mu.Lock()
+	good.err = errors.New("unreachable")
+	good.mu.Unlock()
+	resp, err = g.Resolve(context.Background(), testQuery())
+	if err != nil || resp.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("expected SERVFAIL when nothing better answers, got %v (err=%v)", resp, err)
+	}
+}
+
+func TestGroupRoundRobinAndWeighted(t *testing.T) {
+	a, b, c := &scriptedClient{}, &scriptedClient{}, &scriptedClient{}
+	g := newTestGroup(config.UpstreamPolicy{Strategy: config.StrategyRoundRobin}, nil, a, b, c)
+	for i := 0; i < 6; i++ {
+		g.Resolve(context.Background(), testQuery())
+	}
+	if a.count() != 2 || b.count() != 2 || c.count() != 2 {
+		t.Fatalf("expected even round-robin, got %d/%d/%d", a.count(), b.count(), c.count())
+	}
+
+	a, b = &scriptedClient{}, &scriptedClient{}
+	g = newTestGroup(config.UpstreamPolicy{Strategy: config.StrategyWeighted}, []int{3, 1}, a, b)
+	for i := 0; i < 8; i++ {
+		g.Resolve(context.Background(), testQuery())
+	}
+	if a.count() != 6 || b.count() != 2 {
+		t.Fatalf("expected 3:1 weighted split, got %d/%d", a.count(), b.count())
+	}
+}
+
+func TestGroupFastestPrefersLowestLatency(t *testing.T) {
+	slow := &scriptedClient{delay: 30 * time.Millisecond}
+	fast := &scriptedClient{}
+	g := newTestGroup(config.UpstreamPolicy{Strategy: config.StrategyFastest}, nil, slow, fast)
+
+	// 前两次查询分别测得两个上游的延迟
+	for i := 0; i < 5; i++ {
+		g.Resolve(context.Background(), testQuery())
+	}
+	if slow.count() != 1 || fast.count() != 4 {
+		t.Fatalf("expected queries to settle on the fastest upstream, got slow=%d fast=%d", slow.count(), fast.count())
+	}
+
+	if s := NewGroup(config.UpstreamPolicy{Strategy: "bogus"}, nil, nil).Strategy(); s != config.StrategyRace {
+		t.Fatalf("expected unknown strategy to fall back to race, got %q", s)
+	}
+}
+
+type hangingClient struct{}
+
+func (hangingClient) Resolve(ctx context.Context, _ *dns.Msg) (*dns.Msg, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGroupReachesThirdMemberWhenFirstTwoHang(t *testing.T) {
+	defer func(d time.Duration) { raceTimeout = d }(raceTimeout)
+	raceTimeout = 150 * time.Millisecond
+
+	newGroup := func(attemptMs int) (*Group, *scriptedClient) {
+		third := &scriptedClient{}
+		members := []*StatsClient{
+			NewStatsClient(hangingClient{}, "a", "udp", "test"),
+			NewStatsClient(hangingClient{}, "b", "udp", "test"),
+			NewStatsClient(third, "c", "udp", "test"),
+		}
+		return NewGroup(config.UpstreamPolicy{Strategy: config.StrategyFailover, AttemptTimeoutMs: attemptMs}, members, nil), third
+	}
+
+	// 分组作为唯一客户端时不受竞速计时限制
+	g, third := newGroup(100)
+	resp, err := RaceResolve(context.Background(), testQuery(), []DNSClient{g})
+	if err != nil || resp.Rcode != dns.RcodeSuccess || third.count() != 1 {
+		t.Fatalf("expected the third member to answer, got %v / %v (calls %d)", resp, err, third.count())
+	}
+
+	// 查询期限不足以让每个上游用满 attempt_timeout 时按剩余上游平分
+	g, third = newGroup(2000)
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+	resp, err = RaceResolve(ctx, testQuery(), []DNSClient{g})
+	if err != nil || resp.Rcode != dns.RcodeSuccess || third.count() != 1 {
+		t.Fatalf("expected the third member to answer within the deadline, got %v / %v (calls %d)", resp, err, third.count())
+	}
+}
+
+func TestGroupRoundRobinSurvivesCounterWraparound(t *testing.T) {
+	a, b, c := &scriptedClient{}, &scriptedClient{}, &scriptedClient{}
+	g := newTestGroup(config.UpstreamPolicy{Strategy: config.StrategyRoundRobin}, nil, a, b, c)
+	g.next = math.MaxUint32 - 1
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Resolve(context.Background(), testQuery()); err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+	}
+	if a.count()+b.count()+c.count() != 3 {
+		t.Fatalf("expected one query per round, got %d/%d/%d", a.count(), b.count(), c.count())
+	}
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// HealthChecker periodically probes upstreams and enables their circuit
+// breakers, so a dead upstream stops receiving traffic and is brought back
+// once probes succeed again.
+type HealthChecker struct {
+	clients  []*StatsClient
+	name     string
+	qtype    uint16
+	interval time.Duration
+	timeout  time.Duration
+
+	started  atomic.Bool
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewHealthChecker returns nil when health checks are disabled.
+func NewHealthChecker(cfg config.HealthCheckConfig, clients []*StatsClient) *HealthChecker {
+	if !cfg.Enabled || len(clients) == 0 {
+		return nil
+	}
+
+	h := &HealthChecker{
+		clients:  clients,
+		name:     dns.Fqdn(strings.TrimSpace(cfg.Name)),
+		qtype:    dns.TypeNS,
+		interval: time.Duration(cfg.Interval) * time.Second,
+		timeout:  time.Duration(cfg.TimeoutMs) * time.Millisecond,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if cfg.Type != "" {
+		if qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(cfg.Type))]; ok {
+			h.qtype = qtype
+		} else {
+			log.Printf("无效的健康检查查询类型: %s，将使用 NS", cfg.Type)
+		}
+	}
+	if h.interval <= 0 {
+		h.interval = 30 * time.Second
+	}
+	if h.timeout <= 0 {
+		h.timeout = 3 * time.Second
+	}
+
+	failures, recoveries := cfg.FailureThreshold, cfg.RecoveryThreshold
+	if failures <= 0 {
+		failures = 5
+	}
+	if recoveries <= 0 {
+		recoveries = 2
+	}
+	for _, c := range clients {
+		c.SetBreaker(failures, recoveries)
+	}
+	return h
+}
+
+// Start launches the probe loop.
+func (h *HealthChecker) Start() {
+	if h == nil || !h.started.CompareAndSwap(false, true) {
+		return
+	}
+	go h.run()
+}
+
+// Stop ends the probe loop and waits for in-flight probes.
+func (h *HealthChecker) Stop() {
+	if h == nil {
+		return
+	}
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+	if h.started.Load() {
+		<-h.done
+	}
+}
+
+func (h *HealthChecker) run() {
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.ProbeAll()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// ProbeAll probes every upstream once, concurrently.
+func (h *HealthChecker) ProbeAll() {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, c := range h.clients {
+		wg.Add(1)
+		go func(c *StatsClient) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(h.name, h.qtype)
+			c.Probe(ctx, req)
+		}(c)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestCircuitBreakerOpensAndRecoversThroughProbes(t *testing.T) {
+	dead := &scriptedClient{err: errors.New("connection refused")}
+	alive := &scriptedClient{}
+	deadStats := NewStatsClient(dead, "192.0.2.1:53", "udp", "Overseas")
+	aliveStats := NewStatsClient(alive, "192.0.2.2:53", "udp", "Overseas")
+
+	h := NewHealthChecker(config.HealthCheckConfig{Enabled: true, FailureThreshold: 2, RecoveryThreshold: 2}, []*StatsClient{deadStats, aliveStats})
+	clients := []DNSClient{deadStats, aliveStats}
+
+	deadStats.Resolve(context.Background(), testQuery())
+	if state := deadStats.GetStats()["state"]; state != StateDegraded {
+		t.Fatalf("expected degraded after one failure, got %v", state)
+	}
+	h.ProbeAll()
+	if deadStats.Available() {
+		t.Fatal("expected breaker to open after two consecutive failures")
+	}
+	st := deadStats.GetStats()
+	if st["state"] != StateDown || st["last_error"] != "connection refused" || st["last_success"] != "" {
+		t.Fatalf("unexpected stats for dead upstream %v", st)
+	}
+
+	calls := dead.count()
+	for i := 0; i < 3; i++ {
+		if _, err := RaceResolve(context.Background(), testQuery(), clients); err != nil {
+			t.Fatalf("RaceResolve() error = %v", err)
+		}
+	}
+	if dead.count() != calls {
+		t.Fatalf("expected queries to skip the down upstream, got %d new calls", dead.count()-calls)
+	}
+
+	dead.mu.Lock()
+	dead.err = nil
+	dead.mu.Unlock()
+	h.ProbeAll()
+	if deadStats.Available() {
+		t.Fatal("expected breaker to stay open until enough probes succeed")
+	}
+	h.ProbeAll()
+	if !deadStats.Available() || deadStats.GetStats()["state"] != StateHealthy || deadStats.GetStats()["last_success"] == "" {
+		t.Fatalf("expected upstream to recover, got %v", deadStats.GetStats())
+	}
+	if aliveStats.GetStats()["total_queries"].(int64) != 3 {
+		t.Fatalf("expected probes to stay out of query counters, got %v", aliveStats.GetStats())
+	}
+}
+
+func TestRaceResolveUsesDownUpstreamsAsLastResort(t *testing.T) {
+	only := &scriptedClient{rcode: dns.RcodeServerFailure}
+	sc := NewStatsClient(only, "192.0.2.1:53", "udp", "CN")
+	sc.SetBreaker(1, 1)
+	sc.Resolve(context.Background(), testQuery())
+	if sc.Available() {
+		t.Fatal("expected SERVFAIL to count as a failure")
+	}
+
+	only.mu.Lock()
+	only.rcode = dns.RcodeSuccess
+	only.mu.Unlock()
+	if resp, err := RaceResolve(context.Background(), testQuery(), []DNSClient{sc}); err != nil || resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected the only upstream to be queried anyway, got %v (err=%v)", resp, err)
+	}
+	if !sc.Available() {
+		t.Fatal("expected a successful query to close the breaker")
+	}
+
+	if NewHealthChecker(config.HealthCheckConfig{}, []*StatsClient{sc}) != nil {
+		t.Fatal("expected nil checker when health checks are disabled")
+	}
+	var h *HealthChecker
+	h.Start()
+	h.Stop()
+}
@@ -2,21 +2,42 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+var (
+	// ErrNoUpstream is returned when a group has no upstream to query.
+	ErrNoUpstream = errors.New("没有可用的上游客户端")
+	// ErrRaceTimeout is returned when no upstream answered in time.
+	ErrRaceTimeout = errors.New("并发查询超时")
+)
+
+// raceTimeout bounds how long RaceResolve waits for a successful answer.
+var raceTimeout = 5 * time.Second
+
 type raceResult struct {
-	resp *dns.Msg
-	err  error
+	resp   *dns.Msg
+	err    error
+	client DNSClient
+	// win 为该客户端内部选中的上游（如分组成员）
+	win *Winner
 }
 
 func RaceResolve(ctx context.Context, req *dns.Msg, clients []DNSClient) (*dns.Msg, error) {
 	if len(clients) == 0 {
-		return nil, fmt.Errorf("没有可用的上游客户端")
+		return nil, ErrNoUpstream
 	}
+	// 非竞速分组自行控制每个上游的超时并依次尝试，不受竞速计时限制
+	if len(clients) == 1 {
+		if g, ok := clients[0].(*Group); ok {
+			return g.Resolve(ctx, req)
+		}
+	}
+	clients = availableClients(clients)
 
 	raceCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -26,17 +47,19 @@ func RaceResolve(ctx context.Context, req *dns.Msg, clients []DNSClient) (*dns.M
 	for _, c := range clients {
 		reqClone := req.Copy()
 		go func(cl DNSClient) {
-			resp, err := cl.Resolve(raceCtx, reqClone)
-			results <- raceResult{resp: resp, err: err}
+			clientCtx, win := WithWinner(raceCtx)
+			resp, err := cl.Resolve(clientCtx, reqClone)
+			results <- raceResult{resp: resp, err: err, client: cl, win: win}
 		}(c)
 	}
 
 	var (
-		bestFail *dns.Msg // 保存 SERVFAIL/NXDOMAIN 等非成功响应作为备选
-		lastErr  error
+		bestFail       *dns.Msg // 保存 SERVFAIL/NXDOMAIN 等非成功响应作为备选
+		bestFailResult raceResult
+		lastErr        error
 	)
 
-	timer := time.NewTimer(5 * time.Second)
+	timer := time.NewTimer(raceTimeout)
 	defer timer.Stop()
 
 	for i := 0; i < len(clients); i++ {
@@ -48,18 +71,20 @@ func RaceResolve(ctx context.Context, req *dns.Msg, clients []DNSClient) (*dns.M
 			}
 			// 真正成功的响应（NOERROR），立即返回
 			if r.resp.Rcode == dns.RcodeSuccess {
+				noteWinner(ctx, r.client, r.win)
 				return r.resp, nil
 			}
 			// NXDOMAIN / SERVFAIL 等：保存但继续等其他上游
 			if bestFail == nil {
-				bestFail = r.resp
+				bestFail, bestFailResult = r.resp, r
 			}
 		case <-timer.C:
 			// 超时，返回已有的最佳结果
 			if bestFail != nil {
+				noteWinner(ctx, bestFailResult.client, bestFailResult.win)
 				return bestFail, nil
 			}
-			return nil, fmt.Errorf("并发查询超时")
+			return nil, ErrRaceTimeout
 		case <-ctx.Done():
 			return nil, ctx.Err()
 		}
@@ -67,6 +92,7 @@ func RaceResolve(ctx context.Context, req *dns.Msg, clients []DNSClient) (*dns.M
 
 	// 所有上游都返回了，优先返回非成功但合法的 DNS 响应
 	if bestFail != nil {
+		noteWinner(ctx, bestFailResult.client, bestFailResult.win)
 		return bestFail, nil
 	}
 
@@ -75,3 +101,19 @@ func RaceResolve(ctx context.Context, req *dns.Msg, clients []DNSClient) (*dns.M
 	}
 	return nil, fmt.Errorf("未知错误：未收到任何响应")
 }
+
+// availableClients drops upstreams whose circuit breaker is open, unless that
+// would leave nothing to query.
+func availableClients(clients []DNSClient) []DNSClient {
+	var available []DNSClient
+	for _, c := range clients {
+		if sc, ok := c.(*StatsClient); ok && !sc.Available() {
+			continue
+		}
+		available = append(available, c)
+	}
+	if len(available) == 0 {
+		return clients
+	}
+	return available
+}
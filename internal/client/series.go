@@ -0,0 +1,360 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/config"
+)
+
+// latencyBounds are the upper bounds in milliseconds of the latency histogram
+// buckets; one more open-ended bucket follows the last bound.
+var latencyBounds = [...]float64{1, 2, 3, 5, 7, 10, 15, 20, 30, 50, 70, 100, 150, 200, 300, 500, 700, 1000, 1500, 2000, 3000, 5000}
+
+const (
+	latencyBuckets = len(latencyBounds) + 1
+	seriesMinutes  = 24 * 60
+)
+
+type minuteStats struct {
+	Minute       int64                  `json:"minute"`
+	Queries      uint32                 `json:"queries"`
+	Errors       uint32                 `json:"errors"`
+	Wins         uint32                 `json:"wins"`
+	LatencySumUs int64                  `json:"latency_sum_us"`
+	Latency      [latencyBuckets]uint32 `json:"latency"`
+}
+
+func (m *minuteStats) answered() uint64 {
+	var n uint64
+	for _, c := range m.Latency {
+		n += uint64(c)
+	}
+	return n
+}
+
+// Series keeps per-minute counters and latency histograms of one upstream for
+// the last 24 hours.
+type Series struct {
+	mu    sync.Mutex
+	slots [seriesMinutes]minuteStats
+
+	// total 与 totalSum 为进程启动以来的累计延迟分布，不写入文件
+	total    [latencyBuckets]uint64
+	totalSum time.Duration
+}
+
+// SeriesPoint is one minute of a series as reported to the web UI.
+type SeriesPoint struct {
+	Time    int64   `json:"time"`
+	Queries uint32  `json:"queries"`
+	Errors  uint32  `json:"errors"`
+	Wins    uint32  `json:"wins"`
+	AvgMs   float64 `json:"avg_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+}
+
+type queryOutcome int
+
+const (
+	outcomeAnswered queryOutcome = iota
+	outcomeFailed
+	outcomeCanceled
+)
+
+func unixMinute(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+func (s *Series) slotLocked(minute int64) *minuteStats {
+	m := &s.slots[minute%seriesMinutes]
+	if m.Minute != minute {
+		*m = minuteStats{Minute: minute}
+	}
+	return m
+}
+
+func (s *Series) observe(now time.Time, d time.Duration, outcome queryOutcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.slotLocked(unixMinute(now))
+	m.Queries++
+	switch outcome {
+	case outcomeAnswered:
+		ms := float64(d) / float64(time.Millisecond)
+		i := sort.SearchFloat64s(latencyBounds[:], ms)
+		m.Latency[i]++
+		m.LatencySumUs += d.Microseconds()
+		s.total[i]++
+		s.totalSum += d
+	case outcomeFailed:
+		m.Errors++
+	}
+}
+
+func (s *Series) win(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slotLocked(unixMinute(now)).Wins++
+}
+
+// histogram merges the latency buckets of the minutes inside window.
+func (s *Series) histogram(now time.Time, window time.Duration) [latencyBuckets]uint64 {
+	var hist [latencyBuckets]uint64
+	minutes := int64(window / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	current := unixMinute(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for minute := current - minutes + 1; minute <= current; minute++ {
+		m := &s.slots[minute%seriesMinutes]
+		if m.Minute != minute {
+			continue
+		}
+		for i, c := range m.Latency {
+			hist[i] += uint64(c)
+		}
+	}
+	return hist
+}
+
+// LatencyBounds returns the histogram bucket bounds in seconds.
+func LatencyBounds() []float64 {
+	bounds := make([]float64, len(latencyBounds))
+	for i, ms := range latencyBounds {
+		bounds[i] = ms / 1000
+	}
+	return bounds
+}
+
+// Cumulative returns the latency histogram of every answered query since
+// start-up, one count per LatencyBounds bucket plus the open-ended one, and
+// the sum of their latencies.
+func (s *Series) Cumulative() ([]uint64, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make([]uint64, latencyBuckets)
+	copy(counts, s.total[:])
+	return counts, s.totalSum
+}
+
+// percentile estimates the p-th quantile in milliseconds by interpolating
+// inside the bucket it falls into; 0 when there are no samples.
+func percentile(hist [latencyBuckets]uint64, p float64) float64 {
+	var total uint64
+	for _, c := range hist {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := p * float64(total)
+	var seen float64
+	for i, c := range hist {
+		if c == 0 {
+			continue
+		}
+		if seen+float64(c) >= rank {
+			if i == len(latencyBounds) {
+				return latencyBounds[len(latencyBounds)-1]
+			}
+			lower := 0.0
+			if i > 0 {
+				lower = latencyBounds[i-1]
+			}
+			return lower + (latencyBounds[i]-lower)*(rank-seen)/float64(c)
+		}
+		seen += float64(c)
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// Points returns every minute of the last 24 hours that saw traffic, oldest
+// first.
+func (s *Series) Points(now time.Time) []SeriesPoint {
+	current := unixMinute(now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var points []SeriesPoint
+	for minute := current - seriesMinutes + 1; minute <= current; minute++ {
+		m := &s.slots[minute%seriesMinutes]
+		if m.Minute != minute || m.Queries == 0 {
+			continue
+		}
+		p := SeriesPoint{
+			Time:    minute * 60,
+			Queries: m.Queries,
+			Errors:  m.Errors,
+			Wins:    m.Wins,
+		}
+		if n := m.answered(); n > 0 {
+			var hist [latencyBuckets]uint64
+			for i, c := range m.Latency {
+				hist[i] = uint64(c)
+			}
+			p.AvgMs = roundMs(float64(m.LatencySumUs) / float64(n) / 1000)
+			p.P99Ms = roundMs(percentile(hist, 0.99))
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+func roundMs(ms float64) float64 {
+	return float64(int64(ms*10+0.5)) / 10
+}
+
+// SeriesStore holds the series of every upstream so they survive router
+// rebuilds on config reload, and optionally persists them to disk. A nil
+// store hands out standalone series.
+type SeriesStore struct {
+	path   string
+	window time.Duration
+
+	mu     sync.Mutex
+	series map[string]*Series
+}
+
+// NewSeriesStore loads series saved by a previous run when save_to_file is
+// set; otherwise the series only live in memory.
+func NewSeriesStore(cfg config.UpstreamStatsConfig, dir string) *SeriesStore {
+	s := &SeriesStore{
+		window: time.Duration(cfg.WindowMinutes) * time.Minute,
+		series: make(map[string]*Series),
+	}
+	if s.window <= 0 {
+		s.window = 5 * time.Minute
+	}
+	if cfg.SaveToFile {
+		s.path = cfg.File
+		if s.path == "" {
+			s.path = "upstream_stats.json"
+		}
+		if !filepath.IsAbs(s.path) {
+			s.path = filepath.Join(dir, s.path)
+		}
+		if err := s.load(time.Now()); err != nil && !os.IsNotExist(err) {
+			log.Printf("加载上游统计数据失败: %v", err)
+		}
+	}
+	return s
+}
+
+func seriesKey(c *StatsClient) string {
+	return c.Group + "|" + c.Protocol + "|" + c.Address
+}
+
+// Attach gives c the series recorded for the same upstream before, and the
+// store's percentile window.
+func (s *SeriesStore) Attach(c *StatsClient) {
+	if s == nil {
+		return
+	}
+	key := seriesKey(c)
+
+	s.mu.Lock()
+	series, ok := s.series[key]
+	if !ok {
+		series = new(Series)
+		s.series[key] = series
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.series = series
+	c.window = s.window
+	c.mu.Unlock()
+}
+
+// Retain drops the series of every upstream not among clients, so upstreams
+// removed from the config do not linger in memory or in the saved file.
+func (s *SeriesStore) Retain(clients []*StatsClient) {
+	if s == nil {
+		return
+	}
+	keep := make(map[string]bool, len(clients))
+	for _, c := range clients {
+		keep[seriesKey(c)] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.series {
+		if !keep[key] {
+			delete(s.series, key)
+		}
+	}
+}
+
+// Save writes the series to disk when persistence is enabled.
+func (s *SeriesStore) Save() error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+	current := unixMinute(time.Now())
+
+	s.mu.Lock()
+	snapshot := make(map[string][]minuteStats, len(s.series))
+	for key, series := range s.series {
+		series.mu.Lock()
+		var minutes []minuteStats
+		for _, m := range series.slots {
+			if m.Queries > 0 && m.Minute > current-seriesMinutes {
+				minutes = append(minutes, m)
+			}
+		}
+		series.mu.Unlock()
+		if len(minutes) > 0 {
+			sort.Slice(minutes, func(i, j int) bool { return minutes[i].Minute < minutes[j].Minute })
+			snapshot[key] = minutes
+		}
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *SeriesStore) load(now time.Time) error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var snapshot map[string][]minuteStats
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	current := unixMinute(now)
+	for key, minutes := range snapshot {
+		series := new(Series)
+		for _, m := range minutes {
+			if m.Minute > current-seriesMinutes && m.Minute <= current {
+				series.slots[m.Minute%seriesMinutes] = m
+			}
+		}
+		s.series[key] = series
+	}
+	return nil
+}
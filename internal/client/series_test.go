@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestSeriesPercentiles(t *testing.T) {
+	s := new(Series)
+	now := time.Date(2024, 5, 1, 12, 0, 30, 0, time.UTC)
+
+	// 98 个 10ms 内的应答和 2 个 3 秒级的卡顿
+	for i := 0; i < 98; i++ {
+		s.observe(now, 8*time.Millisecond, outcomeAnswered)
+	}
+	s.observe(now.Add(-2*time.Minute), 2500*time.Millisecond, outcomeAnswered)
+	s.observe(now.Add(-2*time.Minute), 2800*time.Millisecond, outcomeAnswered)
+	s.observe(now, 0, outcomeFailed)
+
+	hist := s.histogram(now, 5*time.Minute)
+	if p50 := percentile(hist, 0.5); p50 <= 7 || p50 > 10 {
+		t.Fatalf("p50 = %v, want within the 7-10ms bucket", p50)
+	}
+	if p99 := percentile(hist, 0.99); p99 <= 2000 || p99 > 3000 {
+		t.Fatalf("p99 = %v, want the stalls to show up", p99)
+	}
+	if p99 := percentile(s.histogram(now, time.Minute), 0.99); p99 > 10 {
+		t.Fatalf("p99 over the last minute = %v, want stalls outside the window ignored", p99)
+	}
+	if p := percentile([latencyBuckets]uint64{}, 0.5); p != 0 {
+		t.Fatalf("expected 0 for an empty histogram, got %v", p)
+	}
+
+	points := s.Points(now)
+	if len(points) != 2 || points[1].Queries != 99 || points[1].Errors != 1 || math.Abs(points[1].AvgMs-8) > 0.1 {
+		t.Fatalf("unexpected points %+v", points)
+	}
+	if points := s.Points(now.Add(24 * time.Hour)); len(points) != 0 {
+		t.Fatalf("expected minutes older than 24h to be dropped, got %+v", points)
+	}
+
+	// 累计分布不随 24 小时窗口滚动
+	counts, sum := s.Cumulative()
+	if len(counts) != len(LatencyBounds())+1 || counts[5] != 98 || counts[20] != 2 || sum != 98*8*time.Millisecond+5300*time.Millisecond {
+		t.Fatalf("unexpected cumulative histogram %v (sum %v)", counts, sum)
+	}
+}
+
+func TestStatsClientCountsWinsAndRcodes(t *testing.T) {
+	nx := NewStatsClient(&scriptedClient{rcode: dns.RcodeNameError}, "192.0.2.1:53", "udp", "CN")
+	ok := NewStatsClient(&scriptedClient{delay: 10 * time.Millisecond}, "192.0.2.2:53", "udp", "CN")
+
+	for i := 0; i < 3; i++ {
+		ctx, win := WithWinner(context.Background())
+		if _, err := RaceResolve(ctx, testQuery(), []DNSClient{nx, ok}); err != nil {
+			t.Fatalf("RaceResolve() error = %v", err)
+		}
+		win.Credit()
+	}
+	// 调用方未采用的应答不计入胜出次数
+	if _, err := RaceResolve(context.Background(), testQuery(), []DNSClient{nx, ok}); err != nil {
+		t.Fatalf("RaceResolve() error = %v", err)
+	}
+
+	if st := ok.GetStats(); st["wins"] != int64(3) || st["rcodes"].(map[string]int64)["NOERROR"] != 4 {
+		t.Fatalf("unexpected stats for the winning upstream %v", st)
+	}
+	if st := nx.GetStats(); st["wins"] != int64(0) || st["rcodes"].(map[string]int64)["NXDOMAIN"] != 4 {
+		t.Fatalf("unexpected stats for the losing upstream %v", st)
+	}
+	if p50 := ok.GetStats()["p50_ms"].(float64); p50 < 7 || p50 > 20 {
+		t.Fatalf("p50_ms = %v, want about 10ms", p50)
+	}
+}
+
+func TestSeriesStoreSurvivesReloadAndRestart(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.UpstreamStatsConfig{WindowMinutes: 10, SaveToFile: true, File: "stats.json"}
+
+	store := NewSeriesStore(cfg, dir)
+	first := NewStatsClient(&scriptedClient{}, "192.0.2.1:53", "udp", "CN")
+	store.Attach(first)
+	first.Resolve(context.Background(), testQuery())
+
+	// 配置重载后新建的客户端沿用同一上游的历史
+	second := NewStatsClient(&scriptedClient{}, "192.0.2.1:53", "udp", "CN")
+	store.Attach(second)
+	if second.Series() != first.Series() || second.GetStats()["window_minutes"] != int64(10) {
+		t.Fatal("expected the series to be shared across router rebuilds")
+	}
+
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	restarted := NewStatsClient(&scriptedClient{}, "192.0.2.1:53", "udp", "CN")
+	NewSeriesStore(cfg, dir).Attach(restarted)
+	if points := restarted.Series().Points(time.Now()); len(points) != 1 || points[0].Queries != 1 {
+		t.Fatalf("expected persisted minute to be loaded, got %+v", points)
+	}
+
+	var none *SeriesStore
+	none.Attach(restarted)
+	if err := none.Save(); err != nil {
+		t.Fatalf("nil store Save() error = %v", err)
+	}
+}
+
+func TestSeriesStoreDropsRemovedUpstreams(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.UpstreamStatsConfig{SaveToFile: true, File: "stats.json"}
+
+	store := NewSeriesStore(cfg, dir)
+	kept := NewStatsClient(&scriptedClient{}, "192.0.2.1:53", "udp", "CN")
+	removed := NewStatsClient(&scriptedClient{}, "192.0.2.2:53", "udp", "CN")
+	store.Attach(kept)
+	store.Attach(removed)
+	kept.Resolve(context.Background(), testQuery())
+	removed.Resolve(context.Background(), testQuery())
+
+	// 配置重载后只剩 kept，removed 的统计既不留在内存也不写入文件
+	store.Retain([]*StatsClient{kept})
+	if err := store.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	restarted := NewSeriesStore(cfg, dir)
+	if len(restarted.series) != 1 {
+		t.Fatalf("expected only the configured upstream to be saved, got %d series", len(restarted.series))
+	}
+	again := NewStatsClient(&scriptedClient{}, "192.0.2.2:53", "udp", "CN")
+	restarted.Attach(again)
+	if points := again.Series().Points(time.Now()); len(points) != 0 {
+		t.Fatalf("expected a removed upstream to start from scratch, got %+v", points)
+	}
+}
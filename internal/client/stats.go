@@ -3,6 +3,8 @@ package client
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
 	"sync"
 	"time"
 
@@ -20,14 +22,45 @@ type StatsClient struct {
 	TotalErrors   int64
 	TotalCanceled int64
 	TotalDuration int64
+
+	// ewma 为成功查询耗时的指数加权平均（微秒），0 表示尚无样本
+	ewma          float64
+	consecutive   int
+	lastFailureAt time.Time
+	lastSuccessAt time.Time
+	lastError     string
+
+	// 熔断：连续失败 failThreshold 次后停用，之后连续成功 recoverThreshold 次恢复
+	failThreshold    int
+	recoverThreshold int
+	down             bool
+	recovered        int
+
+	rcodes map[int]int64
+	wins   int64
+	series *Series
+	window time.Duration
 }
 
+// Upstream health states reported by GetStats.
+const (
+	StateHealthy  = "healthy"
+	StateDegraded = "degraded"
+	StateDown     = "down"
+)
+
+// ewmaWeight is the share of the newest sample in the latency average.
+const ewmaWeight = 0.2
+
 func NewStatsClient(c DNSClient, address, protocol, group string) *StatsClient {
 	return &StatsClient{
 		Client:   c,
 		Address:  address,
 		Protocol: protocol,
 		Group:    group,
+		rcodes:   make(map[int]int64),
+		series:   new(Series),
+		window:   5 * time.Minute,
 	}
 }
 
@@ -41,18 +74,197 @@ func (s *StatsClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, erro
 
 	s.TotalQueries++
 	s.TotalDuration += duration
-	if err != nil {
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-			s.TotalCanceled++
+	if err == nil && resp != nil {
+		s.rcodes[resp.Rcode]++
+	}
+	switch {
+	case answered(resp, err):
+		s.series.observe(start, time.Duration(duration)*time.Microsecond, outcomeAnswered)
+		if s.ewma == 0 {
+			s.ewma = float64(duration)
 		} else {
+			s.ewma += ewmaWeight * (float64(duration) - s.ewma)
+		}
+		s.recordSuccess()
+	case errors.Is(err, context.Canceled):
+		// 竞速中落败被取消，不代表上游有问题
+		s.TotalCanceled++
+		s.series.observe(start, 0, outcomeCanceled)
+	default:
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.TotalCanceled++
+		} else if err != nil {
 			s.TotalErrors++
 		}
-	} else {
+		s.recordFailure(resp, err)
+		s.series.observe(start, 0, outcomeFailed)
 	}
 
 	return resp, err
 }
 
+// recordWin counts a query answered with this upstream's response.
+func (s *StatsClient) recordWin() {
+	s.mu.Lock()
+	s.wins++
+	series := s.series
+	s.mu.Unlock()
+	series.win(time.Now())
+}
+
+// Winner carries the upstream whose response a resolve returned. Races and
+// groups only note it; the caller credits the win once it actually uses the
+// answer, so the discarded side of a dual query or a validator lookup does
+// not count.
+type Winner struct {
+	client *StatsClient
+}
+
+type winnerKey struct{}
+
+// WithWinner gives ctx a fresh Winner for the next resolve.
+func WithWinner(ctx context.Context) (context.Context, *Winner) {
+	w := new(Winner)
+	return context.WithValue(ctx, winnerKey{}, w), w
+}
+
+// Credit counts a win for the noted upstream, if any.
+func (w *Winner) Credit() {
+	if w != nil && w.client != nil {
+		w.client.recordWin()
+	}
+}
+
+// noteWinner records c, or the member c picked in turn, as the source of the
+// answer returned under ctx.
+func noteWinner(ctx context.Context, c DNSClient, picked *Winner) {
+	w, ok := ctx.Value(winnerKey{}).(*Winner)
+	if !ok {
+		return
+	}
+	if picked != nil && picked.client != nil {
+		w.client = picked.client
+		return
+	}
+	if sc, ok := c.(*StatsClient); ok {
+		w.client = sc
+	}
+}
+
+// Series returns the per-minute history of the last 24 hours.
+func (s *StatsClient) Series() *Series {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.series
+}
+
+// Probe sends a health-check query. It feeds the circuit breaker and the
+// health state but not the query counters.
+func (s *StatsClient) Probe(ctx context.Context, req *dns.Msg) error {
+	resp, err := s.Client.Resolve(ctx, req)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if answered(resp, err) {
+		s.recordSuccess()
+		return nil
+	}
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	s.recordFailure(resp, err)
+	if err == nil {
+		err = fmt.Errorf("上游返回 %s", rcodeName(resp))
+	}
+	return err
+}
+
+// answered reports whether the upstream produced a usable answer; SERVFAIL
+// and REFUSED count as failures of the upstream.
+func answered(resp *dns.Msg, err error) bool {
+	return err == nil && resp != nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+}
+
+func rcodeName(resp *dns.Msg) string {
+	if resp == nil {
+		return "空应答"
+	}
+	return dns.RcodeToString[resp.Rcode]
+}
+
+func (s *StatsClient) recordSuccess() {
+	s.consecutive = 0
+	s.lastSuccessAt = time.Now()
+	if s.down {
+		s.recovered++
+		if s.recovered >= s.recoverThreshold {
+			s.down = false
+			s.recovered = 0
+			log.Printf("[%s] 上游 %s 已恢复", s.Group, s.Address)
+		}
+	}
+}
+
+func (s *StatsClient) recordFailure(resp *dns.Msg, err error) {
+	s.consecutive++
+	s.recovered = 0
+	s.lastFailureAt = time.Now()
+	if err != nil {
+		s.lastError = err.Error()
+	} else {
+		s.lastError = rcodeName(resp)
+	}
+	if !s.down && s.failThreshold > 0 && s.consecutive >= s.failThreshold {
+		s.down = true
+		log.Printf("[%s] 上游 %s 连续失败 %d 次，暂停使用: %s", s.Group, s.Address, s.consecutive, s.lastError)
+	}
+}
+
+// SetBreaker enables the circuit breaker: after failures consecutive failures
+// the upstream is taken out of rotation until recoveries consecutive
+// successes, normally from health probes, bring it back.
+func (s *StatsClient) SetBreaker(failures, recoveries int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failThreshold = failures
+	s.recoverThreshold = recoveries
+}
+
+// Available reports whether the circuit breaker lets queries through.
+func (s *StatsClient) Available() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.down
+}
+
+func (s *StatsClient) stateLocked() string {
+	switch {
+	case s.down:
+		return StateDown
+	case s.consecutive > 0:
+		return StateDegraded
+	default:
+		return StateHealthy
+	}
+}
+
+// Latency returns the moving average latency of successful queries, or 0
+// before the first one.
+func (s *StatsClient) Latency() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Duration(s.ewma) * time.Microsecond
+}
+
+// Failures returns the number of failed queries since the last success and
+// when the latest one happened.
+func (s *StatsClient) Failures() (int, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.consecutive, s.lastFailureAt
+}
+
 func (s *StatsClient) GetStats() map[string]interface{} {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -62,15 +274,40 @@ func (s *StatsClient) GetStats() map[string]interface{} {
 		avg = s.TotalDuration / s.TotalQueries / 1000
 	}
 
+	rcodes := make(map[string]int64, len(s.rcodes))
+	for rcode, n := range s.rcodes {
+		rcodes[rcodeName(&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: rcode}})] = n
+	}
+	hist := s.series.histogram(time.Now(), s.window)
+
 	return map[string]interface{}{
-		"address":         s.Address,
-		"protocol":        s.Protocol,
-		"group":           s.Group,
-		"total_queries":   s.TotalQueries,
-		"total_errors":    s.TotalErrors,
-		"total_canceled":  s.TotalCanceled,
-		"avg_duration_ms": avg,
+		"address":            s.Address,
+		"protocol":           s.Protocol,
+		"group":              s.Group,
+		"total_queries":      s.TotalQueries,
+		"total_errors":       s.TotalErrors,
+		"total_canceled":     s.TotalCanceled,
+		"avg_duration_ms":    avg,
+		"ewma_ms":            int64(s.ewma) / 1000,
+		"consecutive_errors": s.consecutive,
+		"state":              s.stateLocked(),
+		"last_error":         s.lastError,
+		"last_success":       formatTime(s.lastSuccessAt),
+		"last_failure":       formatTime(s.lastFailureAt),
+		"wins":               s.wins,
+		"rcodes":             rcodes,
+		"window_minutes":     int64(s.window / time.Minute),
+		"p50_ms":             roundMs(percentile(hist, 0.50)),
+		"p90_ms":             roundMs(percentile(hist, 0.90)),
+		"p99_ms":             roundMs(percentile(hist, 0.99)),
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
 	}
+	return t.Format(time.RFC3339)
 }
 
 func (s *StatsClient) Close() error {
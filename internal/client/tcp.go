@@ -30,8 +30,6 @@ func NewTCPClient(cfg config.UpstreamServer, b *resolver.Bootstrapper) *TCPClien
 }
 
 func (c *TCPClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	ensureECS(req, c.cfg.ECSIP)
-
 	if c.cfg.EnablePipeline {
 		return c.resolvePipeline(ctx, req)
 	}
@@ -47,8 +47,6 @@ func (c *UDPClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
 		Timeout: 5 * time.Second,
 	}
 
-	ensureECS(req, c.cfg.ECSIP)
-
 	resp, _, err := cli.ExchangeContext(ctx, req, addr)
 	if err != nil {
 		return nil, fmt.Errorf("UDP查询失败: %w", err)
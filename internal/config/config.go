@@ -7,23 +7,39 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Listen          ListenConfig      `yaml:"listen" json:"listen"`
-	BootstrapDNS    []string          `yaml:"bootstrap_dns" json:"bootstrap_dns"`
-	Upstreams       UpstreamsConfig   `yaml:"upstreams" json:"upstreams"`
-	Hosts           map[string]string `yaml:"-" json:"hosts"`
-	Rules           map[string]string `yaml:"-" json:"rules"`
-	GeoData         GeoDataConfig     `yaml:"geo_data" json:"geo_data"`
-	AutoCert        AutoCertConfig    `yaml:"auto_cert" json:"auto_cert"`
-	TLSCertificates []TLSCertConfig   `yaml:"tls_certificates" json:"tls_certificates"`
-	WebUI           WebUIConfig       `yaml:"web_ui" json:"web_ui"`
-	QueryLog        QueryLogConfig    `yaml:"query_log" json:"query_log"`
-	ConfigDir       string            `yaml:"-" json:"-"`
+	Listen          ListenConfig        `yaml:"listen" json:"listen"`
+	BootstrapDNS    []string            `yaml:"bootstrap_dns" json:"bootstrap_dns"`
+	Upstreams       UpstreamsConfig     `yaml:"upstreams" json:"upstreams"`
+	UpstreamPolicy  UpstreamPolicies    `yaml:"upstream_policy" json:"upstream_policy"`
+	HealthCheck     HealthCheckConfig   `yaml:"health_check" json:"health_check"`
+	UpstreamStats   UpstreamStatsConfig `yaml:"upstream_stats" json:"upstream_stats"`
+	Hosts           map[string][]string `yaml:"-" json:"hosts"`
+	HostsOptions    HostsConfig         `yaml:"hosts_options" json:"hosts_options"`
+	LocalZones      LocalZonesConfig    `yaml:"local_zones" json:"local_zones"`
+	PrivatePTR      PrivatePTRConfig    `yaml:"private_ptr" json:"private_ptr"`
+	AntiPoison      AntiPoisonConfig    `yaml:"anti_poison" json:"anti_poison"`
+	LearnedRoutes   LearnedRoutesConfig `yaml:"learned_routes" json:"learned_routes"`
+	DNSSEC          DNSSECConfig        `yaml:"dnssec" json:"dnssec"`
+	ECS             ECSConfig           `yaml:"ecs" json:"ecs"`
+	Privacy         PrivacyConfig       `yaml:"privacy" json:"privacy"`
+	Rules           map[string]string   `yaml:"-" json:"rules"`
+	GeoData         GeoDataConfig       `yaml:"geo_data" json:"geo_data"`
+	AutoCert        AutoCertConfig      `yaml:"auto_cert" json:"auto_cert"`
+	TLSCertificates []TLSCertConfig     `yaml:"tls_certificates" json:"tls_certificates"`
+	WebUI           WebUIConfig         `yaml:"web_ui" json:"web_ui"`
+	Metrics         MetricsConfig       `yaml:"metrics" json:"metrics"`
+	QueryLog        QueryLogConfig      `yaml:"query_log" json:"query_log"`
+	Cache           CacheConfig         `yaml:"cache" json:"cache"`
+	Blocklists      BlocklistConfig     `yaml:"blocklists" json:"blocklists"`
+	ConfigDir       string              `yaml:"-" json:"-"`
 }
 
 type TLSCertConfig struct {
@@ -39,6 +55,118 @@ type QueryLogConfig struct {
 	SaveToFile bool   `yaml:"save_to_file" json:"save_to_file"`
 }
 
+type CacheConfig struct {
+	Enabled        bool   `yaml:"enabled" json:"enabled"`
+	Size           int    `yaml:"size" json:"size"`
+	MinTTL         uint32 `yaml:"min_ttl" json:"min_ttl"`
+	MaxTTL         uint32 `yaml:"max_ttl" json:"max_ttl"`
+	NegativeTTL    uint32 `yaml:"negative_ttl" json:"negative_ttl"`
+	MaxNegativeTTL uint32 `yaml:"max_negative_ttl" json:"max_negative_ttl"`
+
+	ServeStale      bool   `yaml:"serve_stale" json:"serve_stale"`
+	StaleTTL        uint32 `yaml:"stale_ttl" json:"stale_ttl"`
+	StaleMaxAge     uint32 `yaml:"stale_max_age" json:"stale_max_age"`
+	Prefetch        bool   `yaml:"prefetch" json:"prefetch"`
+	PrefetchMinHits int    `yaml:"prefetch_min_hits" json:"prefetch_min_hits"`
+}
+
+type HostsConfig struct {
+	// TTL hosts 应答的默认 TTL（秒），可被 hosts.txt 中的 $TTL 指令与单条记录覆盖
+	TTL uint32 `yaml:"ttl" json:"ttl"`
+	// NoDataHTTPS 被 hosts 覆盖地址的域名，HTTPS/SVCB 查询直接返回 NODATA
+	NoDataHTTPS bool `yaml:"nodata_https" json:"nodata_https"`
+}
+
+// LearnedRoutesConfig controls the cache of GeoIP routing decisions, keyed
+// by registrable domain and persisted in the config directory.
+type LearnedRoutesConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// TTLHours 学习结果的有效期（小时），默认 168
+	TTLHours int `yaml:"ttl_hours" json:"ttl_hours"`
+	// MaxEntries 最多保存的域名数，超出时淘汰最早过期的条目，默认 10000
+	MaxEntries int `yaml:"max_entries" json:"max_entries"`
+}
+
+// DNSSECConfig enables validation of upstream answers against a trust
+// anchor, the root KSKs unless TrustAnchor names a file.
+type DNSSECConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// TrustAnchor 为 zone 文件格式的 DS/DNSKEY 信任锚，相对路径基于配置目录；留空使用内置根 KSK
+	TrustAnchor string `yaml:"trust_anchor" json:"trust_anchor"`
+	// Upstream 为查询 DNSKEY/DS 记录使用的上游分组，默认 overseas
+	Upstream string `yaml:"upstream" json:"upstream"`
+	// InsecureDomains 下的名字不做验证（否定信任锚），条件转发的域名自动加入
+	InsecureDomains []string `yaml:"insecure_domains" json:"insecure_domains"`
+}
+
+// ECSConfig holds the ECS settings shared by all upstreams.
+type ECSConfig struct {
+	// ClientSubnets 按客户端地址指定 client/static 模式的上游发送的子网，如分支机构出口网段
+	ClientSubnets []ECSClientSubnet `yaml:"client_subnets" json:"client_subnets"`
+}
+
+type ECSClientSubnet struct {
+	// Clients 为客户端 IP 或 CIDR
+	Clients []string `yaml:"clients" json:"clients"`
+	Subnet  string   `yaml:"subnet" json:"subnet"`
+}
+
+// PrivacyConfig limits what queries reveal beyond the name being resolved.
+type PrivacyConfig struct {
+	// Padding 为 DoT/DoH/DoQ 上游的查询与加密监听的应答添加 EDNS0 填充（RFC 7830/8467），默认开启
+	Padding bool `yaml:"padding" json:"padding"`
+	// StripClientOptions 转发前去除客户端查询中的 Cookie、NSID 等 EDNS 选项，ECS 交由上游的 ecs 策略处理；默认开启
+	StripClientOptions bool `yaml:"strip_client_options" json:"strip_client_options"`
+	// MinimalExistenceCheck HTTPS/SVCB 兼容探测按 QNAME 最小化的方式发送，不带客户端的 EDNS 选项与子网
+	MinimalExistenceCheck bool `yaml:"minimal_existence_check" json:"minimal_existence_check"`
+}
+
+// AntiPoisonConfig discards tampered upstream answers.
+type AntiPoisonConfig struct {
+	// BogusNXDomain 应答中出现这些地址（IP 或 CIDR）时按 NXDOMAIN 处理，同 dnsmasq bogus-nxdomain
+	BogusNXDomain []string `yaml:"bogus_nxdomain" json:"bogus_nxdomain"`
+	// BogusNXDomainFile 每行一个 IP/CIDR 的列表文件，相对路径基于配置目录
+	BogusNXDomainFile string `yaml:"bogus_nxdomain_file" json:"bogus_nxdomain_file"`
+	// VerifyCNAnswer 非国内域名的国内 DNS 应答必须指向国内地址，否则视为被污染丢弃（默认开启）
+	VerifyCNAnswer bool `yaml:"verify_cn_answer" json:"verify_cn_answer"`
+}
+
+// PrivatePTRConfig controls reverse lookups for private address space, which
+// are never sent to the GeoSite/GeoIP upstreams.
+type PrivatePTRConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Upstream 转发目标，可填分组名或 udp://192.168.1.1 这类地址；留空时返回 NXDOMAIN
+	Upstream string `yaml:"upstream" json:"upstream"`
+}
+
+// LocalZonesConfig lists RFC 1035 zone files served authoritatively. Relative
+// file paths are resolved against the config directory.
+type LocalZonesConfig struct {
+	// AllowTransfer 允许 AXFR 获取整个区域，默认关闭
+	AllowTransfer bool        `yaml:"allow_transfer" json:"allow_transfer"`
+	Zones         []LocalZone `yaml:"zones" json:"zones"`
+}
+
+type LocalZone struct {
+	// Origin 区域名，留空时取区域文件中 SOA 记录的所有者
+	Origin string `yaml:"origin" json:"origin"`
+	File   string `yaml:"file" json:"file"`
+}
+
+type BlocklistConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Action 命中订阅规则时的拦截动作，取值同 rule.txt 的 reject 系列目标
+	Action string `yaml:"action" json:"action"`
+	// UpdateInterval 订阅列表的刷新间隔（小时）
+	UpdateInterval int               `yaml:"update_interval" json:"update_interval"`
+	Lists          []BlocklistSource `yaml:"lists" json:"lists"`
+}
+
+type BlocklistSource struct {
+	Name string `yaml:"name" json:"name"`
+	URL  string `yaml:"url" json:"url"`
+}
+
 type WebUIConfig struct {
 	Enabled   bool   `yaml:"enabled" json:"enabled"`
 	Address   string `yaml:"address" json:"address"`
@@ -49,6 +177,17 @@ type WebUIConfig struct {
 	GuestMode bool   `yaml:"guest_mode" json:"guest_mode"`
 }
 
+// MetricsConfig exposes Prometheus metrics at /metrics. Without Address they
+// are served by the web UI; Username/Password (basic auth) or BearerToken
+// protect the endpoint, otherwise the web UI login applies.
+type MetricsConfig struct {
+	Enabled     bool   `yaml:"enabled" json:"enabled"`
+	Address     string `yaml:"address" json:"address"`
+	Username    string `yaml:"username" json:"username"`
+	Password    string `yaml:"password" json:"password"`
+	BearerToken string `yaml:"bearer_token" json:"bearer_token"`
+}
+
 type AutoCertConfig struct {
 	Enabled bool     `yaml:"enabled" json:"enabled"`
 	Email   string   `yaml:"email" json:"email"`
@@ -86,9 +225,52 @@ func (l ListenConfig) DOQAddr() string {
 	return resolveListenAddr(l.Address, l.DOQ)
 }
 
-type UpstreamsConfig struct {
-	CN       []UpstreamServer `yaml:"cn" json:"cn"`
-	Overseas []UpstreamServer `yaml:"overseas" json:"overseas"`
+const (
+	GroupCN       = "cn"
+	GroupOverseas = "overseas"
+)
+
+// UpstreamsConfig maps a group name to its upstream servers. The built-in
+// "cn" and "overseas" groups drive GeoIP/GeoSite splitting; any other name is
+// a user-defined group that rules can target directly.
+type UpstreamsConfig map[string][]UpstreamServer
+
+// GroupNames returns every group name with the built-in groups first and
+// user-defined groups in lexical order.
+func (u UpstreamsConfig) GroupNames() []string {
+	names := []string{GroupCN, GroupOverseas}
+	var extra []string
+	for name := range u {
+		if name != GroupCN && name != GroupOverseas {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	return append(names, extra...)
+}
+
+// GroupLabel returns the display name used in logs and stats for a group.
+func GroupLabel(name string) string {
+	switch name {
+	case GroupCN:
+		return "CN"
+	case GroupOverseas:
+		return "Overseas"
+	default:
+		return name
+	}
+}
+
+func normalizeUpstreams(upstreams UpstreamsConfig) UpstreamsConfig {
+	normalized := make(UpstreamsConfig, len(upstreams))
+	for name, servers := range upstreams {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		normalized[name] = append(normalized[name], servers...)
+	}
+	return normalized
 }
 
 type UpstreamServer struct {
@@ -98,6 +280,107 @@ type UpstreamServer struct {
 	EnablePipeline     bool   `yaml:"pipeline" json:"pipeline"`
 	EnableH3           bool   `yaml:"http3" json:"http3"`
 	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	// Weight 仅用于 weighted 策略，默认为 1
+	Weight int `yaml:"weight,omitempty" json:"weight,omitempty"`
+	// ECS 为 ECS 策略，见 ECSStrip 等常量；留空时设置了 ECSIP 为 static，否则为 passthrough
+	ECS string `yaml:"ecs,omitempty" json:"ecs,omitempty"`
+	// ECSPrefixV4/V6 为 client/static 模式发送的前缀长度，默认 24 与 56；ECSIP 写成 CIDR 时以其前缀为准
+	ECSPrefixV4 int `yaml:"ecs_prefix_v4,omitempty" json:"ecs_prefix_v4,omitempty"`
+	ECSPrefixV6 int `yaml:"ecs_prefix_v6,omitempty" json:"ecs_prefix_v6,omitempty"`
+	// Padding 由 privacy.padding 填入，加密协议的上游据此填充查询
+	Padding bool `yaml:"-" json:"-"`
+}
+
+// EDNS Client Subnet modes of an upstream.
+const (
+	ECSStrip       = "strip"
+	ECSPassthrough = "passthrough"
+	ECSClient      = "client"
+	ECSStatic      = "static"
+)
+
+// Upstream selection strategies for a group.
+const (
+	StrategyRace       = "race"
+	StrategyFastest    = "fastest"
+	StrategyRoundRobin = "round_robin"
+	StrategyWeighted   = "weighted"
+	StrategyFailover   = "failover"
+)
+
+// UpstreamPolicies maps a group name to how queries are spread over its
+// upstreams; groups without an entry race every upstream.
+type UpstreamPolicies map[string]UpstreamPolicy
+
+type UpstreamPolicy struct {
+	Strategy string `yaml:"strategy" json:"strategy"`
+	// MaxFails 个连续失败后将上游剔除 FailTimeout 秒，race 策略不剔除
+	MaxFails    int `yaml:"max_fails" json:"max_fails"`
+	FailTimeout int `yaml:"fail_timeout" json:"fail_timeout"`
+	// AttemptTimeoutMs 是逐个尝试时单个上游的超时，超时后换下一个
+	AttemptTimeoutMs int `yaml:"attempt_timeout_ms" json:"attempt_timeout_ms"`
+}
+
+// HealthCheckConfig controls the periodic probes sent to every upstream and
+// the circuit breaker fed by them.
+type HealthCheckConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Name/Type 为探测查询的域名与类型，默认查询根区 NS
+	Name      string `yaml:"name" json:"name"`
+	Type      string `yaml:"type" json:"type"`
+	Interval  int    `yaml:"interval" json:"interval"`
+	TimeoutMs int    `yaml:"timeout_ms" json:"timeout_ms"`
+	// 连续失败 FailureThreshold 次熔断，熔断后连续成功 RecoveryThreshold 次恢复
+	FailureThreshold  int `yaml:"failure_threshold" json:"failure_threshold"`
+	RecoveryThreshold int `yaml:"recovery_threshold" json:"recovery_threshold"`
+}
+
+// UpstreamStatsConfig controls the latency percentiles and the 24-hour
+// per-minute history kept for every upstream.
+type UpstreamStatsConfig struct {
+	// WindowMinutes 为计算延迟百分位的滚动窗口
+	WindowMinutes int    `yaml:"window_minutes" json:"window_minutes"`
+	SaveToFile    bool   `yaml:"save_to_file" json:"save_to_file"`
+	File          string `yaml:"file" json:"file"`
+}
+
+func normalizeUpstreamPolicies(policies UpstreamPolicies) UpstreamPolicies {
+	if len(policies) == 0 {
+		return policies
+	}
+	normalized := make(UpstreamPolicies, len(policies))
+	for name, policy := range policies {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		policy.Strategy = strings.ToLower(strings.TrimSpace(policy.Strategy))
+		normalized[name] = policy
+	}
+	return normalized
+}
+
+// ParseUpstreamURL turns a rule.txt forwarding target such as
+// "udp://10.0.0.53" or "https://dns.example/dns-query" into an upstream.
+func ParseUpstreamURL(target string) (UpstreamServer, bool) {
+	scheme, rest, ok := strings.Cut(strings.TrimSpace(target), "://")
+	if !ok || rest == "" {
+		return UpstreamServer{}, false
+	}
+
+	switch strings.ToLower(scheme) {
+	case "udp", "tcp", "dot", "doq":
+		return UpstreamServer{Address: rest, Protocol: strings.ToLower(scheme)}, true
+	case "tls":
+		return UpstreamServer{Address: rest, Protocol: "dot"}, true
+	case "quic":
+		return UpstreamServer{Address: rest, Protocol: "doq"}, true
+	case "https", "doh":
+		return UpstreamServer{Address: "https://" + rest, Protocol: "doh"}, true
+	case "h3":
+		return UpstreamServer{Address: "https://" + rest, Protocol: "doh", EnableH3: true}, true
+	}
+	return UpstreamServer{}, false
 }
 
 type GeoDataConfig struct {
@@ -106,6 +389,25 @@ type GeoDataConfig struct {
 	GeoIPDownloadURL   string `yaml:"geoip_download_url" json:"geoip_download_url"`
 	GeoSiteDownloadURL string `yaml:"geosite_download_url" json:"geosite_download_url"`
 	AutoUpdate         string `yaml:"auto_update" json:"auto_update"`
+	// GeoSitePriority 指定域名同属多个 GeoSite 分类时的匹配顺序
+	GeoSitePriority []string `yaml:"geosite_priority" json:"geosite_priority"`
+	// GeoIPPolicy 双路查询时判定应答是否为国内地址的策略
+	GeoIPPolicy GeoIPPolicyConfig `yaml:"geoip_policy" json:"geoip_policy"`
+}
+
+// GeoIPPolicyConfig decides, for domains no rule or GeoSite category covers,
+// whether the dual-resolve answer points at domestic addresses.
+type GeoIPPolicyConfig struct {
+	// Mode any（任一地址命中，默认）、majority（过半命中）、all（全部命中）、first（仅看第一个地址）
+	Mode string `yaml:"mode" json:"mode"`
+	// Codes 视为国内的 GeoIP 代码或分类（如 cn、private），默认 [cn]
+	Codes []string `yaml:"codes" json:"codes"`
+	// CIDRs 额外视为国内的地址段
+	CIDRs []string `yaml:"cidrs" json:"cidrs"`
+	// TrustCN 先检查国内 DNS 的应答，命中国内地址即直接采用
+	TrustCN bool `yaml:"trust_cn" json:"trust_cn"`
+	// CNGraceMs trust_cn 下海外应答已指向境外地址时，再等待国内结果的毫秒数；0 表示一直等到国内结果返回
+	CNGraceMs int `yaml:"cn_grace_ms" json:"cn_grace_ms"`
 }
 
 func LoadConfig(configPath string) (*Config, error) {
@@ -140,9 +442,96 @@ func LoadConfig(configPath string) (*Config, error) {
 		cfg.QueryLog.MaxHistory = 5000
 	}
 
+	if !hasNestedKey(raw, "cache", "enabled") {
+		cfg.Cache.Enabled = true
+	}
+	if cfg.Cache.Size <= 0 {
+		cfg.Cache.Size = 4096
+	}
+	if cfg.Cache.MaxTTL == 0 {
+		cfg.Cache.MaxTTL = 86400
+	}
+	if cfg.Cache.NegativeTTL == 0 {
+		cfg.Cache.NegativeTTL = 30
+	}
+	if cfg.Cache.MaxNegativeTTL == 0 {
+		cfg.Cache.MaxNegativeTTL = 3600
+	}
+	if cfg.Cache.StaleTTL == 0 {
+		cfg.Cache.StaleTTL = 30
+	}
+	if cfg.Cache.StaleMaxAge == 0 {
+		cfg.Cache.StaleMaxAge = 86400
+	}
+	if cfg.Cache.PrefetchMinHits <= 0 {
+		cfg.Cache.PrefetchMinHits = 2
+	}
+
+	if !hasNestedKey(raw, "blocklists", "enabled") {
+		cfg.Blocklists.Enabled = true
+	}
+	if cfg.Blocklists.Action == "" {
+		cfg.Blocklists.Action = "reject"
+	}
+	if cfg.Blocklists.UpdateInterval <= 0 {
+		cfg.Blocklists.UpdateInterval = 24
+	}
+
+	if cfg.UpstreamStats.WindowMinutes <= 0 {
+		cfg.UpstreamStats.WindowMinutes = 5
+	}
+	if cfg.UpstreamStats.File == "" {
+		cfg.UpstreamStats.File = "upstream_stats.json"
+	}
+	if cfg.HealthCheck.Name == "" {
+		cfg.HealthCheck.Name = "."
+	}
+	if cfg.HealthCheck.Type == "" {
+		cfg.HealthCheck.Type = "NS"
+	}
+	if cfg.HealthCheck.Interval <= 0 {
+		cfg.HealthCheck.Interval = 30
+	}
+	if cfg.HealthCheck.TimeoutMs <= 0 {
+		cfg.HealthCheck.TimeoutMs = 3000
+	}
+	if cfg.HealthCheck.FailureThreshold <= 0 {
+		cfg.HealthCheck.FailureThreshold = 5
+	}
+	if cfg.HealthCheck.RecoveryThreshold <= 0 {
+		cfg.HealthCheck.RecoveryThreshold = 2
+	}
+	if !hasNestedKey(raw, "learned_routes", "enabled") {
+		cfg.LearnedRoutes.Enabled = true
+	}
+	if !hasNestedKey(raw, "privacy", "padding") {
+		cfg.Privacy.Padding = true
+	}
+	if !hasNestedKey(raw, "privacy", "strip_client_options") {
+		cfg.Privacy.StripClientOptions = true
+	}
+	if cfg.DNSSEC.Upstream == "" {
+		cfg.DNSSEC.Upstream = GroupOverseas
+	}
+	if cfg.LearnedRoutes.TTLHours <= 0 {
+		cfg.LearnedRoutes.TTLHours = 168
+	}
+	if cfg.LearnedRoutes.MaxEntries <= 0 {
+		cfg.LearnedRoutes.MaxEntries = 10000
+	}
+	if !hasNestedKey(raw, "anti_poison", "verify_cn_answer") {
+		cfg.AntiPoison.VerifyCNAnswer = true
+	}
+
+	if cfg.HostsOptions.TTL == 0 {
+		cfg.HostsOptions.TTL = 60
+	}
+
 	normalizeListenConfig(&cfg.Listen)
+	cfg.Upstreams = normalizeUpstreams(cfg.Upstreams)
+	cfg.UpstreamPolicy = normalizeUpstreamPolicies(cfg.UpstreamPolicy)
 
-	cfg.Hosts = make(map[string]string)
+	cfg.Hosts = make(map[string][]string)
 	cfg.Rules = make(map[string]string)
 
 	hostsPath := filepath.Join(configDir, "hosts.txt")
@@ -210,6 +599,8 @@ func (c *Config) Save(configPath string) error {
 	c.ConfigDir = configDir
 
 	normalizeListenConfig(&c.Listen)
+	c.Upstreams = normalizeUpstreams(c.Upstreams)
+	c.UpstreamPolicy = normalizeUpstreamPolicies(c.UpstreamPolicy)
 
 	relPath := func(p string) string {
 		if strings.HasPrefix(p, configDir) {
@@ -245,17 +636,30 @@ func (c *Config) Save(configPath string) error {
 	return nil
 }
 
-func saveHostsFile(path string, hosts map[string]string) error {
+func saveHostsFile(path string, hosts map[string][]string) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	domains := make([]string, 0, len(hosts))
+	for domain := range hosts {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
 	w := bufio.NewWriter(f)
-	for domain, ip := range hosts {
-		if _, err := fmt.Fprintf(w, "%s %s\n", ip, domain); err != nil {
-			return err
+	for _, domain := range domains {
+		for _, value := range hosts[domain] {
+			// 地址写成标准 hosts 行，其余类型写成 "域名 类型 数据"
+			line := fmt.Sprintf("%s %s\n", domain, value)
+			if net.ParseIP(value) != nil {
+				line = fmt.Sprintf("%s %s\n", value, domain)
+			}
+			if _, err := w.WriteString(line); err != nil {
+				return err
+			}
 		}
 	}
 	return w.Flush()
@@ -277,13 +681,17 @@ func saveRulesFile(path string, rules map[string]string) error {
 	return w.Flush()
 }
 
-func loadHostsFile(path string, hosts map[string]string) error {
+// loadHostsFile accepts standard "IP name..." lines as well as typed records
+// written as "name [ttl] TYPE rdata" or "name ttl IP". A "$TTL n" line sets the
+// TTL of every following entry that does not carry its own.
+func loadHostsFile(path string, hosts map[string][]string) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	var fileTTL string
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -291,16 +699,51 @@ func loadHostsFile(path string, hosts map[string]string) error {
 			continue
 		}
 		parts := strings.Fields(line)
-		if len(parts) >= 2 {
+		if len(parts) < 2 {
+			continue
+		}
+		if strings.EqualFold(parts[0], "$TTL") {
+			if _, err := strconv.ParseUint(parts[1], 10, 32); err == nil {
+				fileTTL = parts[1]
+			}
+			continue
+		}
+
+		withTTL := func(value string) string {
+			if fileTTL == "" {
+				return value
+			}
+			if _, err := strconv.ParseUint(strings.Fields(value)[0], 10, 32); err == nil {
+				return value
+			}
+			return fileTTL + " " + value
+		}
+
+		if net.ParseIP(parts[0]) != nil {
 			ip := parts[0]
 			for _, domain := range parts[1:] {
-				hosts[strings.ToLower(domain)] = ip
+				AddHost(hosts, domain, withTTL(ip))
 			}
+			continue
+		}
+		if len(parts) >= 3 {
+			AddHost(hosts, parts[0], withTTL(strings.TrimSpace(line[len(parts[0]):])))
 		}
 	}
 	return scanner.Err()
 }
 
+// AddHost appends value to the records of domain, skipping duplicates.
+func AddHost(hosts map[string][]string, domain, value string) {
+	domain = strings.ToLower(domain)
+	for _, v := range hosts[domain] {
+		if v == value {
+			return
+		}
+	}
+	hosts[domain] = append(hosts[domain], value)
+}
+
 func loadRulesFile(path string, rules map[string]string) error {
 	f, err := os.Open(path)
 	if err != nil {
@@ -317,7 +760,11 @@ func loadRulesFile(path string, rules map[string]string) error {
 		parts := strings.Fields(line)
 		if len(parts) >= 2 {
 			domain := strings.ToLower(parts[0])
-			target := strings.ToLower(parts[1])
+			target := parts[1]
+			// 转发地址保留原始大小写（DoH 路径区分大小写）
+			if !strings.Contains(target, "://") {
+				target = strings.ToLower(target)
+			}
 			rules[domain] = target
 		}
 	}
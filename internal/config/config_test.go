@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -72,7 +73,7 @@ func TestSaveConfigWritesListenAddressSeparately(t *testing.T) {
 			DOH:     "8443",
 			DoHPath: "/dns-query",
 		},
-		Hosts: make(map[string]string),
+		Hosts: make(map[string][]string),
 		Rules: make(map[string]string),
 	}
 
@@ -155,3 +156,160 @@ func TestLoadConfigDefaultsQueryLogWhenFieldMissing(t *testing.T) {
 		t.Fatalf("expected query_log.max_history default to 5000, got %d", cfg.QueryLog.MaxHistory)
 	}
 }
+
+func TestLoadConfigDefaultsPrivacyProtections(t *testing.T) {
+	t.Parallel()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := []byte(`privacy:
+  strip_client_options: false
+`)
+
+	if err := os.WriteFile(configPath, content, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if !cfg.Privacy.Padding {
+		t.Fatalf("expected privacy.padding to default to true when omitted")
+	}
+	if cfg.Privacy.StripClientOptions {
+		t.Fatalf("expected explicit privacy.strip_client_options=false to be preserved")
+	}
+	if cfg.Privacy.MinimalExistenceCheck {
+		t.Fatalf("expected privacy.minimal_existence_check to default to false")
+	}
+}
+
+func TestLoadConfigLeavesHealthCheckOffWhenOmitted(t *testing.T) {
+	t.Parallel()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := []byte(`listen:
+  dns_udp: "53"
+`)
+
+	if err := os.WriteFile(configPath, content, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if cfg.HealthCheck.Enabled {
+		t.Fatalf("expected health_check.enabled to default to false when omitted")
+	}
+	if cfg.HealthCheck.Interval != 30 {
+		t.Fatalf("expected health_check.interval default to 30, got %d", cfg.HealthCheck.Interval)
+	}
+}
+
+func TestLoadConfigLeavesPrivatePTROffWhenOmitted(t *testing.T) {
+	t.Parallel()
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := []byte(`listen:
+  dns_udp: "53"
+`)
+
+	if err := os.WriteFile(configPath, content, 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	if cfg.PrivatePTR.Enabled {
+		t.Fatalf("expected private_ptr.enabled to default to false when omitted")
+	}
+}
+
+func TestHostsFileRoundTripsTypedRecords(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "hosts.txt")
+	content := "10.0.0.1 app.lan App.Alias\n10.0.0.2 app.lan\nsvc.lan CNAME app.lan.\nlan MX 10 mail.lan.\n10.0.0.1 app.lan\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	hosts := make(map[string][]string)
+	if err := loadHostsFile(path, hosts); err != nil {
+		t.Fatalf("loadHostsFile() error = %v", err)
+	}
+	want := map[string][]string{
+		"app.lan":   {"10.0.0.1", "10.0.0.2"},
+		"app.alias": {"10.0.0.1"},
+		"svc.lan":   {"CNAME app.lan."},
+		"lan":       {"MX 10 mail.lan."},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("loadHostsFile() = %v, want %v", hosts, want)
+	}
+
+	if err := saveHostsFile(path, hosts); err != nil {
+		t.Fatalf("saveHostsFile() error = %v", err)
+	}
+	reloaded := make(map[string][]string)
+	if err := loadHostsFile(path, reloaded); err != nil {
+		t.Fatalf("loadHostsFile() after save error = %v", err)
+	}
+	if !reflect.DeepEqual(reloaded, want) {
+		t.Fatalf("reloaded hosts = %v, want %v", reloaded, want)
+	}
+}
+
+func TestHostsFileAppliesFileTTL(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "hosts.txt")
+	content := "10.0.0.1 early.lan\n$TTL 300\n10.0.0.2 late.lan\nlate.lan 30 10.0.0.3\nlate.lan CNAME early.lan.\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	hosts := make(map[string][]string)
+	if err := loadHostsFile(path, hosts); err != nil {
+		t.Fatalf("loadHostsFile() error = %v", err)
+	}
+	want := map[string][]string{
+		"early.lan": {"10.0.0.1"},
+		"late.lan":  {"300 10.0.0.2", "30 10.0.0.3", "300 CNAME early.lan."},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Fatalf("loadHostsFile() = %v, want %v", hosts, want)
+	}
+}
+
+func TestParseUpstreamURL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		target string
+		want   UpstreamServer
+		ok     bool
+	}{
+		{"udp://10.0.0.53", UpstreamServer{Address: "10.0.0.53", Protocol: "udp"}, true},
+		{"TCP://10.0.0.53:5353", UpstreamServer{Address: "10.0.0.53:5353", Protocol: "tcp"}, true},
+		{"tls://dns.corp.example", UpstreamServer{Address: "dns.corp.example", Protocol: "dot"}, true},
+		{"quic://192.168.1.1", UpstreamServer{Address: "192.168.1.1", Protocol: "doq"}, true},
+		{"https://dns.corp.example/Query", UpstreamServer{Address: "https://dns.corp.example/Query", Protocol: "doh"}, true},
+		{"cn", UpstreamServer{}, false},
+		{"ftp://10.0.0.1", UpstreamServer{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseUpstreamURL(tt.target)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("ParseUpstreamURL(%q) = %+v, %v; want %+v, %v", tt.target, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,627 @@
+// Package dnssec validates upstream answers against a chain of trust from a
+// trust anchor down to the signed RRsets (RFC 4033-4035).
+package dnssec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// Validation outcomes recorded in the query log.
+const (
+	StatusSecure        = "secure"
+	StatusInsecure      = "insecure"
+	StatusBogus         = "bogus"
+	StatusIndeterminate = "indeterminate"
+)
+
+// rootAnchors are the DS records of the root zone KSKs published by IANA
+// (KSK-2017 and KSK-2024).
+const rootAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+const (
+	minCacheTTL = time.Minute
+	maxCacheTTL = time.Hour
+	// bogusCacheTTL 验证失败的区域在这段时间内不再重复查询
+	bogusCacheTTL = time.Minute
+)
+
+// ResolveFunc sends a query to the upstreams used for DNSKEY, DS and SOA
+// lookups.
+type ResolveFunc func(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+
+// Error explains why an answer failed validation; Code is the RFC 8914
+// extended DNS error to report.
+type Error struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return e.Reason
+}
+
+// Status is bogus, or indeterminate when the chain could not be fetched.
+func (e *Error) Status() string {
+	if e.Code == dns.ExtendedErrorCodeNetworkError {
+		return StatusIndeterminate
+	}
+	return StatusBogus
+}
+
+func failure(code uint16, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Result is the outcome of validating one answer. Err is set for bogus and
+// indeterminate answers.
+type Result struct {
+	Status string
+	Err    *Error
+}
+
+type anchor struct {
+	ds   []*dns.DS
+	keys []*dns.DNSKEY
+}
+
+// zoneKeys is the validated DNSKEY RRset of a zone, or why there is none.
+type zoneKeys struct {
+	keys     []dns.RR
+	insecure bool
+	err      *Error
+	expire   time.Time
+}
+
+type zoneEntry struct {
+	zone   string
+	expire time.Time
+}
+
+// Validator checks upstream answers. Validated DNSKEY sets and zone cuts are
+// cached; a nil validator validates nothing.
+type Validator struct {
+	resolve  ResolveFunc
+	anchors  map[string]anchor
+	insecure map[string]bool
+	now      func() time.Time
+
+	mu    sync.Mutex
+	keys  map[string]*zoneKeys
+	zones map[string]zoneEntry
+}
+
+// New builds a validator using the trust anchor file named in cfg, or the
+// built-in root KSKs.
+func New(cfg config.DNSSECConfig, dir string, resolve ResolveFunc) (*Validator, error) {
+	text, file := rootAnchors, "root anchors"
+	if cfg.TrustAnchor != "" {
+		file = cfg.TrustAnchor
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("读取信任锚失败: %w", err)
+		}
+		text = string(data)
+	}
+	anchors, err := parseAnchors(text, file)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Validator{
+		resolve:  resolve,
+		anchors:  anchors,
+		insecure: make(map[string]bool),
+		now:      time.Now,
+		keys:     make(map[string]*zoneKeys),
+		zones:    make(map[string]zoneEntry),
+	}
+	for _, domain := range cfg.InsecureDomains {
+		v.AddInsecureDomain(domain)
+	}
+	return v, nil
+}
+
+func parseAnchors(text, file string) (map[string]anchor, error) {
+	anchors := make(map[string]anchor)
+	zp := dns.NewZoneParser(strings.NewReader(text), ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		owner := dns.CanonicalName(rr.Header().Name)
+		a := anchors[owner]
+		switch rr := rr.(type) {
+		case *dns.DS:
+			a.ds = append(a.ds, rr)
+		case *dns.DNSKEY:
+			a.keys = append(a.keys, rr)
+		default:
+			continue
+		}
+		anchors[owner] = a
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("解析信任锚失败: %w", err)
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("信任锚 %s 中没有 DS 或 DNSKEY 记录", file)
+	}
+	return anchors, nil
+}
+
+// AddInsecureDomain turns validation off for domain and its subdomains
+// (a negative trust anchor, RFC 7646).
+func (v *Validator) AddInsecureDomain(domain string) {
+	domain = strings.TrimSpace(domain)
+	if domain == "" {
+		return
+	}
+	v.insecure[dns.CanonicalName(domain)] = true
+}
+
+// Skip reports whether name lies below a negative trust anchor.
+func (v *Validator) Skip(name string) bool {
+	if v == nil {
+		return true
+	}
+	name = dns.CanonicalName(name)
+	for {
+		if v.insecure[name] {
+			return true
+		}
+		if name == "." {
+			return false
+		}
+		name = parentName(name)
+	}
+}
+
+// Validate checks resp, the upstream answer to req. SERVFAIL and other
+// failures carry nothing to validate and yield an empty status. Negative
+// answers proven only by an opt-out NSEC3 are insecure.
+func (v *Validator) Validate(ctx context.Context, req, resp *dns.Msg) Result {
+	if v == nil || len(req.Question) == 0 || resp == nil {
+		return Result{}
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return Result{}
+	}
+	q := req.Question[0]
+	qname := dns.CanonicalName(q.Name)
+	if v.Skip(qname) {
+		return Result{Status: StatusInsecure}
+	}
+	now := v.now()
+
+	sets := append(rrsets(resp.Answer, false), rrsets(resp.Ns, true)...)
+	if len(sets) == 0 {
+		status, err := v.nameStatus(ctx, qname, now)
+		if err != nil {
+			return Result{Status: err.Status(), Err: err}
+		}
+		if status == StatusSecure {
+			return bogusResult(failure(dns.ExtendedErrorCodeNSECMissing, "%s 位于已签名区域，但应答没有不存在证明", qname))
+		}
+		return Result{Status: StatusInsecure}
+	}
+
+	secure := true
+	for _, set := range sets {
+		status, err := v.verifySet(ctx, set, "", now)
+		if err != nil {
+			return Result{Status: err.Status(), Err: err}
+		}
+		if status != StatusSecure {
+			secure = false
+		}
+	}
+	if !secure {
+		return Result{Status: StatusInsecure}
+	}
+
+	// 沿 CNAME 链找到最终名字，否定应答的证明针对它
+	target := qname
+	for i := 0; i < len(resp.Answer); i++ {
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == target && q.Qtype != dns.TypeCNAME {
+				target = dns.CanonicalName(cname.Target)
+			}
+		}
+	}
+	nxdomain := resp.Rcode == dns.RcodeNameError
+	if (nxdomain || !hasRRset(resp.Answer, target, q.Qtype)) && q.Qtype != dns.TypeANY {
+		switch proveDenial(sets, target, q.Qtype, nxdomain) {
+		case denialMissing:
+			return bogusResult(failure(dns.ExtendedErrorCodeNSECMissing, "%s %s 的否定应答缺少有效的 NSEC/NSEC3 证明", target, dns.Type(q.Qtype)))
+		case denialOptOut:
+			return Result{Status: StatusInsecure}
+		}
+	}
+	return Result{Status: StatusSecure}
+}
+
+func bogusResult(err *Error) Result {
+	return Result{Status: err.Status(), Err: err}
+}
+
+// verifySet checks the signatures of one RRset. Unsigned data is acceptable
+// only outside signed zones. Inside the DS lookup of child, signatures must
+// come from a zone above child and unsigned data is judged by its parent.
+func (v *Validator) verifySet(ctx context.Context, set *rrset, child string, now time.Time) (string, *Error) {
+	if len(set.sigs) == 0 {
+		name := set.name
+		if child != "" {
+			name = parentName(child)
+		}
+		status, err := v.nameStatus(ctx, name, now)
+		if err != nil {
+			return "", err
+		}
+		if status == StatusSecure {
+			return "", failure(dns.ExtendedErrorCodeRRSIGsMissing, "%s %s 缺少 RRSIG", set.name, dns.Type(set.rrtype))
+		}
+		return StatusInsecure, nil
+	}
+
+	var firstErr *Error
+	for _, sig := range set.sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, set.name) || (child != "" && (signer == child || !dns.IsSubDomain(signer, child))) {
+			if firstErr == nil {
+				firstErr = failure(dns.ExtendedErrorCodeDNSBogus, "%s %s 的签名者 %s 无效", set.name, dns.Type(set.rrtype), signer)
+			}
+			continue
+		}
+		zk := v.zoneKeys(ctx, signer)
+		if zk.err != nil {
+			if firstErr == nil {
+				firstErr = zk.err
+			}
+			continue
+		}
+		if zk.insecure {
+			return StatusInsecure, nil
+		}
+		if err := verifySig(sig, zk.keys, set.rrs, now); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		return StatusSecure, nil
+	}
+	return "", firstErr
+}
+
+func verifySig(sig *dns.RRSIG, keys []dns.RR, rrs []dns.RR, now time.Time) *Error {
+	if !sig.ValidityPeriod(now) {
+		// 按序列号算术比较，与 ValidityPeriod 一致
+		if int32(sig.Inception-uint32(now.Unix())) > 0 {
+			return failure(dns.ExtendedErrorCodeSignatureNotYetValid, "%s %s 的签名尚未生效", sig.Hdr.Name, dns.Type(sig.TypeCovered))
+		}
+		return failure(dns.ExtendedErrorCodeSignatureExpired, "%s %s 的签名已过期", sig.Hdr.Name, dns.Type(sig.TypeCovered))
+	}
+	matched := false
+	for _, rr := range keys {
+		key := rr.(*dns.DNSKEY)
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		matched = true
+		if sig.Verify(key, rrs) == nil {
+			return nil
+		}
+	}
+	if !matched {
+		return failure(dns.ExtendedErrorCodeDNSKEYMissing, "%s 没有与 %s %s 签名匹配的 DNSKEY (tag %d)", sig.SignerName, sig.Hdr.Name, dns.Type(sig.TypeCovered), sig.KeyTag)
+	}
+	return failure(dns.ExtendedErrorCodeDNSBogus, "%s %s 的签名验证失败", sig.Hdr.Name, dns.Type(sig.TypeCovered))
+}
+
+// nameStatus reports whether name lies in a signed zone with a chain of
+// trust (secure) or below an unsigned delegation (insecure).
+func (v *Validator) nameStatus(ctx context.Context, name string, now time.Time) (string, *Error) {
+	if v.Skip(name) {
+		return StatusInsecure, nil
+	}
+	zone, err := v.findZone(ctx, name, now)
+	if err != nil {
+		return "", err
+	}
+	zk := v.zoneKeys(ctx, zone)
+	switch {
+	case zk.err != nil:
+		return "", zk.err
+	case zk.insecure:
+		return StatusInsecure, nil
+	}
+	return StatusSecure, nil
+}
+
+// findZone returns the apex of the zone holding name, learned from the SOA
+// record the upstream returns for it.
+func (v *Validator) findZone(ctx context.Context, name string, now time.Time) (string, *Error) {
+	v.mu.Lock()
+	entry, ok := v.zones[name]
+	v.mu.Unlock()
+	if ok && now.Before(entry.expire) {
+		return entry.zone, nil
+	}
+
+	for n := name; ; n = parentName(n) {
+		if _, ok := v.anchors[n]; ok || n == "." {
+			return n, nil
+		}
+		resp, err := v.query(ctx, n, dns.TypeSOA)
+		if err != nil {
+			return "", err
+		}
+		for _, rr := range append(resp.Answer, resp.Ns...) {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				continue
+			}
+			zone := dns.CanonicalName(soa.Hdr.Name)
+			if !dns.IsSubDomain(zone, n) {
+				continue
+			}
+			v.mu.Lock()
+			v.zones[name] = zoneEntry{zone: zone, expire: now.Add(clampTTL(soa.Hdr.Ttl))}
+			v.mu.Unlock()
+			return zone, nil
+		}
+	}
+}
+
+// zoneKeys returns the validated DNSKEY RRset of zone, from the cache when
+// possible. Failures to reach the upstreams are not cached.
+func (v *Validator) zoneKeys(ctx context.Context, zone string) *zoneKeys {
+	now := v.now()
+	v.mu.Lock()
+	zk, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && now.Before(zk.expire) {
+		return zk
+	}
+
+	zk = v.fetchKeys(ctx, zone, now)
+	if zk.err == nil || zk.err.Status() != StatusIndeterminate {
+		v.mu.Lock()
+		v.keys[zone] = zk
+		v.mu.Unlock()
+	}
+	return zk
+}
+
+func (v *Validator) fetchKeys(ctx context.Context, zone string, now time.Time) *zoneKeys {
+	bogus := func(err *Error) *zoneKeys {
+		return &zoneKeys{err: err, expire: now.Add(bogusCacheTTL)}
+	}
+
+	var ds []*dns.DS
+	var anchorKeys []*dns.DNSKEY
+	ttl := uint32(maxCacheTTL / time.Second)
+	if a, ok := v.anchors[zone]; ok {
+		ds, anchorKeys = a.ds, a.keys
+	} else if zone == "." {
+		return &zoneKeys{insecure: true, expire: now.Add(maxCacheTTL)}
+	} else {
+		var zk *zoneKeys
+		ds, ttl, zk = v.delegation(ctx, zone, now)
+		if zk != nil {
+			return zk
+		}
+	}
+
+	// RFC 4035 5.2：DS 全部使用不支持的算法或摘要时按未签名处理
+	ds = supportedDS(ds)
+	if len(ds) == 0 && len(anchorKeys) == 0 {
+		return &zoneKeys{insecure: true, expire: now.Add(clampTTL(ttl))}
+	}
+
+	resp, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return &zoneKeys{err: err}
+	}
+	var keys []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		if dns.CanonicalName(rr.Header().Name) != zone {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			ttl = min(ttl, rr.Hdr.Ttl)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return bogus(failure(dns.ExtendedErrorCodeDNSKEYMissing, "%s 没有 DNSKEY 记录", zone))
+	}
+
+	var trusted []dns.RR
+	for _, rr := range keys {
+		if key := rr.(*dns.DNSKEY); key.Flags&dns.ZONE != 0 && matchesAnchor(key, ds, anchorKeys) {
+			trusted = append(trusted, key)
+		}
+	}
+	if len(trusted) == 0 {
+		return bogus(failure(dns.ExtendedErrorCodeDNSKEYMissing, "%s 没有与 DS 匹配的 DNSKEY", zone))
+	}
+	if len(sigs) == 0 {
+		return bogus(failure(dns.ExtendedErrorCodeRRSIGsMissing, "%s DNSKEY 缺少 RRSIG", zone))
+	}
+
+	var firstErr *Error
+	for _, sig := range sigs {
+		if err := verifySig(sig, trusted, keys, now); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		return &zoneKeys{keys: keys, expire: now.Add(sigTTL(sig, ttl, now))}
+	}
+	return bogus(firstErr)
+}
+
+// delegation fetches and validates the DS RRset of zone from its parent. A
+// non-nil zoneKeys reports that the zone is insecure or bogus.
+func (v *Validator) delegation(ctx context.Context, zone string, now time.Time) ([]*dns.DS, uint32, *zoneKeys) {
+	resp, err := v.query(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, 0, &zoneKeys{err: err}
+	}
+	bogus := func(err *Error) *zoneKeys {
+		return &zoneKeys{err: err, expire: now.Add(bogusCacheTTL)}
+	}
+
+	for _, set := range rrsets(resp.Answer, false) {
+		if set.rrtype != dns.TypeDS || set.name != zone {
+			continue
+		}
+		status, err := v.verifySet(ctx, set, zone, now)
+		if err != nil {
+			return nil, 0, bogus(err)
+		}
+		if status != StatusSecure {
+			return nil, 0, &zoneKeys{insecure: true, expire: now.Add(clampTTL(set.rrs[0].Header().Ttl))}
+		}
+		ds := make([]*dns.DS, 0, len(set.rrs))
+		for _, rr := range set.rrs {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		return ds, set.rrs[0].Header().Ttl, nil
+	}
+
+	// 没有 DS：父区域已签名时必须有经过验证的不存在证明
+	sets := rrsets(resp.Ns, true)
+	if len(sets) == 0 {
+		status, err := v.nameStatus(ctx, parentName(zone), now)
+		if err != nil {
+			return nil, 0, bogus(err)
+		}
+		if status == StatusSecure {
+			return nil, 0, bogus(failure(dns.ExtendedErrorCodeNSECMissing, "%s 的 DS 否定应答缺少证明", zone))
+		}
+		return nil, 0, &zoneKeys{insecure: true, expire: now.Add(minCacheTTL)}
+	}
+	ttl := uint32(maxCacheTTL / time.Second)
+	for _, set := range sets {
+		status, err := v.verifySet(ctx, set, zone, now)
+		if err != nil {
+			return nil, 0, bogus(err)
+		}
+		if status != StatusSecure {
+			return nil, 0, &zoneKeys{insecure: true, expire: now.Add(minCacheTTL)}
+		}
+		ttl = min(ttl, set.rrs[0].Header().Ttl)
+	}
+	if !provesNoDS(sets, zone) {
+		return nil, 0, bogus(failure(dns.ExtendedErrorCodeNSECMissing, "%s 的 DS 否定应答缺少有效的 NSEC/NSEC3 证明", zone))
+	}
+	return nil, 0, &zoneKeys{insecure: true, expire: now.Add(clampTTL(ttl))}
+}
+
+func (v *Validator) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, *Error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(1232, true)
+	req.CheckingDisabled = true
+
+	resp, err := v.resolve(ctx, req)
+	if err != nil {
+		return nil, failure(dns.ExtendedErrorCodeNetworkError, "查询 %s %s 失败: %v", name, dns.Type(qtype), err)
+	}
+	if resp == nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		rcode := "empty response"
+		if resp != nil {
+			rcode = dns.RcodeToString[resp.Rcode]
+		}
+		return nil, failure(dns.ExtendedErrorCodeNetworkError, "查询 %s %s 失败: %s", name, dns.Type(qtype), rcode)
+	}
+	return resp, nil
+}
+
+func matchesAnchor(key *dns.DNSKEY, ds []*dns.DS, anchorKeys []*dns.DNSKEY) bool {
+	for _, a := range anchorKeys {
+		if a.Algorithm == key.Algorithm && a.PublicKey == key.PublicKey {
+			return true
+		}
+	}
+	tag := key.KeyTag()
+	for _, d := range ds {
+		if d.KeyTag != tag || d.Algorithm != key.Algorithm {
+			continue
+		}
+		if digest := key.ToDS(d.DigestType); digest != nil && strings.EqualFold(digest.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func supportedDS(ds []*dns.DS) []*dns.DS {
+	var supported []*dns.DS
+	for _, d := range ds {
+		switch d.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+			dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		default:
+			continue
+		}
+		switch d.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			supported = append(supported, d)
+		}
+	}
+	return supported
+}
+
+func clampTTL(ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d < minCacheTTL {
+		return minCacheTTL
+	}
+	if d > maxCacheTTL {
+		return maxCacheTTL
+	}
+	return d
+}
+
+// sigTTL caps the cache lifetime of validated keys at the expiry of the
+// signature that validated them.
+func sigTTL(sig *dns.RRSIG, ttl uint32, now time.Time) time.Duration {
+	d := clampTTL(ttl)
+	if remaining := time.Duration(int32(sig.Expiration-uint32(now.Unix()))) * time.Second; remaining < d {
+		return max(remaining, 0)
+	}
+	return d
+}
+
+func parentName(name string) string {
+	if name == "." {
+		return "."
+	}
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
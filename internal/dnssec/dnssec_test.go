@@ -0,0 +1,459 @@
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+type testZone struct {
+	name     string
+	ksk, zsk *dns.DNSKEY
+	kskPriv  crypto.Signer
+	zskPriv  crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	z := &testZone{name: name}
+	z.ksk, z.kskPriv = newTestKey(t, name, 257)
+	z.zsk, z.zskPriv = newTestKey(t, name, 256)
+	return z
+}
+
+func newTestKey(t *testing.T, name string, flags uint16) (*dns.DNSKEY, crypto.Signer) {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, priv.(crypto.Signer)
+}
+
+// sign returns the RRSIG of rrset made with the zone's ZSK, or its KSK for
+// the DNSKEY RRset, valid around now.
+func (z *testZone) sign(t *testing.T, now time.Time, rrset ...dns.RR) *dns.RRSIG {
+	t.Helper()
+	key, priv := z.zsk, z.zskPriv
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key, priv = z.ksk, z.kskPriv
+	}
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.Algorithm,
+		SignerName: z.name,
+		KeyTag:     key.KeyTag(),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(24 * time.Hour).Unix()),
+	}
+	if err := sig.Sign(priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func (z *testZone) dnskeys(t *testing.T, now time.Time) []dns.RR {
+	return []dns.RR{z.ksk, z.zsk, z.sign(t, now, z.ksk, z.zsk)}
+}
+
+func (z *testZone) soa() *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{Name: z.name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:  dns.Fqdn("ns." + strings.TrimSuffix(z.name, ".")), Mbox: dns.Fqdn("hostmaster." + strings.TrimSuffix(z.name, ".")),
+		Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 300,
+	}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// stubUpstream answers from canned responses keyed by "name type".
+type stubUpstream struct {
+	answers map[string]*dns.Msg
+	queries []string
+	err     error
+}
+
+func (s *stubUpstream) set(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+	resp := new(dns.Msg)
+	resp.Rcode = rcode
+	resp.Answer = answer
+	resp.Ns = ns
+	s.answers[name+" "+dns.TypeToString[qtype]] = resp
+}
+
+func (s *stubUpstream) resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	key := dns.CanonicalName(q.Name) + " " + dns.TypeToString[q.Qtype]
+	s.queries = append(s.queries, key)
+	if s.err != nil {
+		return nil, s.err
+	}
+	if !req.CheckingDisabled {
+		return nil, errors.New("validator queries must set CD")
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if canned, ok := s.answers[key]; ok {
+		resp.Rcode = canned.Rcode
+		resp.Answer = canned.Copy().Answer
+		resp.Ns = canned.Copy().Ns
+	}
+	return resp, nil
+}
+
+// testHierarchy is a root zone delegating securely to example. and without
+// DS to insecure., served by a stub upstream.
+type testHierarchy struct {
+	now           time.Time
+	root, example *testZone
+	upstream      *stubUpstream
+	validator     *Validator
+}
+
+func newTestHierarchy(t *testing.T) *testHierarchy {
+	t.Helper()
+	now := time.Now()
+	h := &testHierarchy{
+		now:      now,
+		root:     newTestZone(t, "."),
+		example:  newTestZone(t, "example."),
+		upstream: &stubUpstream{answers: make(map[string]*dns.Msg)},
+	}
+	up, root, example := h.upstream, h.root, h.example
+
+	up.set(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.dnskeys(t, now), nil)
+	ds := example.ksk.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	up.set("example.", dns.TypeDS, dns.RcodeSuccess, []dns.RR{ds, root.sign(t, now, ds)}, nil)
+	up.set("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.dnskeys(t, now), nil)
+	up.set("example.", dns.TypeSOA, dns.RcodeSuccess, []dns.RR{example.soa(), example.sign(t, now, example.soa())}, nil)
+
+	rootSOA := root.soa()
+	noDS := mustRR(t, "insecure. 300 IN NSEC zzz. NS RRSIG NSEC")
+	up.set("insecure.", dns.TypeDS, dns.RcodeSuccess, nil, []dns.RR{rootSOA, root.sign(t, now, rootSOA), noDS, root.sign(t, now, noDS)})
+	insecureSOA := mustRR(t, "insecure. 300 IN SOA ns.insecure. hostmaster.insecure. 1 3600 600 86400 300")
+	up.set("www.insecure.", dns.TypeSOA, dns.RcodeSuccess, nil, []dns.RR{insecureSOA})
+
+	anchor := filepath.Join(t.TempDir(), "anchor.txt")
+	if err := os.WriteFile(anchor, []byte(root.ksk.ToDS(dns.SHA256).String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(config.DNSSECConfig{TrustAnchor: "anchor.txt"}, filepath.Dir(anchor), up.resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return now }
+	h.validator = v
+	return h
+}
+
+func testRequest(name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	return req
+}
+
+func testReply(rcode int, answer, ns []dns.RR) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.Rcode = rcode
+	resp.Answer = answer
+	resp.Ns = ns
+	return resp
+}
+
+func TestValidateSecureAndTamperedAnswers(t *testing.T) {
+	h := newTestHierarchy(t)
+	a := mustRR(t, "www.example. 300 IN A 192.0.2.1")
+	sig := h.example.sign(t, h.now, a)
+
+	res := h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeA), testReply(dns.RcodeSuccess, []dns.RR{a, sig}, nil))
+	if res.Status != StatusSecure {
+		t.Fatalf("expected secure answer, got %+v", res)
+	}
+
+	tampered := mustRR(t, "www.example. 300 IN A 198.51.100.1")
+	res = h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeA), testReply(dns.RcodeSuccess, []dns.RR{tampered, sig}, nil))
+	if res.Status != StatusBogus || res.Err.Code != dns.ExtendedErrorCodeDNSBogus {
+		t.Fatalf("expected bogus tampered answer, got %+v", res)
+	}
+
+	res = h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeA), testReply(dns.RcodeSuccess, []dns.RR{a}, nil))
+	if res.Status != StatusBogus || res.Err.Code != dns.ExtendedErrorCodeRRSIGsMissing {
+		t.Fatalf("expected stripped signatures to be bogus, got %+v", res)
+	}
+
+	expired := h.example.sign(t, h.now.Add(-48*time.Hour), a)
+	res = h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeA), testReply(dns.RcodeSuccess, []dns.RR{a, expired}, nil))
+	if res.Status != StatusBogus || res.Err.Code != dns.ExtendedErrorCodeSignatureExpired {
+		t.Fatalf("expected expired signature to be bogus, got %+v", res)
+	}
+
+	// 密钥已缓存，再次验证不再查询上游
+	before := len(h.upstream.queries)
+	h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeA), testReply(dns.RcodeSuccess, []dns.RR{a, sig}, nil))
+	if len(h.upstream.queries) != before {
+		t.Fatalf("expected validated keys to be cached, got queries %v", h.upstream.queries[before:])
+	}
+}
+
+func TestValidateForgedKeyIsBogus(t *testing.T) {
+	h := newTestHierarchy(t)
+	forged := newTestZone(t, "example.")
+	h.upstream.set("example.", dns.TypeDNSKEY, dns.RcodeSuccess, forged.dnskeys(t, h.now), nil)
+
+	a := mustRR(t, "www.example. 300 IN A 192.0.2.1")
+	res := h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeA), testReply(dns.RcodeSuccess, []dns.RR{a, forged.sign(t, h.now, a)}, nil))
+	if res.Status != StatusBogus || res.Err.Code != dns.ExtendedErrorCodeDNSKEYMissing {
+		t.Fatalf("expected keys not matching the DS to be bogus, got %+v", res)
+	}
+}
+
+func TestValidateInsecureDelegation(t *testing.T) {
+	h := newTestHierarchy(t)
+	a := mustRR(t, "www.insecure. 300 IN A 192.0.2.1")
+
+	res := h.validator.Validate(context.Background(), testRequest("www.insecure.", dns.TypeA), testReply(dns.RcodeSuccess, []dns.RR{a}, nil))
+	if res.Status != StatusInsecure {
+		t.Fatalf("expected unsigned answer below an unsigned delegation to be insecure, got %+v", res)
+	}
+}
+
+func TestValidateDenialOfExistence(t *testing.T) {
+	h := newTestHierarchy(t)
+	soa := h.example.soa()
+	nsec := mustRR(t, "example. 300 IN NSEC www.example. NS SOA RRSIG NSEC DNSKEY")
+	wwwNSEC := mustRR(t, "www.example. 300 IN NSEC example. A RRSIG NSEC")
+	ns := []dns.RR{soa, h.example.sign(t, h.now, soa), nsec, h.example.sign(t, h.now, nsec)}
+
+	res := h.validator.Validate(context.Background(), testRequest("missing.example.", dns.TypeA), testReply(dns.RcodeNameError, nil, ns))
+	if res.Status != StatusSecure {
+		t.Fatalf("expected proven NXDOMAIN to be secure, got %+v", res)
+	}
+
+	res = h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeAAAA), testReply(dns.RcodeSuccess, nil, []dns.RR{soa, h.example.sign(t, h.now, soa), wwwNSEC, h.example.sign(t, h.now, wwwNSEC)}))
+	if res.Status != StatusSecure {
+		t.Fatalf("expected proven NODATA to be secure, got %+v", res)
+	}
+
+	res = h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeA), testReply(dns.RcodeSuccess, nil, []dns.RR{soa, h.example.sign(t, h.now, soa), wwwNSEC, h.example.sign(t, h.now, wwwNSEC)}))
+	if res.Status != StatusBogus || res.Err.Code != dns.ExtendedErrorCodeNSECMissing {
+		t.Fatalf("expected NODATA contradicted by the NSEC bitmap to be bogus, got %+v", res)
+	}
+
+	res = h.validator.Validate(context.Background(), testRequest("missing.example.", dns.TypeA), testReply(dns.RcodeNameError, nil, []dns.RR{soa, h.example.sign(t, h.now, soa)}))
+	if res.Status != StatusBogus || res.Err.Code != dns.ExtendedErrorCodeNSECMissing {
+		t.Fatalf("expected NXDOMAIN without NSEC to be bogus, got %+v", res)
+	}
+}
+
+func TestValidateNSECClosestEncloserAndWildcardProofs(t *testing.T) {
+	h := newTestHierarchy(t)
+	soa := h.example.soa()
+	signed := func(rrs ...dns.RR) []dns.RR {
+		out := []dns.RR{soa, h.example.sign(t, h.now, soa)}
+		for _, rr := range rrs {
+			out = append(out, rr, h.example.sign(t, h.now, rr))
+		}
+		return out
+	}
+	coverB := mustRR(t, "a.example. 300 IN NSEC c.example. A RRSIG NSEC")
+	coverWildcard := mustRR(t, "example. 300 IN NSEC a.example. NS SOA RRSIG NSEC DNSKEY")
+
+	res := h.validator.Validate(context.Background(), testRequest("b.example.", dns.TypeA), testReply(dns.RcodeNameError, nil, signed(coverB)))
+	if res.Status != StatusBogus || res.Err.Code != dns.ExtendedErrorCodeNSECMissing {
+		t.Fatalf("expected NXDOMAIN without wildcard proof to be bogus, got %+v", res)
+	}
+	res = h.validator.Validate(context.Background(), testRequest("b.example.", dns.TypeA), testReply(dns.RcodeNameError, nil, signed(coverB, coverWildcard)))
+	if res.Status != StatusSecure {
+		t.Fatalf("expected NXDOMAIN with wildcard proof to be secure, got %+v", res)
+	}
+
+	// 仅有覆盖名字的 NSEC 不能证明 NODATA，还需匹配通配符且不含该类型
+	res = h.validator.Validate(context.Background(), testRequest("b.example.", dns.TypeA), testReply(dns.RcodeSuccess, nil, signed(coverB)))
+	if res.Status != StatusBogus {
+		t.Fatalf("expected NODATA from a covering NSEC alone to be bogus, got %+v", res)
+	}
+	wildcard := mustRR(t, "*.example. 300 IN NSEC y.example. AAAA RRSIG NSEC")
+	res = h.validator.Validate(context.Background(), testRequest("x.example.", dns.TypeA), testReply(dns.RcodeSuccess, nil, signed(wildcard)))
+	if res.Status != StatusSecure {
+		t.Fatalf("expected wildcard NODATA to be secure, got %+v", res)
+	}
+
+	// 委派点的 NSEC 来自父区，不能证明其下的名字不存在
+	delegation := mustRR(t, "sub.example. 300 IN NSEC z.example. NS RRSIG NSEC")
+	res = h.validator.Validate(context.Background(), testRequest("www.sub.example.", dns.TypeA), testReply(dns.RcodeNameError, nil, signed(delegation, coverWildcard)))
+	if res.Status != StatusBogus {
+		t.Fatalf("expected a delegation NSEC not to prove names below it, got %+v", res)
+	}
+}
+
+// nsec3Chain returns the NSEC3 records (SHA-1, no salt or iterations) of a
+// zone holding names, each with the given types.
+func nsec3Chain(zone string, names map[string][]uint16, optOut bool) []*dns.NSEC3 {
+	hashes := make([]string, 0, len(names))
+	types := make(map[string][]uint16, len(names))
+	for name, bitmap := range names {
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		hashes = append(hashes, hash)
+		types[hash] = bitmap
+	}
+	sort.Strings(hashes)
+
+	var flags uint8
+	if optOut {
+		flags = 1
+	}
+	chain := make([]*dns.NSEC3, len(hashes))
+	for i, hash := range hashes {
+		chain[i] = &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: types[hash],
+		}
+	}
+	return chain
+}
+
+func TestValidateNSEC3Proofs(t *testing.T) {
+	h := newTestHierarchy(t)
+	soa := h.example.soa()
+	names := map[string][]uint16{
+		"example.":     {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"www.example.": {dns.TypeA, dns.TypeRRSIG},
+		"a.example.":   {dns.TypeA, dns.TypeRRSIG},
+		"b.example.":   {dns.TypeA, dns.TypeRRSIG},
+		"c.example.":   {dns.TypeA, dns.TypeRRSIG},
+	}
+	reply := func(chain []*dns.NSEC3, pick func(*dns.NSEC3) bool) *dns.Msg {
+		ns := []dns.RR{soa, h.example.sign(t, h.now, soa)}
+		for _, rr := range chain {
+			if pick(rr) {
+				ns = append(ns, rr, h.example.sign(t, h.now, rr))
+			}
+		}
+		return testReply(dns.RcodeNameError, nil, ns)
+	}
+
+	// 找一个不存在的名字，使最近存在祖先、下一更近名字与通配符分别由不同的 NSEC3 证明
+	chain := nsec3Chain("example.", names, false)
+	var missing string
+	var apex, nextCloser, wildcard *dns.NSEC3
+	for i := 0; missing == "" && i < 100; i++ {
+		name := fmt.Sprintf("m%d.example.", i)
+		apex, nextCloser, wildcard = nil, nil, nil
+		for _, rr := range chain {
+			switch {
+			case rr.Match("example."):
+				apex = rr
+			case rr.Cover(name):
+				nextCloser = rr
+			}
+		}
+		for _, rr := range chain {
+			if rr.Cover("*.example.") {
+				wildcard = rr
+			}
+		}
+		if apex != nil && nextCloser != nil && wildcard != nil && wildcard != nextCloser && wildcard != apex {
+			missing = name
+		}
+	}
+	if missing == "" {
+		t.Fatal("no suitable test name")
+	}
+	proof := func(rr *dns.NSEC3) bool { return rr == apex || rr == nextCloser || rr == wildcard }
+
+	res := h.validator.Validate(context.Background(), testRequest(missing, dns.TypeA), reply(chain, proof))
+	if res.Status != StatusSecure {
+		t.Fatalf("expected a complete NSEC3 proof to be secure, got %+v", res)
+	}
+	res = h.validator.Validate(context.Background(), testRequest(missing, dns.TypeA), reply(chain, func(rr *dns.NSEC3) bool { return rr == nextCloser || rr == wildcard }))
+	if res.Status != StatusBogus {
+		t.Fatalf("expected NXDOMAIN without closest encloser match to be bogus, got %+v", res)
+	}
+	res = h.validator.Validate(context.Background(), testRequest(missing, dns.TypeA), reply(chain, func(rr *dns.NSEC3) bool { return rr == apex || rr == nextCloser }))
+	if res.Status != StatusBogus {
+		t.Fatalf("expected NXDOMAIN without wildcard proof to be bogus, got %+v", res)
+	}
+
+	// opt-out 区间可能藏有未签名的委派，不能证明 NXDOMAIN
+	optOut := nsec3Chain("example.", names, true)
+	res = h.validator.Validate(context.Background(), testRequest(missing, dns.TypeA), reply(optOut, func(*dns.NSEC3) bool { return true }))
+	if res.Status != StatusInsecure || res.Err != nil {
+		t.Fatalf("expected an opt-out NSEC3 proof to be insecure, got %+v", res)
+	}
+}
+
+func TestValidateNegativeTrustAnchorAndUpstreamFailure(t *testing.T) {
+	h := newTestHierarchy(t)
+	h.validator.AddInsecureDomain("example")
+	tampered := mustRR(t, "www.example. 300 IN A 198.51.100.1")
+	res := h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeA), testReply(dns.RcodeSuccess, []dns.RR{tampered}, nil))
+	if res.Status != StatusInsecure {
+		t.Fatalf("expected names below a negative trust anchor to skip validation, got %+v", res)
+	}
+
+	h = newTestHierarchy(t)
+	h.upstream.err = errors.New("timeout")
+	a := mustRR(t, "www.example. 300 IN A 192.0.2.1")
+	res = h.validator.Validate(context.Background(), testRequest("www.example.", dns.TypeA), testReply(dns.RcodeSuccess, []dns.RR{a, h.example.sign(t, h.now, a)}, nil))
+	if res.Status != StatusIndeterminate || res.Err.Code != dns.ExtendedErrorCodeNetworkError {
+		t.Fatalf("expected unreachable upstream to be indeterminate, got %+v", res)
+	}
+	if len(h.validator.keys) != 0 {
+		t.Fatal("expected failures to reach the upstream not to be cached")
+	}
+}
+
+func TestBuiltinRootAnchors(t *testing.T) {
+	v, err := New(config.DNSSECConfig{}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := v.anchors["."]
+	if len(root.ds) != 2 || root.ds[0].KeyTag != 20326 || !strings.EqualFold(root.ds[1].Digest[:8], "683D2D0A") {
+		t.Fatalf("unexpected root anchors %+v", root.ds)
+	}
+	if _, err := New(config.DNSSECConfig{TrustAnchor: "missing.txt"}, t.TempDir(), nil); err == nil {
+		t.Fatal("expected missing trust anchor file to fail")
+	}
+}
+
+func TestCanonicalOrderAndCover(t *testing.T) {
+	if canonicalCompare("example.", "a.example.") >= 0 || canonicalCompare("z.example.", "a.b.example.") <= 0 || canonicalCompare("A.example.", "a.example.") != 0 {
+		t.Fatal("unexpected canonical order")
+	}
+	if !covers("a.example.", "c.example.", "b.example.") || covers("a.example.", "c.example.", "d.example.") {
+		t.Fatal("unexpected NSEC cover")
+	}
+	if !covers("y.example.", "example.", "z.example.") {
+		t.Fatal("expected the last NSEC to wrap around to the apex")
+	}
+}
@@ -0,0 +1,322 @@
+package dnssec
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rrset is one RRset of a message section with the signatures covering it.
+type rrset struct {
+	name   string
+	rrtype uint16
+	rrs    []dns.RR
+	sigs   []*dns.RRSIG
+}
+
+// rrsets groups a message section into RRsets in order of appearance. NS
+// records in the authority section are delegation data the parent does not
+// sign, so they are left out there.
+func rrsets(section []dns.RR, authority bool) []*rrset {
+	type key struct {
+		name   string
+		rrtype uint16
+	}
+	var sets []*rrset
+	index := make(map[key]*rrset)
+	get := func(name string, rrtype uint16) *rrset {
+		k := key{name: name, rrtype: rrtype}
+		set, ok := index[k]
+		if !ok {
+			set = &rrset{name: name, rrtype: rrtype}
+			index[k] = set
+			sets = append(sets, set)
+		}
+		return set
+	}
+
+	for _, rr := range section {
+		name := dns.CanonicalName(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.OPT:
+			continue
+		case *dns.RRSIG:
+			set := get(name, rr.TypeCovered)
+			set.sigs = append(set.sigs, rr)
+		default:
+			if authority && rr.Header().Rrtype == dns.TypeNS {
+				continue
+			}
+			set := get(name, rr.Header().Rrtype)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+
+	// 只有签名没有数据的 RRset 无需验证
+	filtered := sets[:0]
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			filtered = append(filtered, set)
+		}
+	}
+	return filtered
+}
+
+func hasRRset(section []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range section {
+		if rr.Header().Rrtype == qtype && dns.CanonicalName(rr.Header().Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Outcomes of checking a denial of existence.
+const (
+	denialMissing = iota
+	denialProven
+	// denialOptOut 表示名字落在 opt-out 的 NSEC3 区间内，可能是未签名的委派，无法证明不存在
+	denialOptOut
+)
+
+// proveDenial checks that the validated NSEC/NSEC3 records show that name
+// does not exist (nxdomain) or has no qtype records, including the closest
+// encloser and wildcard proofs (RFC 4035 section 5.4, RFC 5155 section 8).
+func proveDenial(sets []*rrset, name string, qtype uint16, nxdomain bool) int {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, set := range sets {
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+	switch {
+	case len(nsecs) > 0:
+		return nsecDenial(nsecs, name, qtype, nxdomain)
+	case len(nsec3s) > 0:
+		return nsec3Denial(nsec3s, name, qtype, nxdomain)
+	}
+	return denialMissing
+}
+
+func nsecDenial(nsecs []*dns.NSEC, name string, qtype uint16, nxdomain bool) int {
+	if !nxdomain {
+		for _, rr := range nsecs {
+			owner, next := dns.CanonicalName(rr.Hdr.Name), dns.CanonicalName(rr.NextDomain)
+			if owner == name {
+				if typesDenied(rr.TypeBitMap, qtype) {
+					return denialProven
+				}
+				return denialMissing
+			}
+			// 空非终端：覆盖名字的 NSEC 的下一个名字位于其下
+			if covers(owner, next, name) && dns.IsSubDomain(name, next) {
+				return denialProven
+			}
+		}
+	}
+
+	cover := nsecCovering(nsecs, name)
+	if cover == nil {
+		return denialMissing
+	}
+	ce := closestEncloser(name, dns.CanonicalName(cover.Hdr.Name), dns.CanonicalName(cover.NextDomain))
+	wildcard := wildcardOf(ce)
+	if nxdomain {
+		if nsecCovering(nsecs, wildcard) != nil {
+			return denialProven
+		}
+		return denialMissing
+	}
+	// 通配符展开的 NODATA：通配符存在但没有该类型
+	for _, rr := range nsecs {
+		if dns.CanonicalName(rr.Hdr.Name) == wildcard && typesDenied(rr.TypeBitMap, qtype) {
+			return denialProven
+		}
+	}
+	return denialMissing
+}
+
+// nsecCovering returns the NSEC covering name. NSEC records at a delegation
+// or DNAME come from the parent side and say nothing about names below them.
+func nsecCovering(nsecs []*dns.NSEC, name string) *dns.NSEC {
+	for _, rr := range nsecs {
+		owner := dns.CanonicalName(rr.Hdr.Name)
+		if !covers(owner, dns.CanonicalName(rr.NextDomain), name) {
+			continue
+		}
+		if dns.IsSubDomain(owner, name) && (hasType(rr.TypeBitMap, dns.TypeDNAME) || hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA)) {
+			continue
+		}
+		return rr
+	}
+	return nil
+}
+
+// closestEncloser returns the longest ancestor of name shared with the owner
+// or next name of the NSEC covering it.
+func closestEncloser(name, owner, next string) string {
+	common := dns.CompareDomainName(name, owner)
+	if n := dns.CompareDomainName(name, next); n > common {
+		common = n
+	}
+	return lastLabels(name, common)
+}
+
+func nsec3Denial(nsec3s []*dns.NSEC3, name string, qtype uint16, nxdomain bool) int {
+	if !nxdomain {
+		for _, rr := range nsec3s {
+			if rr.Match(name) {
+				if typesDenied(rr.TypeBitMap, qtype) {
+					return denialProven
+				}
+				return denialMissing
+			}
+		}
+	}
+
+	ce, cover := nsec3ClosestEncloser(nsec3s, name)
+	if cover == nil {
+		return denialMissing
+	}
+	// opt-out 区间可能包含未签名的委派 (RFC 5155 section 7.2.1)
+	if cover.Flags&0x01 != 0 {
+		return denialOptOut
+	}
+	wildcard := wildcardOf(ce)
+	if nxdomain {
+		if nsec3Covering(nsec3s, wildcard) != nil {
+			return denialProven
+		}
+		return denialMissing
+	}
+	for _, rr := range nsec3s {
+		if rr.Match(wildcard) && typesDenied(rr.TypeBitMap, qtype) {
+			return denialProven
+		}
+	}
+	return denialMissing
+}
+
+// nsec3ClosestEncloser finds the closest encloser proof of RFC 5155 section
+// 7.2.1: an NSEC3 matching the closest existing ancestor of name and another
+// covering the next closer name. It returns the closest encloser and the
+// NSEC3 covering the next closer name, or nil when the proof is incomplete.
+func nsec3ClosestEncloser(nsec3s []*dns.NSEC3, name string) (string, *dns.NSEC3) {
+	labels := dns.CountLabel(name)
+	for n := labels - 1; n >= 0; n-- {
+		ce := lastLabels(name, n)
+		for _, rr := range nsec3s {
+			if !rr.Match(ce) {
+				continue
+			}
+			// 委派点或 DNAME 不能作为最近存在祖先
+			if hasType(rr.TypeBitMap, dns.TypeDNAME) || hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA) {
+				return "", nil
+			}
+			return ce, nsec3Covering(nsec3s, lastLabels(name, n+1))
+		}
+	}
+	return "", nil
+}
+
+func nsec3Covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, rr := range nsec3s {
+		if rr.Cover(name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// typesDenied reports whether an NSEC/NSEC3 bitmap shows neither qtype nor
+// a CNAME that would have answered it.
+func typesDenied(bitmap []uint16, qtype uint16) bool {
+	return !hasType(bitmap, qtype) && !hasType(bitmap, dns.TypeCNAME)
+}
+
+// lastLabels returns the ancestor of name made of its last n labels.
+func lastLabels(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n <= 0 || len(labels) == 0 {
+		return "."
+	}
+	if n > len(labels) {
+		n = len(labels)
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+func wildcardOf(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+	return "*." + ce
+}
+
+// provesNoDS reports whether the validated records show that zone has no DS
+// RRset: an NSEC/NSEC3 at the name without the DS bit, an opt-out NSEC3
+// covering it, or proof that the name does not exist at all.
+func provesNoDS(sets []*rrset, zone string) bool {
+	for _, set := range sets {
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if set.name == zone {
+					if !hasType(rr.TypeBitMap, dns.TypeDS) {
+						return true
+					}
+				} else if covers(set.name, rr.NextDomain, zone) {
+					return true
+				}
+			case *dns.NSEC3:
+				if rr.Match(zone) {
+					if !hasType(rr.TypeBitMap, dns.TypeDS) {
+						return true
+					}
+				} else if rr.Cover(zone) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func hasType(bitmap []uint16, qtype uint16) bool {
+	for _, t := range bitmap {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// covers reports whether name falls strictly between owner and next in
+// canonical order; the last NSEC of a zone wraps around to the apex.
+func covers(owner, next, name string) bool {
+	afterOwner := canonicalCompare(owner, name) < 0
+	beforeNext := canonicalCompare(name, next) < 0
+	if canonicalCompare(owner, next) < 0 {
+		return afterOwner && beforeNext
+	}
+	return afterOwner || beforeNext
+}
+
+// canonicalCompare orders names as in RFC 4034 section 6.1: label by label
+// from the root, case-insensitively.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
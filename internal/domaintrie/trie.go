@@ -0,0 +1,145 @@
+package domaintrie
+
+import "strings"
+
+// Mode selects which names an inserted domain matches.
+type Mode uint8
+
+const (
+	// MatchExact matches the domain itself.
+	MatchExact Mode = 1 << iota
+	// MatchSubdomains matches every name below the domain, but not the
+	// domain itself.
+	MatchSubdomains
+
+	// MatchDomain matches the domain and all of its subdomains.
+	MatchDomain = MatchExact | MatchSubdomains
+)
+
+// Trie is a label-wise suffix trie: "www.example.com" is stored under
+// com → example → www, so a lookup walks the query name from the TLD down
+// and costs O(labels) regardless of how many domains are stored.
+type Trie struct {
+	root *node
+	size int
+}
+
+type node struct {
+	children map[string]*node
+
+	exact     string
+	hasExact  bool
+	subdomain string
+	hasSub    bool
+}
+
+func New() *Trie {
+	return &Trie{root: &node{}}
+}
+
+// Insert stores value for domain. Re-inserting the same domain and mode
+// overwrites the previous value.
+func (t *Trie) Insert(domain string, mode Mode, value string) {
+	domain = normalize(domain)
+	if domain == "" || mode&MatchDomain == 0 {
+		return
+	}
+
+	n := t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*node)
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &node{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+
+	if !n.hasExact && !n.hasSub {
+		t.size++
+	}
+	if mode&MatchExact != 0 {
+		n.exact, n.hasExact = value, true
+	}
+	if mode&MatchSubdomains != 0 {
+		n.subdomain, n.hasSub = value, true
+	}
+}
+
+// Taken reports which of the slots selected by mode are already set for
+// domain, so callers can keep the first of several conflicting entries.
+func (t *Trie) Taken(domain string, mode Mode) Mode {
+	domain = normalize(domain)
+	if domain == "" {
+		return 0
+	}
+
+	n := t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			return 0
+		}
+		n = child
+	}
+
+	var taken Mode
+	if mode&MatchExact != 0 && n.hasExact {
+		taken |= MatchExact
+	}
+	if mode&MatchSubdomains != 0 && n.hasSub {
+		taken |= MatchSubdomains
+	}
+	return taken
+}
+
+// Lookup returns the value of the most specific entry matching domain: an
+// exact entry for the name wins, otherwise the closest enclosing
+// subdomain entry.
+func (t *Trie) Lookup(domain string) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+	domain = normalize(domain)
+	if domain == "" {
+		return "", false
+	}
+
+	var value string
+	found := false
+
+	n := t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.hasSub {
+			value, found = n.subdomain, true
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			return value, found
+		}
+		n = child
+	}
+
+	if n.hasExact {
+		return n.exact, true
+	}
+	return value, found
+}
+
+// Len returns the number of distinct domains stored.
+func (t *Trie) Len() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
+
+func normalize(domain string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+}
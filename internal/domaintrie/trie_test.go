@@ -0,0 +1,56 @@
+package domaintrie
+
+import "testing"
+
+func TestTrieLookupPrefersMostSpecificEntry(t *testing.T) {
+	tr := New()
+	tr.Insert("example.com", MatchDomain, "domain")
+	tr.Insert("ads.example.com", MatchExact, "full")
+	tr.Insert("cdn.example.com", MatchSubdomains, "wildcard")
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{name: "example.com", value: "domain", ok: true},
+		{name: "WWW.Example.COM.", value: "domain", ok: true},
+		{name: "ads.example.com", value: "full", ok: true},
+		{name: "x.ads.example.com", value: "domain", ok: true},
+		{name: "cdn.example.com", value: "domain", ok: true},
+		{name: "img.cdn.example.com", value: "wildcard", ok: true},
+		{name: "example.org", ok: false},
+		{name: "com", ok: false},
+		{name: "notexample.com", ok: false},
+	}
+
+	for _, tc := range tests {
+		value, ok := tr.Lookup(tc.name)
+		if ok != tc.ok || value != tc.value {
+			t.Fatalf("Lookup(%q) = %q, %v; want %q, %v", tc.name, value, ok, tc.value, tc.ok)
+		}
+	}
+
+	if tr.Len() != 3 {
+		t.Fatalf("expected 3 entries, got %d", tr.Len())
+	}
+}
+
+func TestTrieSubdomainOnlyEntryDoesNotMatchApex(t *testing.T) {
+	tr := New()
+	tr.Insert("example.net", MatchSubdomains, "sub")
+
+	if _, ok := tr.Lookup("example.net"); ok {
+		t.Fatal("expected subdomain-only entry not to match the apex")
+	}
+	if v, ok := tr.Lookup("a.b.example.net"); !ok || v != "sub" {
+		t.Fatalf("expected deep subdomain to match, got %q %v", v, ok)
+	}
+}
+
+func TestNilTrieLookupMisses(t *testing.T) {
+	var tr *Trie
+	if _, ok := tr.Lookup("example.com"); ok {
+		t.Fatal("expected nil trie to miss")
+	}
+}
@@ -0,0 +1,42 @@
+// Package edns holds EDNS(0) helpers shared by the upstream clients and the
+// listeners.
+package edns
+
+import "github.com/miekg/dns"
+
+// Block sizes recommended by RFC 8467 section 4.1.
+const (
+	QueryBlockSize    = 128
+	ResponseBlockSize = 468
+)
+
+// Pad adds a Padding option (RFC 7830) so that the packed message is a
+// multiple of blockSize octets. Messages without an OPT record are left
+// alone, since padding is only allowed where EDNS was negotiated.
+func Pad(msg *dns.Msg, blockSize int) {
+	opt := msg.IsEdns0()
+	if opt == nil || blockSize <= 0 {
+		return
+	}
+	Strip(opt, func(code uint16) bool { return code != dns.EDNS0PADDING })
+
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	if rem := msg.Len() % blockSize; rem != 0 {
+		padding.Padding = make([]byte, blockSize-rem)
+	}
+}
+
+// Strip keeps only the options of opt for which keep returns true.
+func Strip(opt *dns.OPT, keep func(code uint16) bool) {
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if keep(o.Option()) {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
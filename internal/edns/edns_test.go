@@ -0,0 +1,53 @@
+package edns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPadRoundsPackedLengthToBlockSize(t *testing.T) {
+	for _, name := range []string{"a.example.", "a-much-longer-name.subdomain.example.com."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.SetEdns0(1232, false)
+
+		Pad(msg, QueryBlockSize)
+		// 重复填充时替换原有的 Padding 选项
+		Pad(msg, QueryBlockSize)
+
+		packed, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packed)%QueryBlockSize != 0 {
+			t.Fatalf("%s: packed length %d is not a multiple of %d", name, len(packed), QueryBlockSize)
+		}
+		if n := len(msg.IsEdns0().Option); n != 1 {
+			t.Fatalf("%s: expected a single padding option, got %d", name, n)
+		}
+	}
+
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	Pad(plain, QueryBlockSize)
+	if plain.IsEdns0() != nil {
+		t.Fatal("expected messages without EDNS to stay unpadded")
+	}
+}
+
+func TestStripKeepsSelectedOptions(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetEdns0(1232, true)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"},
+		&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1},
+	)
+
+	Strip(opt, func(code uint16) bool { return code == dns.EDNS0SUBNET })
+	if len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0SUBNET || !opt.Do() {
+		t.Fatalf("expected only ECS kept with DO intact, got %v", opt)
+	}
+}
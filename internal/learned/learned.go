@@ -0,0 +1,289 @@
+package learned
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Entry is one learned routing decision.
+type Entry struct {
+	Domain    string    `json:"domain"`
+	Target    string    `json:"target"`
+	Hits      int64     `json:"hits"`
+	LearnedAt time.Time `json:"learned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Store remembers which upstream group the GeoIP fallback picked for a
+// registrable domain (eTLD+1), so later queries under it skip the dual
+// resolve. All methods treat a nil *Store as empty.
+type Store struct {
+	path       string
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	dirty   bool
+
+	now func() time.Time
+}
+
+// New returns nil when learning is disabled. Entries saved at path by a
+// previous run are loaded immediately.
+func New(cfg config.LearnedRoutesConfig, path string) *Store {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	s := &Store{
+		path:       path,
+		ttl:        time.Duration(cfg.TTLHours) * time.Hour,
+		maxEntries: cfg.MaxEntries,
+		entries:    make(map[string]*Entry),
+		now:        time.Now,
+	}
+	if s.ttl <= 0 {
+		s.ttl = 168 * time.Hour
+	}
+	if s.maxEntries <= 0 {
+		s.maxEntries = 10000
+	}
+
+	if err := s.load(); err != nil && !os.IsNotExist(err) {
+		log.Printf("加载已学习的分流结果失败: %v", err)
+	}
+	return s
+}
+
+// Key returns the registrable domain decisions are stored under; names
+// without a public suffix (e.g. "router.lan") are kept as they are.
+func Key(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if key, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return key
+	}
+	return domain
+}
+
+// Lookup returns the learned target for domain.
+func (s *Store) Lookup(domain string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+
+	key := Key(domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return "", false
+	}
+	if !s.now().Before(e.ExpiresAt) {
+		delete(s.entries, key)
+		s.dirty = true
+		return "", false
+	}
+	e.Hits++
+	return e.Target, true
+}
+
+// Learn records target for the registrable domain of domain and extends its
+// expiry.
+func (s *Store) Learn(domain, target string) {
+	if s == nil {
+		return
+	}
+	s.set(Key(domain), target, false)
+}
+
+// Set stores a decision for domain exactly as given, e.g. from the web UI.
+func (s *Store) Set(domain, target string) {
+	if s == nil {
+		return
+	}
+	s.set(strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), ".")), target, true)
+}
+
+func (s *Store) set(key, target string, resetHits bool) {
+	if key == "" || target == "" {
+		return
+	}
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || e.Target != target || resetHits {
+		e = &Entry{Domain: key, Target: target, LearnedAt: now}
+		s.entries[key] = e
+	}
+	e.ExpiresAt = now.Add(s.ttl)
+	s.dirty = true
+
+	if len(s.entries) > s.maxEntries {
+		s.evictLocked()
+	}
+}
+
+// evictLocked drops expired entries, then the ones closest to expiry until
+// the store fits maxEntries again.
+func (s *Store) evictLocked() {
+	now := s.now()
+	var live []*Entry
+	for key, e := range s.entries {
+		if !now.Before(e.ExpiresAt) {
+			delete(s.entries, key)
+			continue
+		}
+		live = append(live, e)
+	}
+	if len(live) <= s.maxEntries {
+		return
+	}
+
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].ExpiresAt.Before(live[j].ExpiresAt)
+	})
+	for _, e := range live[:len(live)-s.maxEntries] {
+		delete(s.entries, e.Domain)
+	}
+}
+
+// Get returns the unexpired entry stored for domain.
+func (s *Store) Get(domain string) (Entry, bool) {
+	if s == nil {
+		return Entry{}, false
+	}
+	key := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || !s.now().Before(e.ExpiresAt) {
+		return Entry{}, false
+	}
+	return *e, true
+}
+
+// Delete forgets the given domains.
+func (s *Store) Delete(domains ...string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, domain := range domains {
+		key := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+		if _, ok := s.entries[key]; ok {
+			delete(s.entries, key)
+			s.dirty = true
+		}
+	}
+}
+
+// List returns every unexpired entry sorted by domain.
+func (s *Store) List() []Entry {
+	if s == nil {
+		return nil
+	}
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		if now.Before(e.ExpiresAt) {
+			list = append(list, *e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Domain < list[j].Domain
+	})
+	return list
+}
+
+// Save writes the store to disk if it changed since the last save.
+func (s *Store) Save() error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	now := s.now()
+	list := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		if now.Before(e.ExpiresAt) {
+			list = append(list, *e)
+		}
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Domain < list[j].Domain
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	// 先写临时文件再替换，避免写入中断留下损坏的文件
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	var list []Entry
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range list {
+		e := list[i]
+		if e.Domain == "" || e.Target == "" || !now.Before(e.ExpiresAt) {
+			continue
+		}
+		s.entries[e.Domain] = &e
+	}
+	if len(s.entries) > s.maxEntries {
+		s.evictLocked()
+	}
+	return nil
+}
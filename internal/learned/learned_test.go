@@ -0,0 +1,77 @@
+package learned
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+)
+
+func TestKeyUsesRegistrableDomain(t *testing.T) {
+	cases := map[string]string{
+		"www.bbc.co.uk.":      "bbc.co.uk",
+		"A.B.Example.com":     "example.com",
+		"example.com":         "example.com",
+		"github.io":           "github.io",
+		"user.github.io":      "user.github.io",
+		"deep.user.github.io": "user.github.io",
+	}
+	for name, want := range cases {
+		if got := Key(name); got != want {
+			t.Errorf("Key(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestStoreExpiresAndEvicts(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := New(config.LearnedRoutesConfig{Enabled: true, TTLHours: 1, MaxEntries: 2}, "")
+	s.now = func() time.Time { return now }
+
+	s.Learn("www.a.com", "cn")
+	if target, ok := s.Lookup("img.a.com"); !ok || target != "cn" {
+		t.Fatalf("expected learned target for sibling name, got %q %v", target, ok)
+	}
+
+	now = now.Add(30 * time.Minute)
+	s.Learn("b.com", "overseas")
+	s.Learn("c.com", "overseas")
+	if _, ok := s.Get("a.com"); ok {
+		t.Fatal("expected the entry closest to expiry to be evicted")
+	}
+	if len(s.List()) != 2 {
+		t.Fatalf("expected 2 entries, got %v", s.List())
+	}
+
+	now = now.Add(time.Hour)
+	if _, ok := s.Lookup("b.com"); ok {
+		t.Fatal("expected expired entry to be ignored")
+	}
+}
+
+func TestStoreSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "learned_routes.json")
+	cfg := config.LearnedRoutesConfig{Enabled: true}
+
+	s := New(cfg, path)
+	s.Learn("www.example.com", "overseas")
+	s.Lookup("example.com")
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	loaded := New(cfg, path)
+	entry, ok := loaded.Get("example.com")
+	if !ok || entry.Target != "overseas" || entry.Hits != 1 {
+		t.Fatalf("unexpected loaded entry %+v (ok=%v)", entry, ok)
+	}
+
+	if New(config.LearnedRoutesConfig{}, path) != nil {
+		t.Fatal("expected nil store when learning is disabled")
+	}
+	var disabled *Store
+	if _, ok := disabled.Lookup("example.com"); ok {
+		t.Fatal("expected nil store to be empty")
+	}
+}
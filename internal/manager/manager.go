@@ -6,12 +6,19 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime/debug"
 	"sync"
 	"time"
 	_ "time/tzdata"
 
+	"doh-autoproxy/internal/blocklist"
+	"doh-autoproxy/internal/cache"
+	"doh-autoproxy/internal/client"
 	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/learned"
+	"doh-autoproxy/internal/metrics"
 	"doh-autoproxy/internal/querylog"
 	"doh-autoproxy/internal/router"
 	"doh-autoproxy/internal/server"
@@ -26,6 +33,11 @@ type ServiceManager struct {
 	Router      *router.Router
 	CertManager *util.CertManager
 	QueryLog    *querylog.QueryLogger
+	Cache       *cache.Cache
+	Blocklists  *blocklist.Manager
+	Learned     *learned.Store
+	Series      *client.SeriesStore
+	Metrics     *metrics.Collector
 
 	DNSServer  *server.DNSServer
 	DoTServer  *server.DoTServer
@@ -33,12 +45,17 @@ type ServiceManager struct {
 	DoQServer  *server.DoQServer
 	ACMEServer *http.Server
 
+	// MetricsServer 为 metrics.address 的独立监听，随配置重载重启
+	MetricsServer  *http.Server
+	metricsHandler http.Handler
+
 	stopAutoUpdate chan struct{}
 }
 
 func NewServiceManager(initialCfg *config.Config) *ServiceManager {
 	return &ServiceManager{
 		Config:         initialCfg,
+		Metrics:        metrics.NewCollector(),
 		stopAutoUpdate: make(chan struct{}),
 	}
 }
@@ -86,6 +103,25 @@ func (m *ServiceManager) Reload(newCfg *config.Config) error {
 		log.Printf("Warning: Error stopping services during reload: %v", err)
 	}
 
+	if m.Cache != nil {
+		m.Cache.Flush()
+		if m.Config.Cache != newCfg.Cache {
+			m.Cache = nil
+		}
+	}
+
+	if !reflect.DeepEqual(m.Config.Blocklists, newCfg.Blocklists) {
+		m.Blocklists = nil
+	}
+
+	if m.Config.LearnedRoutes != newCfg.LearnedRoutes {
+		m.Learned = nil
+	}
+
+	if m.Config.UpstreamStats != newCfg.UpstreamStats {
+		m.Series = nil
+	}
+
 	if m.Config.QueryLog.SaveToFile && !newCfg.QueryLog.SaveToFile {
 		logFile := m.Config.QueryLog.File
 		if logFile == "" {
@@ -107,6 +143,31 @@ func (m *ServiceManager) Reload(newCfg *config.Config) error {
 	return nil
 }
 
+// SetMetricsHandler registers the handler served on metrics.address and
+// starts the dedicated listener when one is configured.
+func (m *ServiceManager) SetMetricsHandler(h http.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metricsHandler = h
+	m.startMetricsServer()
+}
+
+func (m *ServiceManager) startMetricsServer() {
+	cfg := m.Config.Metrics
+	if m.metricsHandler == nil || m.MetricsServer != nil || !cfg.Enabled || cfg.Address == "" {
+		return
+	}
+
+	srv := &http.Server{Addr: cfg.Address, Handler: m.metricsHandler}
+	m.MetricsServer = srv
+	go func() {
+		log.Printf("Metrics HTTP started on http://%s/metrics", cfg.Address)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("Metrics HTTP server failed: %v", err)
+		}
+	}()
+}
+
 func (m *ServiceManager) CheckAndDownloadGeoFiles() {
 	shouldDownload := func(path string) bool {
 		fi, err := os.Stat(path)
@@ -162,6 +223,7 @@ func (m *ServiceManager) runAutoUpdate() {
 	defer ticker.Stop()
 
 	lastAttempt := time.Time{}
+	lastBlocklistAttempt := time.Time{}
 
 	for {
 		select {
@@ -171,8 +233,26 @@ func (m *ServiceManager) runAutoUpdate() {
 			m.mu.Lock()
 			autoUpdate := m.Config.GeoData.AutoUpdate
 			geoIPFile := m.Config.GeoData.GeoIPDat
+			learnedRoutes := m.Learned
+			upstreamSeries := m.Series
+			blocklists := m.Blocklists
+			blocklistInterval := time.Duration(m.Config.Blocklists.UpdateInterval) * time.Hour
 			m.mu.Unlock()
 
+			if err := learnedRoutes.Save(); err != nil {
+				log.Printf("保存已学习的分流结果失败: %v", err)
+			}
+			if err := upstreamSeries.Save(); err != nil {
+				log.Printf("保存上游统计数据失败: %v", err)
+			}
+
+			// 拦截列表按自己的间隔刷新，与 Geo 数据的计划时间无关
+			if blocklists.Outdated(time.Now().Add(-blocklistInterval)) && time.Since(lastBlocklistAttempt) >= 1*time.Hour {
+				log.Println("触发计划的拦截列表更新...")
+				lastBlocklistAttempt = time.Now()
+				go blocklists.Update(true)
+			}
+
 			if autoUpdate == "" {
 				continue
 			}
@@ -250,7 +330,27 @@ func (m *ServiceManager) startInternal() error {
 	}
 	m.QueryLog = querylog.NewQueryLogger(cfg.QueryLog.Enabled, cfg.QueryLog.MaxHistory, cfg.QueryLog.MaxSizeMB, logFile, cfg.QueryLog.SaveToFile)
 
-	m.Router = router.NewRouter(cfg, m.GeoManager, m.QueryLog)
+	if m.Cache == nil {
+		m.Cache = cache.New(cfg.Cache)
+	}
+
+	if m.Blocklists == nil {
+		m.Blocklists = blocklist.New(cfg.Blocklists, filepath.Join(cfg.ConfigDir, "blocklists"))
+		if m.Blocklists != nil {
+			m.Blocklists.Load()
+			// 首次订阅的列表在后台下载，完成后直接生效，无需重载
+			go m.Blocklists.Update(false)
+		}
+	}
+
+	if m.Learned == nil {
+		m.Learned = learned.New(cfg.LearnedRoutes, filepath.Join(cfg.ConfigDir, "learned_routes.json"))
+	}
+
+	if m.Series == nil {
+		m.Series = client.NewSeriesStore(cfg.UpstreamStats, cfg.ConfigDir)
+	}
+	m.Router = router.NewRouter(cfg, m.GeoManager, m.QueryLog, m.Cache, m.Blocklists, m.Learned, m.Series, m.Metrics)
 
 	cm, err := util.NewCertManager(cfg)
 	if err != nil {
@@ -305,6 +405,8 @@ func (m *ServiceManager) startInternal() error {
 		}
 	}
 
+	m.startMetricsServer()
+
 	return nil
 }
 
@@ -320,6 +422,13 @@ func (m *ServiceManager) stopInternal() error {
 		m.ACMEServer = nil
 	}
 
+	if m.MetricsServer != nil {
+		if err := m.MetricsServer.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		m.MetricsServer = nil
+	}
+
 	if m.DNSServer != nil {
 		if err := m.DNSServer.Stop(); err != nil && firstErr == nil {
 			firstErr = err
@@ -362,6 +471,13 @@ func (m *ServiceManager) stopInternal() error {
 		m.QueryLog = nil
 	}
 
+	if err := m.Learned.Save(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := m.Series.Save(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
 	return firstErr
 }
 
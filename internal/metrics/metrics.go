@@ -0,0 +1,218 @@
+// Package metrics renders the Prometheus text exposition format and counts
+// the queries answered by the listeners.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writer emits metric families in the Prometheus text format (version 0.0.4).
+type Writer struct {
+	buf *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{buf: bufio.NewWriter(w)}
+}
+
+// Header starts a metric family.
+func (w *Writer) Header(name, typ, help string) {
+	w.buf.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	w.buf.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// Value writes one sample; labels are name/value pairs.
+func (w *Writer) Value(name string, value float64, labels ...string) {
+	w.buf.WriteString(name)
+	w.writeLabels(labels)
+	w.buf.WriteByte(' ')
+	w.buf.WriteString(formatFloat(value))
+	w.buf.WriteByte('\n')
+}
+
+// Histogram writes the _bucket, _sum and _count samples of a histogram.
+// counts holds one non-cumulative count per bound plus the +Inf bucket.
+func (w *Writer) Histogram(name string, bounds []float64, counts []uint64, sum float64, labels ...string) {
+	var cumulative uint64
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		w.Value(name+"_bucket", float64(cumulative), append(labels[:len(labels):len(labels)], "le", formatFloat(bound))...)
+	}
+	cumulative += counts[len(bounds)]
+	w.Value(name+"_bucket", float64(cumulative), append(labels[:len(labels):len(labels)], "le", "+Inf")...)
+	w.Value(name+"_sum", sum, labels...)
+	w.Value(name+"_count", float64(cumulative), labels...)
+}
+
+func (w *Writer) Flush() error {
+	return w.buf.Flush()
+}
+
+func (w *Writer) writeLabels(labels []string) {
+	if len(labels) < 2 {
+		return
+	}
+	w.buf.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			w.buf.WriteByte(',')
+		}
+		w.buf.WriteString(labels[i])
+		w.buf.WriteString(`="`)
+		w.buf.WriteString(escapeLabel(labels[i+1]))
+		w.buf.WriteByte('"')
+	}
+	w.buf.WriteByte('}')
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// durationBounds are the bucket bounds in seconds of the query duration
+// histograms.
+var durationBounds = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type queryKey struct {
+	listener string
+	route    string
+	rcode    string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+}
+
+// Collector counts the queries answered through the router. It is owned by
+// the service manager so counters survive config reloads; a nil collector
+// ignores observations.
+type Collector struct {
+	mu        sync.Mutex
+	queries   map[queryKey]uint64
+	durations map[string]*histogram
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		queries:   make(map[queryKey]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// ObserveQuery records one query answered on listener (udp, tcp, dot, doh,
+// doq) with the given route decision and rcode.
+func (c *Collector) ObserveQuery(listener, route, rcode string, d time.Duration) {
+	if c == nil {
+		return
+	}
+	if listener == "" {
+		listener = "unknown"
+	}
+	seconds := d.Seconds()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries[queryKey{listener: listener, route: route, rcode: rcode}]++
+	h, ok := c.durations[listener]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBounds)+1)}
+		c.durations[listener] = h
+	}
+	h.counts[sort.SearchFloat64s(durationBounds, seconds)]++
+	h.sum += seconds
+}
+
+// Write emits the query counters and duration histograms.
+func (c *Collector) Write(w *Writer) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]queryKey, 0, len(c.queries))
+	for key := range c.queries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.listener != b.listener {
+			return a.listener < b.listener
+		}
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.rcode < b.rcode
+	})
+	w.Header("doh_queries_total", "counter", "DNS queries answered, by listener protocol, route decision and response code.")
+	for _, key := range keys {
+		w.Value("doh_queries_total", float64(c.queries[key]), "listener", key.listener, "route", key.route, "rcode", key.rcode)
+	}
+
+	listeners := make([]string, 0, len(c.durations))
+	for listener := range c.durations {
+		listeners = append(listeners, listener)
+	}
+	sort.Strings(listeners)
+	w.Header("doh_query_duration_seconds", "histogram", "Time spent answering DNS queries, by listener protocol.")
+	for _, listener := range listeners {
+		h := c.durations[listener]
+		w.Histogram("doh_query_duration_seconds", durationBounds, h.counts, h.sum, "listener", listener)
+	}
+}
+
+var startTime = time.Now()
+
+// WriteRuntime emits Go runtime and process metrics.
+func WriteRuntime(w *Writer) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	w.Header("go_info", "gauge", "Information about the Go environment.")
+	w.Value("go_info", 1, "version", runtime.Version())
+	w.Header("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	w.Value("go_goroutines", float64(runtime.NumGoroutine()))
+	w.Header("go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	w.Value("go_memstats_alloc_bytes", float64(m.Alloc))
+	w.Header("go_memstats_alloc_bytes_total", "counter", "Cumulative bytes allocated for heap objects.")
+	w.Value("go_memstats_alloc_bytes_total", float64(m.TotalAlloc))
+	w.Header("go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the OS.")
+	w.Value("go_memstats_sys_bytes", float64(m.Sys))
+	w.Header("go_memstats_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.")
+	w.Value("go_memstats_heap_inuse_bytes", float64(m.HeapInuse))
+	w.Header("go_memstats_heap_objects", "gauge", "Number of allocated heap objects.")
+	w.Value("go_memstats_heap_objects", float64(m.HeapObjects))
+	w.Header("go_gc_cycles_total", "counter", "Completed GC cycles.")
+	w.Value("go_gc_cycles_total", float64(m.NumGC))
+	w.Header("go_gc_pause_seconds_total", "counter", "Cumulative time spent in GC stop-the-world pauses.")
+	w.Value("go_gc_pause_seconds_total", float64(m.PauseTotalNs)/1e9)
+	w.Header("go_memstats_last_gc_time_seconds", "gauge", "Time of the last garbage collection since the epoch.")
+	w.Value("go_memstats_last_gc_time_seconds", float64(m.LastGC)/1e9)
+	w.Header("process_start_time_seconds", "gauge", "Start time of the process since the epoch.")
+	w.Value("process_start_time_seconds", float64(startTime.UnixNano())/1e9)
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriterFormatsSamplesAndHistograms(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Header("test_total", "counter", "Line one\nline two.")
+	w.Value("test_total", 3, "route", `Rule("CN")`)
+	w.Header("test_seconds", "histogram", "Durations.")
+	w.Histogram("test_seconds", []float64{0.1, 1}, []uint64{2, 1, 1}, 2.5, "listener", "udp")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_total Line one\nline two.
+# TYPE test_total counter
+test_total{route="Rule(\"CN\")"} 3
+# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{listener="udp",le="0.1"} 2
+test_seconds_bucket{listener="udp",le="1"} 3
+test_seconds_bucket{listener="udp",le="+Inf"} 4
+test_seconds_sum{listener="udp"} 2.5
+test_seconds_count{listener="udp"} 4
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCollectorCountsQueriesByListenerRouteAndRcode(t *testing.T) {
+	c := NewCollector()
+	c.ObserveQuery("udp", "Rule(CN)", "NOERROR", 2*time.Millisecond)
+	c.ObserveQuery("udp", "Rule(CN)", "NOERROR", 20*time.Millisecond)
+	c.ObserveQuery("doh", "GeoIP(Overseas)", "NXDOMAIN", 3*time.Second)
+	c.ObserveQuery("", "Hosts", "NOERROR", 0)
+
+	var nilCollector *Collector
+	nilCollector.ObserveQuery("udp", "Rule(CN)", "NOERROR", time.Millisecond)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	c.Write(w)
+	w.Flush()
+	out := buf.String()
+
+	for _, line := range []string{
+		`doh_queries_total{listener="udp",route="Rule(CN)",rcode="NOERROR"} 2`,
+		`doh_queries_total{listener="doh",route="GeoIP(Overseas)",rcode="NXDOMAIN"} 1`,
+		`doh_queries_total{listener="unknown",route="Hosts",rcode="NOERROR"} 1`,
+		`doh_query_duration_seconds_bucket{listener="udp",le="0.0025"} 1`,
+		`doh_query_duration_seconds_bucket{listener="udp",le="0.025"} 2`,
+		`doh_query_duration_seconds_bucket{listener="doh",le="2.5"} 0`,
+		`doh_query_duration_seconds_count{listener="doh"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+	if strings.Index(out, `listener="doh"`) > strings.Index(out, `listener="udp"`) {
+		t.Fatalf("expected samples sorted by listener:\n%s", out)
+	}
+}
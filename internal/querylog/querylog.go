@@ -26,6 +26,10 @@ type LogEntry struct {
 	AnswerRecords []AnswerRecord `json:"answer_records"`
 	DurationMs    int64          `json:"duration_ms"`
 	Status        string         `json:"status"`
+	DNSSEC        string         `json:"dnssec,omitempty"`
+	// EDE 为返回给客户端的扩展错误码（RFC 8914），EDEText 为其名称与说明
+	EDE     *uint16 `json:"ede,omitempty"`
+	EDEText string  `json:"ede_text,omitempty"`
 }
 
 type AnswerRecord struct {
@@ -40,6 +44,7 @@ type Stats struct {
 	TotalQueries  int64            `json:"total_queries"`
 	TotalCN       int64            `json:"total_cn"`
 	TotalOverseas int64            `json:"total_overseas"`
+	TotalBlocked  int64            `json:"total_blocked"`
 	QPS           float64          `json:"qps"`
 	TopClients    map[string]int64 `json:"top_clients"`
 	TopDomains    map[string]int64 `json:"top_domains"`
@@ -64,6 +69,18 @@ type QueryLogger struct {
 	writerDone        chan struct{}
 	closeOnce         sync.Once
 	closed            atomic.Bool
+
+	// queueOverflows 为写入队列已满、改为同步写文件的次数；queueDrops 为关闭后未能写入文件的条目数
+	queueOverflows atomic.Uint64
+	queueDrops     atomic.Uint64
+}
+
+// QueueStats describes the file write queue of a QueryLogger.
+type QueueStats struct {
+	Length    int
+	Capacity  int
+	Overflows uint64
+	Drops     uint64
 }
 
 const defaultMaxMemoryLogs = 5000
@@ -204,7 +221,11 @@ func cloneEntry(entry LogEntry) LogEntry {
 }
 
 func (l *QueryLogger) enqueueFileWrite(entry LogEntry) {
-	if l.fileQueue == nil || l.closed.Load() {
+	if l.fileQueue == nil {
+		return
+	}
+	if l.closed.Load() {
+		l.queueDrops.Add(1)
 		return
 	}
 
@@ -212,10 +233,25 @@ func (l *QueryLogger) enqueueFileWrite(entry LogEntry) {
 	case l.fileQueue <- entry:
 	default:
 		// 队列满时直接回退到同步写，避免额外 goroutine 堆积。
+		l.queueOverflows.Add(1)
 		l.appendToFile(entry)
 	}
 }
 
+// QueueStats reports the state of the file write queue; all zero when the
+// log is not saved to file.
+func (l *QueryLogger) QueueStats() QueueStats {
+	if l == nil {
+		return QueueStats{}
+	}
+	return QueueStats{
+		Length:    len(l.fileQueue),
+		Capacity:  cap(l.fileQueue),
+		Overflows: l.queueOverflows.Load(),
+		Drops:     l.queueDrops.Load(),
+	}
+}
+
 func (l *QueryLogger) Close() error {
 	l.closeOnce.Do(func() {
 		l.closed.Store(true)
@@ -232,7 +268,9 @@ func (l *QueryLogger) Close() error {
 
 func (l *QueryLogger) updateTotals(entry *LogEntry) {
 	l.stats.TotalQueries++
-	if strings.Contains(entry.Upstream, "CN") {
+	if strings.HasPrefix(entry.Upstream, "Block(") {
+		l.stats.TotalBlocked++
+	} else if strings.Contains(entry.Upstream, "CN") {
 		l.stats.TotalCN++
 	} else if strings.Contains(entry.Upstream, "Overseas") {
 		l.stats.TotalOverseas++
@@ -579,7 +617,8 @@ func matches(entry *LogEntry, searchLower string) bool {
 		strings.Contains(strings.ToLower(entry.Type), searchLower) ||
 		strings.Contains(strings.ToLower(entry.Upstream), searchLower) ||
 		strings.Contains(strings.ToLower(entry.Answer), searchLower) ||
-		strings.Contains(strings.ToLower(entry.Status), searchLower)
+		strings.Contains(strings.ToLower(entry.Status), searchLower) ||
+		strings.Contains(strings.ToLower(entry.EDEText), searchLower)
 }
 
 func (l *QueryLogger) GetStats() Stats {
@@ -32,6 +32,33 @@ type Bootstrapper struct {
 	counter  uint64
 	cache    sync.Map
 	cacheTTL time.Duration
+
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+	failures atomic.Uint64
+}
+
+// BootstrapStats are the cache counters of a Bootstrapper.
+type BootstrapStats struct {
+	Hits     uint64
+	Misses   uint64
+	Failures uint64
+	Size     int
+}
+
+// Stats reports cache hits, misses, failed lookups and cached hosts.
+func (b *Bootstrapper) Stats() BootstrapStats {
+	size := 0
+	b.cache.Range(func(_, _ interface{}) bool {
+		size++
+		return true
+	})
+	return BootstrapStats{
+		Hits:     b.hits.Load(),
+		Misses:   b.misses.Load(),
+		Failures: b.failures.Load(),
+		Size:     size,
+	}
 }
 
 func NewBootstrapper(servers []string) *Bootstrapper {
@@ -89,13 +116,16 @@ func (b *Bootstrapper) LookupIP(ctx context.Context, host string) (string, error
 	if entry, ok := b.cache.Load(host); ok {
 		ce := entry.(*cacheEntry)
 		if time.Now().Before(ce.expiry) {
+			b.hits.Add(1)
 			return ce.ip, nil
 		}
 		b.cache.Delete(host)
 	}
+	b.misses.Add(1)
 
 	ip, err := b.lookupWithRetry(ctx, host)
 	if err != nil {
+		b.failures.Add(1)
 		return "", err
 	}
 
@@ -1,6 +1,10 @@
 package resolver
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+)
 
 func TestParseBootstrapServerDefaultsToUDP(t *testing.T) {
 	server := parseBootstrapServer("8.8.8.8")
@@ -31,3 +35,23 @@ func TestNewBootstrapperSkipsEmptyEntries(t *testing.T) {
 		t.Fatalf("expected 1 bootstrap server, got %d", len(bootstrapper.servers))
 	}
 }
+
+func TestBootstrapperCountsCacheHitsAndFailures(t *testing.T) {
+	bootstrapper := NewBootstrapper(nil)
+	bootstrapper.cache.Store("dns.example", &cacheEntry{ip: "192.0.2.1", expiry: time.Now().Add(time.Minute)})
+
+	if ip, err := bootstrapper.LookupIP(context.Background(), "dns.example"); err != nil || ip != "192.0.2.1" {
+		t.Fatalf("expected cached IP, got %q (err=%v)", ip, err)
+	}
+	if _, err := bootstrapper.LookupIP(context.Background(), "192.0.2.2"); err != nil {
+		t.Fatalf("expected IP literal to pass through, got %v", err)
+	}
+	if _, err := bootstrapper.LookupIP(context.Background(), "nonexistent.invalid"); err == nil {
+		t.Fatal("expected lookup of an invalid name to fail")
+	}
+
+	stats := bootstrapper.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Failures != 1 || stats.Size != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,160 @@
+package router
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"doh-autoproxy/internal/client"
+	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/dnssec"
+
+	"github.com/miekg/dns"
+)
+
+// newValidator builds the DNSSEC validator when validation is enabled. The
+// domains of conditional forwarding rules usually point at internal servers
+// that do not sign, so they become negative trust anchors.
+func newValidator(cfg *config.Config, groups map[string][]client.DNSClient) *dnssec.Validator {
+	if !cfg.DNSSEC.Enabled {
+		return nil
+	}
+	upstream := strings.ToLower(cfg.DNSSEC.Upstream)
+	if upstream == "" {
+		upstream = config.GroupOverseas
+	}
+	clients := groups[upstream]
+	if len(clients) == 0 {
+		log.Printf("DNSSEC 验证使用的上游分组 %s 不存在或为空，已关闭验证", upstream)
+		return nil
+	}
+
+	v, err := dnssec.New(cfg.DNSSEC, cfg.ConfigDir, func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		// 验证所需的 DNSKEY/DS 查询不是客户端采用的应答，不计入胜出次数
+		ctx, _ = client.WithWinner(ctx)
+		return client.RaceResolve(ctx, req, clients)
+	})
+	if err != nil {
+		log.Printf("初始化 DNSSEC 验证失败，已关闭验证: %v", err)
+		return nil
+	}
+	for domain, target := range cfg.Rules {
+		if !strings.Contains(target, "://") {
+			continue
+		}
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		switch {
+		case strings.HasPrefix(domain, prefixKeyword), strings.HasPrefix(domain, prefixRegexp), strings.HasPrefix(domain, prefixGeoSite):
+			continue
+		case strings.HasPrefix(domain, prefixFull):
+			domain = strings.TrimPrefix(domain, prefixFull)
+		case strings.HasPrefix(domain, prefixDomain):
+			domain = strings.TrimPrefix(domain, prefixDomain)
+		case strings.HasPrefix(domain, prefixWild):
+			domain = strings.TrimPrefix(domain, prefixWild)
+		}
+		v.AddInsecureDomain(domain)
+	}
+	return v
+}
+
+// cachedDNSSECStatus recovers the status of a cached answer: only validated
+// answers carry the AD bit, and bogus ones are never cached.
+func (r *Router) cachedDNSSECStatus(req, resp *dns.Msg) string {
+	if r.dnssec == nil || r.dnssec.Skip(req.Question[0].Name) {
+		return ""
+	}
+	if resp.AuthenticatedData {
+		return dnssec.StatusSecure
+	}
+	return dnssec.StatusInsecure
+}
+
+// resolveValidated runs resolve and, when validation is on, asks upstreams
+// for signatures and checks the answer. Bogus answers become SERVFAIL with an
+// extended DNS error recorded in ctx, except for clients that set CD, which
+// get the data as is (RFC 4035 section 3.2.2).
+func (r *Router) resolveValidated(ctx context.Context, req *dns.Msg, resolve resolveFunc) (*dns.Msg, string, string, error) {
+	if r.dnssec == nil || r.dnssec.Skip(req.Question[0].Name) {
+		resp, upstream, err := resolve(ctx, req)
+		return resp, upstream, "", err
+	}
+
+	resp, upstream, err := resolve(ctx, dnssecRequest(req))
+	if err != nil || resp == nil {
+		return resp, upstream, "", err
+	}
+	res := r.dnssec.Validate(ctx, req, resp)
+	if res.Err != nil {
+		log.Printf("DNSSEC 验证失败 (%s): %s %s: %v", res.Status, req.Question[0].Name, dns.Type(req.Question[0].Qtype), res.Err)
+		resp.AuthenticatedData = false
+		if !req.CheckingDisabled {
+			resp = servfailResponse(req)
+			setExtendedError(ctx, res.Err.Code, res.Err.Reason)
+		}
+		return resp, upstream, res.Status, nil
+	}
+	resp.AuthenticatedData = res.Status == dnssec.StatusSecure
+	return resp, upstream, res.Status, nil
+}
+
+// dnssecRequest asks upstreams for DNSSEC records (DO) and for data they
+// could not validate themselves (CD), since the answer is validated here.
+func dnssecRequest(req *dns.Msg) *dns.Msg {
+	upstreamReq := req.Copy()
+	if opt := upstreamReq.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		upstreamReq.SetEdns0(1232, true)
+	}
+	upstreamReq.CheckingDisabled = true
+	return upstreamReq
+}
+
+// shapeDNSSECResponse fits an answer fetched with DO and CD back to what the
+// client asked for: DNSSEC records only with DO (RFC 4035 section 3.2.1), AD
+// only with DO or AD (RFC 6840 section 5.8), and no OPT without EDNS.
+func shapeDNSSECResponse(req, resp *dns.Msg) {
+	opt := req.IsEdns0()
+	do := opt != nil && opt.Do()
+	if !do {
+		qtype := req.Question[0].Qtype
+		resp.Answer = stripDNSSECRecords(resp.Answer, qtype)
+		resp.Ns = stripDNSSECRecords(resp.Ns, qtype)
+		resp.Extra = stripDNSSECRecords(resp.Extra, qtype)
+		if !req.AuthenticatedData {
+			resp.AuthenticatedData = false
+		}
+	}
+
+	respOpt := resp.IsEdns0()
+	switch {
+	case respOpt == nil:
+	case opt == nil:
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+	case do:
+		respOpt.SetDo()
+	default:
+		respOpt.SetDo(false)
+	}
+}
+
+func stripDNSSECRecords(section []dns.RR, qtype uint16) []dns.RR {
+	kept := section[:0]
+	for _, rr := range section {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
@@ -0,0 +1,137 @@
+package router
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"doh-autoproxy/internal/domaintrie"
+)
+
+const (
+	prefixFull    = "full:"
+	prefixDomain  = "domain:"
+	prefixKeyword = "keyword:"
+	prefixRegexp  = "regexp:"
+	prefixGeoSite = "geosite:"
+	prefixWild    = "*."
+)
+
+// domainMatcher resolves rule.txt / hosts.txt keys written in v2ray/mihomo
+// style:
+//
+//	full:example.com     only example.com
+//	domain:example.com   example.com and every subdomain
+//	*.example.com        every subdomain, but not example.com itself
+//	keyword:example      any name containing "example"
+//
+// Keys without a prefix use the mode passed to newDomainMatcher. For a single
+// name, full matches win over the longest matching suffix, which wins over
+// keywords; regexp: and geosite: keys are handled by the router separately.
+// When several keys claim the same name, the first in the order full:,
+// domain:, plain, *. (then lexical) wins and the others are logged.
+type domainMatcher struct {
+	trie     *domaintrie.Trie
+	keywords []keywordEntry
+}
+
+type keywordEntry struct {
+	keyword string
+	value   string
+}
+
+func newDomainMatcher(entries map[string]string, plain domaintrie.Mode) *domainMatcher {
+	m := &domainMatcher{trie: domaintrie.New()}
+
+	// 按 full: → domain: → 不带前缀 → *. 、同类按字典序插入，
+	// 同一域名的冲突规则保留先插入的一条，结果不受 map 遍历顺序影响
+	keys := make([]domainKey, 0, len(entries))
+	for key, value := range entries {
+		keys = append(keys, domainKey{key: strings.ToLower(strings.TrimSpace(key)), value: value})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if ra, rb := keyRank(a.key), keyRank(b.key); ra != rb {
+			return ra < rb
+		}
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		return a.value < b.value
+	})
+
+	for _, k := range keys {
+		key, value := k.key, k.value
+		switch {
+		case strings.HasPrefix(key, prefixRegexp), strings.HasPrefix(key, prefixGeoSite):
+		case strings.HasPrefix(key, prefixFull):
+			m.insert(key, strings.TrimPrefix(key, prefixFull), domaintrie.MatchExact, value)
+		case strings.HasPrefix(key, prefixDomain):
+			m.insert(key, strings.TrimPrefix(key, prefixDomain), domaintrie.MatchDomain, value)
+		case strings.HasPrefix(key, prefixWild):
+			m.insert(key, strings.TrimPrefix(key, prefixWild), domaintrie.MatchSubdomains, value)
+		case strings.HasPrefix(key, prefixKeyword):
+			if keyword := strings.TrimPrefix(key, prefixKeyword); keyword != "" {
+				m.keywords = append(m.keywords, keywordEntry{keyword: keyword, value: value})
+			}
+		default:
+			m.insert(key, key, plain, value)
+		}
+	}
+
+	// 关键字按长度降序、同长度按字典序，保证匹配结果稳定
+	sort.Slice(m.keywords, func(i, j int) bool {
+		a, b := m.keywords[i].keyword, m.keywords[j].keyword
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+
+	return m
+}
+
+type domainKey struct {
+	key   string
+	value string
+}
+
+func keyRank(key string) int {
+	switch {
+	case strings.HasPrefix(key, prefixFull):
+		return 0
+	case strings.HasPrefix(key, prefixDomain):
+		return 1
+	case strings.HasPrefix(key, prefixWild):
+		return 3
+	default:
+		return 2
+	}
+}
+
+// insert adds domain to the trie unless an earlier key already claimed the
+// same names; only the unclaimed part of mode is stored.
+func (m *domainMatcher) insert(key, domain string, mode domaintrie.Mode, value string) {
+	taken := m.trie.Taken(domain, mode)
+	if taken != 0 {
+		log.Printf("规则 %s -> %s 与同一域名的其他规则冲突，冲突部分已忽略", key, value)
+	}
+	if free := mode &^ taken; free != 0 {
+		m.trie.Insert(domain, free, value)
+	}
+}
+
+func (m *domainMatcher) lookup(name string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	if value, ok := m.trie.Lookup(name); ok {
+		return value, true
+	}
+	for _, kw := range m.keywords {
+		if strings.Contains(name, kw.keyword) {
+			return kw.value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,126 @@
+package router
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+
+	"doh-autoproxy/internal/client"
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// ecsOverride maps client networks to the subnet upstreams in client or
+// static ECS mode receive for them.
+type ecsOverride struct {
+	clients []*net.IPNet
+	subnet  *net.IPNet
+}
+
+func buildECSOverrides(cfg config.ECSConfig) []ecsOverride {
+	var overrides []ecsOverride
+	for _, entry := range cfg.ClientSubnets {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(entry.Subnet))
+		if err != nil {
+			log.Printf("忽略无效的客户端 ECS 子网: %s (%v)", entry.Subnet, err)
+			continue
+		}
+		o := ecsOverride{subnet: subnet}
+		for _, c := range entry.Clients {
+			if network := parseClientNetwork(c); network != nil {
+				o.clients = append(o.clients, network)
+			} else {
+				log.Printf("忽略无效的客户端地址: %s", c)
+			}
+		}
+		if len(o.clients) > 0 {
+			overrides = append(overrides, o)
+		}
+	}
+	return overrides
+}
+
+func parseClientNetwork(s string) *net.IPNet {
+	s = strings.TrimSpace(s)
+	if _, network, err := net.ParseCIDR(s); err == nil {
+		return network
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// ecsSubnetFor returns the configured subnet of the first override that
+// matches ip.
+func (r *Router) ecsSubnetFor(ip net.IP) *net.IPNet {
+	if ip == nil {
+		return nil
+	}
+	for _, o := range r.ecsOverrides {
+		for _, network := range o.clients {
+			if network.Contains(ip) {
+				return o.subnet
+			}
+		}
+	}
+	return nil
+}
+
+// echoClientECS makes the ECS option of resp answer the client's own query:
+// clients that sent none get none, others get their family, address and
+// source prefix back with the scope the upstream returned (RFC 7871 section
+// 7.2.2).
+func echoClientECS(req, resp *dns.Msg) {
+	respOpt := resp.IsEdns0()
+	if respOpt == nil {
+		return
+	}
+
+	var reqSubnet *dns.EDNS0_SUBNET
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				reqSubnet = subnet
+				break
+			}
+		}
+	}
+
+	options := respOpt.Option[:0]
+	for _, o := range respOpt.Option {
+		subnet, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			options = append(options, o)
+			continue
+		}
+		if reqSubnet == nil {
+			continue
+		}
+		scope := subnet.SourceScope
+		if subnet.Family != reqSubnet.Family {
+			scope = 0
+		}
+		options = append(options, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        reqSubnet.Family,
+			SourceNetmask: reqSubnet.SourceNetmask,
+			SourceScope:   scope,
+			Address:       reqSubnet.Address,
+		})
+	}
+	respOpt.Option = options
+}
+
+// withClient records the querying client for upstreams that derive ECS
+// from it.
+func (r *Router) withClient(ctx context.Context, clientIP string) context.Context {
+	ip := net.ParseIP(clientIP)
+	return client.WithClient(ctx, ip, r.ecsSubnetFor(ip))
+}
@@ -0,0 +1,133 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"doh-autoproxy/internal/client"
+
+	"github.com/miekg/dns"
+)
+
+// queryInfo collects what routing learned about a query beyond the answer
+// itself: the DNSSEC status and the reason for a blocked, stale or failed
+// answer, reported to the client as an extended DNS error (RFC 8914).
+type queryInfo struct {
+	dnssec string
+	ede    *dns.EDNS0_EDE
+}
+
+type queryInfoKey struct{}
+
+// withQueryInfo gives ctx a fresh queryInfo, filled in while routing and read
+// back by Route for the response and the query log.
+func withQueryInfo(ctx context.Context) (context.Context, *queryInfo) {
+	info := new(queryInfo)
+	return context.WithValue(ctx, queryInfoKey{}, info), info
+}
+
+func setDNSSECStatus(ctx context.Context, status string) {
+	if info, ok := ctx.Value(queryInfoKey{}).(*queryInfo); ok {
+		info.dnssec = status
+	}
+}
+
+func setExtendedError(ctx context.Context, code uint16, text string) {
+	if info, ok := ctx.Value(queryInfoKey{}).(*queryInfo); ok {
+		info.ede = &dns.EDNS0_EDE{InfoCode: code, ExtraText: text}
+	}
+}
+
+// FailureResponse builds the SERVFAIL a listener sends when Route fails,
+// carrying an extended DNS error derived from err for EDNS clients.
+func FailureResponse(req *dns.Msg, err error) *dns.Msg {
+	resp := servfailResponse(req)
+	if ede := extendedErrorFor(err); ede != nil {
+		attachExtendedError(req, resp, ede)
+	}
+	return resp
+}
+
+func servfailResponse(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	resp.RecursionAvailable = true
+	return resp
+}
+
+// extendedErrorFor maps a routing error to an extended DNS error: timeouts
+// and groups without usable upstreams mean no upstream could be reached,
+// anything else is a failed exchange.
+func extendedErrorFor(err error) *dns.EDNS0_EDE {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, client.ErrNoUpstream):
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "没有可用的上游"}
+	case errors.Is(err, client.ErrRaceTimeout), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "上游查询超时"}
+	default:
+		return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNetworkError, ExtraText: "上游查询失败"}
+	}
+}
+
+// attachExtendedError adds ede to resp. Options need an OPT record, so
+// clients that did not send EDNS get the response unchanged.
+func attachExtendedError(req, resp *dns.Msg, ede *dns.EDNS0_EDE) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+	respOpt := resp.IsEdns0()
+	if respOpt == nil {
+		resp.SetEdns0(1232, opt.Do())
+		respOpt = resp.IsEdns0()
+	}
+	for _, o := range respOpt.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok && e.InfoCode == ede.InfoCode {
+			return
+		}
+	}
+	respOpt.Option = append(respOpt.Option, ede)
+}
+
+// extendedErrorOf returns the first extended DNS error in resp, which may
+// also come from the upstream that answered.
+func extendedErrorOf(resp *dns.Msg) *dns.EDNS0_EDE {
+	if resp == nil {
+		return nil
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_EDE); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func edeCode(ede *dns.EDNS0_EDE) *uint16 {
+	if ede == nil {
+		return nil
+	}
+	code := ede.InfoCode
+	return &code
+}
+
+func edeText(ede *dns.EDNS0_EDE) string {
+	if ede == nil {
+		return ""
+	}
+	if name, ok := dns.ExtendedErrorCodeToString[ede.InfoCode]; ok {
+		if ede.ExtraText != "" {
+			return name + ": " + ede.ExtraText
+		}
+		return name
+	}
+	return ede.ExtraText
+}
@@ -49,11 +49,7 @@ func VerifyGeoSite(path string) error {
 }
 
 func (g *GeoDataManager) IsCNIP(ip net.IP) bool {
-	if g == nil || g.geoip == nil {
-		return false
-	}
-	codes := g.geoip.LookupCode(ip)
-	for _, code := range codes {
+	for _, code := range g.LookupCodes(ip) {
 		if strings.ToUpper(code) == "CN" {
 			return true
 		}
@@ -61,15 +57,33 @@ func (g *GeoDataManager) IsCNIP(ip net.IP) bool {
 	return false
 }
 
-func (g *GeoDataManager) LookupGeoSite(domain string) string {
-	if g == nil || g.geosite == nil {
+// LookupCodes returns every GeoIP code and category containing ip.
+func (g *GeoDataManager) LookupCodes(ip net.IP) []string {
+	if g == nil || g.geoip == nil {
+		return nil
+	}
+	return g.geoip.LookupCode(ip)
+}
+
+// LookupGeoSite returns the first of the given categories, in order, that
+// contains domain.
+func (g *GeoDataManager) LookupGeoSite(domain string, categories []string) string {
+	if g == nil || g.geosite == nil || len(categories) == 0 {
 		return ""
 	}
 
 	codes := g.geosite.LookupCodes(domain)
+	if len(codes) == 0 {
+		return ""
+	}
+
+	matched := make(map[string]struct{}, len(codes))
 	for _, code := range codes {
-		if strings.ToLower(code) == "cn" {
-			return "cn"
+		matched[strings.ToLower(code)] = struct{}{}
+	}
+	for _, category := range categories {
+		if _, ok := matched[category]; ok {
+			return category
 		}
 	}
 
@@ -0,0 +1,134 @@
+package router
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	geoIPModeAny      = "any"
+	geoIPModeMajority = "majority"
+	geoIPModeAll      = "all"
+	geoIPModeFirst    = "first"
+)
+
+// geoIPPolicy decides whether an answer points at domestic addresses. A nil
+// policy behaves like the defaults: any address with GeoIP code "cn".
+type geoIPPolicy struct {
+	mode    string
+	codes   map[string]bool
+	nets    []*net.IPNet
+	trustCN bool
+	cnGrace time.Duration
+}
+
+func newGeoIPPolicy(cfg config.GeoIPPolicyConfig) *geoIPPolicy {
+	p := &geoIPPolicy{
+		mode:    strings.ToLower(strings.TrimSpace(cfg.Mode)),
+		codes:   make(map[string]bool),
+		trustCN: cfg.TrustCN,
+	}
+	if cfg.TrustCN && cfg.CNGraceMs > 0 {
+		p.cnGrace = time.Duration(cfg.CNGraceMs) * time.Millisecond
+	}
+
+	switch p.mode {
+	case geoIPModeAny, geoIPModeMajority, geoIPModeAll, geoIPModeFirst:
+	case "":
+		p.mode = geoIPModeAny
+	default:
+		log.Printf("无效的 GeoIP 判定方式: %s，将使用 %s", cfg.Mode, geoIPModeAny)
+		p.mode = geoIPModeAny
+	}
+
+	for _, code := range cfg.Codes {
+		if code = strings.ToLower(strings.TrimSpace(code)); code != "" {
+			p.codes[code] = true
+		}
+	}
+	if len(p.codes) == 0 {
+		p.codes[config.GroupCN] = true
+	}
+
+	for _, cidr := range cfg.CIDRs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			log.Printf("忽略无效的 GeoIP 地址段: %s (%v)", cidr, err)
+			continue
+		}
+		p.nets = append(p.nets, ipNet)
+	}
+
+	return p
+}
+
+func (p *geoIPPolicy) matchIP(geo *GeoDataManager, ip net.IP) bool {
+	for _, ipNet := range p.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	for _, code := range geo.LookupCodes(ip) {
+		if p.codes[strings.ToLower(code)] {
+			return true
+		}
+	}
+	return false
+}
+
+// domestic reports whether resp points at domestic addresses; ok is false
+// when the answer carries no A/AAAA record to judge by.
+func (p *geoIPPolicy) domestic(geo *GeoDataManager, resp *dns.Msg) (domestic, ok bool) {
+	if p == nil {
+		p = newGeoIPPolicy(config.GeoIPPolicyConfig{})
+	}
+
+	var total, matched int
+	for _, ans := range resp.Answer {
+		var ip net.IP
+		switch rr := ans.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		total++
+		hit := p.matchIP(geo, ip)
+		if hit {
+			matched++
+		}
+		if p.mode == geoIPModeFirst {
+			return hit, true
+		}
+	}
+
+	if total == 0 {
+		return false, false
+	}
+	switch p.mode {
+	case geoIPModeMajority:
+		return matched*2 > total, true
+	case geoIPModeAll:
+		return matched == total, true
+	default:
+		return matched > 0, true
+	}
+}
+
+// canJudge reports whether there is any data to geolocate addresses with.
+func (p *geoIPPolicy) canJudge(geo *GeoDataManager) bool {
+	return (geo != nil && geo.geoip != nil) || (p != nil && len(p.nets) > 0)
+}
+
+func (p *geoIPPolicy) preferCN() bool {
+	return p != nil && p.trustCN
+}
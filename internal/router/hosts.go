@@ -0,0 +1,307 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/domaintrie"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultHostsTTL = 60
+	// hostsOwner 仅用于解析记录数据，应答时替换为实际查询名
+	hostsOwner = "hosts.invalid."
+	// maxHostsCNAMEChain 限制 hosts 内 CNAME 链的跟随深度，防止循环
+	maxHostsCNAMEChain = 8
+)
+
+// hostEntry holds every record configured for one hosts.txt key. Address
+// records are kept apart so they can be rotated round-robin per query.
+type hostEntry struct {
+	v4      []hostAddr
+	v6      []hostAddr
+	records []dns.RR
+
+	next atomic.Uint32
+}
+
+type hostAddr struct {
+	ip  net.IP
+	ttl uint32
+}
+
+// hostsTable compiles Config.Hosts. Values are either a bare IP address or a
+// typed record such as "CNAME backend.lan." / "MX 10 mail.lan.", optionally
+// preceded by a TTL.
+type hostsTable struct {
+	ttl         uint32
+	nodataHTTPS bool
+
+	matcher *domainMatcher
+	entries map[string]*hostEntry
+	// reverse 由精确 hosts 地址自动生成的反向解析，key 为 in-addr.arpa/ip6.arpa 名
+	reverse map[string][]string
+}
+
+func newHostsTable(hosts map[string][]string, opts config.HostsConfig) *hostsTable {
+	t := &hostsTable{
+		ttl:         opts.TTL,
+		nodataHTTPS: opts.NoDataHTTPS,
+		entries:     make(map[string]*hostEntry, len(hosts)),
+		reverse:     make(map[string][]string),
+	}
+	if t.ttl == 0 {
+		t.ttl = defaultHostsTTL
+	}
+
+	keys := make(map[string]string, len(hosts))
+	for key, values := range hosts {
+		key = strings.ToLower(strings.TrimSpace(key))
+		entry := t.entries[key]
+		if entry == nil {
+			entry = &hostEntry{}
+		}
+
+		for _, value := range values {
+			addr, rr, err := parseHostValue(value, t.ttl)
+			if err != nil {
+				log.Printf("忽略无效的 hosts 记录: %s %s (%v)", key, value, err)
+				continue
+			}
+			switch {
+			case addr.ip != nil && addr.ip.To4() != nil:
+				addr.ip = addr.ip.To4()
+				entry.v4 = append(entry.v4, addr)
+			case addr.ip != nil:
+				entry.v6 = append(entry.v6, addr)
+			default:
+				entry.records = append(entry.records, rr)
+			}
+		}
+
+		if len(entry.v4) == 0 && len(entry.v6) == 0 && len(entry.records) == 0 {
+			continue
+		}
+		t.entries[key] = entry
+		keys[key] = key
+
+		if name, ok := exactHostName(key); ok {
+			for _, addr := range append(append([]hostAddr{}, entry.v4...), entry.v6...) {
+				rev, err := dns.ReverseAddr(addr.ip.String())
+				if err != nil {
+					continue
+				}
+				rev = strings.TrimSuffix(rev, ".")
+				t.reverse[rev] = appendUnique(t.reverse[rev], name)
+			}
+		}
+	}
+
+	t.matcher = newDomainMatcher(keys, domaintrie.MatchExact)
+	return t
+}
+
+// parseHostValue parses "[ttl] IP" or "[ttl] TYPE rdata"; ttl defaults to
+// the table-wide TTL.
+func parseHostValue(value string, ttl uint32) (hostAddr, dns.RR, error) {
+	value = strings.TrimSpace(value)
+	if fields := strings.Fields(value); len(fields) > 1 {
+		if n, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+			ttl = uint32(n)
+			value = strings.TrimSpace(value[len(fields[0]):])
+		}
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		return hostAddr{ip: ip, ttl: ttl}, nil, nil
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s", hostsOwner, ttl, value))
+	if err != nil {
+		return hostAddr{}, nil, err
+	}
+	if rr == nil {
+		return hostAddr{}, nil, fmt.Errorf("空记录")
+	}
+
+	switch v := rr.(type) {
+	case *dns.A:
+		return hostAddr{ip: v.A, ttl: ttl}, nil, nil
+	case *dns.AAAA:
+		return hostAddr{ip: v.AAAA, ttl: ttl}, nil, nil
+	}
+	return hostAddr{}, rr, nil
+}
+
+// exactHostName reports the plain owner name for keys that match a single
+// name, which are the only ones reverse PTR records can be synthesized for.
+func exactHostName(key string) (string, bool) {
+	key = strings.TrimPrefix(key, prefixFull)
+	if strings.Contains(key, ":") || strings.HasPrefix(key, prefixWild) {
+		return "", false
+	}
+	return key, key != ""
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+func (t *hostsTable) lookup(name string) (*hostEntry, bool) {
+	if t == nil {
+		return nil, false
+	}
+	key, ok := t.matcher.lookup(name)
+	if !ok {
+		return nil, false
+	}
+	entry, ok := t.entries[key]
+	return entry, ok
+}
+
+// answer synthesizes a response from hosts. It returns false when hosts has
+// nothing for the question, so the query continues through routing.
+//
+// Names whose addresses are overridden are answered authoritatively: asking
+// for the family hosts does not define (and, with nodata_https, HTTPS/SVCB)
+// yields NODATA instead of leaking the name to an upstream.
+func (t *hostsTable) answer(req *dns.Msg) (*dns.Msg, bool) {
+	if t == nil || len(req.Question) == 0 {
+		return nil, false
+	}
+
+	q := req.Question[0]
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+
+	var answers []dns.RR
+	entry, ok := t.lookup(name)
+	if ok {
+		answers = t.records(entry, q.Name, q.Qtype, 0)
+	} else if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+		for _, target := range t.reverse[name] {
+			answers = append(answers, &dns.PTR{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: t.ttl},
+				Ptr: dns.Fqdn(target),
+			})
+		}
+	}
+
+	if len(answers) == 0 {
+		if !ok || !t.nodata(entry, q.Qtype) {
+			return nil, false
+		}
+		return t.nodataResponse(req), true
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Answer = answers
+	return m, true
+}
+
+func (t *hostsTable) nodata(entry *hostEntry, qtype uint16) bool {
+	if len(entry.v4) == 0 && len(entry.v6) == 0 {
+		return false
+	}
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return true
+	case dns.TypeHTTPS, dns.TypeSVCB:
+		return t.nodataHTTPS
+	}
+	return false
+}
+
+// nodataResponse carries a synthetic SOA so clients can negative-cache the
+// answer for the hosts TTL (RFC 2308).
+func (t *hostsTable) nodataResponse(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Ns = []dns.RR{&dns.SOA{
+		Hdr:     dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: t.ttl},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster.localhost.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  t.ttl,
+	}}
+	return m
+}
+
+func (t *hostsTable) records(entry *hostEntry, owner string, qtype uint16, depth int) []dns.RR {
+	var answers []dns.RR
+
+	if qtype == dns.TypeA || qtype == dns.TypeANY {
+		for _, addr := range rotate(entry.v4, &entry.next) {
+			answers = append(answers, &dns.A{
+				Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: addr.ttl},
+				A:   addr.ip,
+			})
+		}
+	}
+	if qtype == dns.TypeAAAA || qtype == dns.TypeANY {
+		for _, addr := range rotate(entry.v6, &entry.next) {
+			answers = append(answers, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: owner, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: addr.ttl},
+				AAAA: addr.ip,
+			})
+		}
+	}
+	for _, rr := range entry.records {
+		if qtype == dns.TypeANY || rr.Header().Rrtype == qtype {
+			answers = append(answers, withOwner(rr, owner))
+		}
+	}
+
+	if len(answers) > 0 || qtype == dns.TypeCNAME || depth >= maxHostsCNAMEChain {
+		return answers
+	}
+
+	// 无对应类型记录时，CNAME 作为别名返回，并在 hosts 内继续跟随目标
+	for _, rr := range entry.records {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		answers = append(answers, withOwner(rr, owner))
+		target := strings.ToLower(strings.TrimSuffix(cname.Target, "."))
+		if next, ok := t.lookup(target); ok {
+			answers = append(answers, t.records(next, cname.Target, qtype, depth+1)...)
+		}
+		break
+	}
+	return answers
+}
+
+func withOwner(rr dns.RR, owner string) dns.RR {
+	cp := dns.Copy(rr)
+	cp.Header().Name = owner
+	return cp
+}
+
+// rotate returns ips starting at the next round-robin offset.
+func rotate(ips []hostAddr, next *atomic.Uint32) []hostAddr {
+	if len(ips) <= 1 {
+		return ips
+	}
+	// 先在 uint32 上取模，计数器越过 2^31 时在 32 位平台上也不会变成负数
+	offset := int((next.Add(1) - 1) % uint32(len(ips)))
+	rotated := make([]hostAddr, 0, len(ips))
+	rotated = append(rotated, ips[offset:]...)
+	return append(rotated, ips[:offset]...)
+}
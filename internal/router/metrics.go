@@ -0,0 +1,53 @@
+package router
+
+import (
+	"doh-autoproxy/internal/client"
+	"doh-autoproxy/internal/metrics"
+)
+
+// WriteMetrics emits the upstream, response cache and bootstrap cache metrics.
+func (r *Router) WriteMetrics(w *metrics.Writer) {
+	bounds := client.LatencyBounds()
+	w.Header("doh_upstream_latency_seconds", "histogram", "Latency of answered upstream queries.")
+	for _, s := range r.upstreamStats {
+		counts, sum := s.Series().Cumulative()
+		w.Histogram("doh_upstream_latency_seconds", bounds, counts, sum.Seconds(),
+			"group", s.Group, "protocol", s.Protocol, "address", s.Address)
+	}
+	w.Header("doh_upstream_up", "gauge", "Whether the upstream circuit breaker is closed (1) or open (0).")
+	for _, s := range r.upstreamStats {
+		up := 0.0
+		if s.Available() {
+			up = 1
+		}
+		w.Value("doh_upstream_up", up, "group", s.Group, "protocol", s.Protocol, "address", s.Address)
+	}
+
+	if r.cache != nil {
+		stats := r.cache.Stats()
+		w.Header("doh_cache_hits_total", "counter", "Response cache hits.")
+		w.Value("doh_cache_hits_total", float64(stats["hits"].(int64)))
+		w.Header("doh_cache_misses_total", "counter", "Response cache misses.")
+		w.Value("doh_cache_misses_total", float64(stats["misses"].(int64)))
+		w.Header("doh_cache_stale_hits_total", "counter", "Expired response cache entries served stale.")
+		w.Value("doh_cache_stale_hits_total", float64(stats["stale_hits"].(int64)))
+		w.Header("doh_cache_evictions_total", "counter", "Response cache evictions.")
+		w.Value("doh_cache_evictions_total", float64(stats["evictions"].(int64)))
+		w.Header("doh_cache_hit_ratio", "gauge", "Share of response cache lookups that were hits.")
+		w.Value("doh_cache_hit_ratio", stats["hit_ratio"].(float64))
+		w.Header("doh_cache_entries", "gauge", "Entries in the response cache.")
+		w.Value("doh_cache_entries", float64(stats["size"].(int)))
+	}
+
+	if r.bootstrapper != nil {
+		stats := r.bootstrapper.Stats()
+		w.Header("doh_bootstrap_cache_hits_total", "counter", "Upstream host lookups answered from the bootstrap cache.")
+		w.Value("doh_bootstrap_cache_hits_total", float64(stats.Hits))
+		w.Header("doh_bootstrap_cache_misses_total", "counter", "Upstream host lookups sent to the bootstrap servers.")
+		w.Value("doh_bootstrap_cache_misses_total", float64(stats.Misses))
+		w.Header("doh_bootstrap_lookup_failures_total", "counter", "Upstream host lookups that failed.")
+		w.Value("doh_bootstrap_lookup_failures_total", float64(stats.Failures))
+		w.Header("doh_bootstrap_cache_entries", "gauge", "Hosts in the bootstrap cache.")
+		w.Value("doh_bootstrap_cache_entries", float64(stats.Size))
+	}
+}
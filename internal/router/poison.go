@@ -0,0 +1,120 @@
+package router
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// poisonFilter recognises tampered upstream answers: addresses on the
+// bogus-nxdomain list (ISP hijack pages, fake IPs) and, when verifyCN is set,
+// CN answers for non-CN domains that do not geolocate to CN.
+type poisonFilter struct {
+	bogus    []*net.IPNet
+	verifyCN bool
+}
+
+func newPoisonFilter(cfg config.AntiPoisonConfig, dir string) *poisonFilter {
+	f := &poisonFilter{verifyCN: cfg.VerifyCNAnswer}
+
+	entries := append([]string(nil), cfg.BogusNXDomain...)
+	if cfg.BogusNXDomainFile != "" {
+		path := cfg.BogusNXDomainFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		fileEntries, err := readBogusFile(path)
+		if err != nil {
+			log.Printf("加载 bogus-nxdomain 列表失败: %s (%v)", path, err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+
+	for _, entry := range entries {
+		ipNet, ok := parseIPOrCIDR(entry)
+		if !ok {
+			log.Printf("忽略无效的 bogus-nxdomain 地址: %s", entry)
+			continue
+		}
+		f.bogus = append(f.bogus, ipNet)
+	}
+
+	return f
+}
+
+func readBogusFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		// 兼容 dnsmasq 的 bogus-nxdomain=1.2.3.4 写法
+		line = strings.TrimPrefix(strings.TrimSpace(line), "bogus-nxdomain=")
+		if line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func parseIPOrCIDR(s string) (*net.IPNet, bool) {
+	s = strings.TrimSpace(s)
+	if _, ipNet, err := net.ParseCIDR(s); err == nil {
+		return ipNet, true
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, true
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, true
+}
+
+// isBogus reports whether resp contains an address from the bogus list.
+func (f *poisonFilter) isBogus(resp *dns.Msg) bool {
+	if f == nil || resp == nil || len(f.bogus) == 0 {
+		return false
+	}
+	for _, ans := range resp.Answer {
+		var ip net.IP
+		switch rr := ans.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		for _, ipNet := range f.bogus {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bogusResponse replaces an answer carrying a bogus address with NXDOMAIN,
+// as dnsmasq's bogus-nxdomain does.
+func bogusResponse(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeNameError)
+	return m
+}
@@ -0,0 +1,32 @@
+package router
+
+import (
+	"doh-autoproxy/internal/edns"
+
+	"github.com/miekg/dns"
+)
+
+// forwardableRequest drops the EDNS options a query should not carry to
+// upstreams. Padding only covers the hop from the client and is always
+// removed; with strip, cookies, NSID and every other option go too, except
+// ECS, which the upstream ECS policies handle. req is copied before changes.
+func forwardableRequest(req *dns.Msg, strip bool) *dns.Msg {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return req
+	}
+	keep := func(code uint16) bool {
+		if code == dns.EDNS0PADDING {
+			return false
+		}
+		return !strip || code == dns.EDNS0SUBNET
+	}
+	for _, o := range opt.Option {
+		if !keep(o.Option()) {
+			req = req.Copy()
+			edns.Strip(req.IsEdns0(), keep)
+			return req
+		}
+	}
+	return req
+}
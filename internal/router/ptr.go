@@ -0,0 +1,64 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+
+	"doh-autoproxy/internal/domaintrie"
+
+	"github.com/miekg/dns"
+)
+
+// privateReverseZones covers the reverse trees of locally-served address
+// space (RFC 1918, RFC 6598, RFC 6761/6303 special-use, ULA and link-local).
+var privateReverseZones = buildPrivateReverseZones()
+
+func buildPrivateReverseZones() *domaintrie.Trie {
+	zones := []string{
+		"0.in-addr.arpa",
+		"10.in-addr.arpa",
+		"127.in-addr.arpa",
+		"254.169.in-addr.arpa",
+		"168.192.in-addr.arpa",
+		"2.0.192.in-addr.arpa",
+		"100.51.198.in-addr.arpa",
+		"113.0.203.in-addr.arpa",
+		"255.255.255.255.in-addr.arpa",
+		"c.f.ip6.arpa",
+		"d.f.ip6.arpa",
+		"8.e.f.ip6.arpa",
+		"9.e.f.ip6.arpa",
+		"a.e.f.ip6.arpa",
+		"b.e.f.ip6.arpa",
+		"8.b.d.0.1.0.0.2.ip6.arpa",
+		// ::1 与 ::
+		strings.Repeat("0.", 31) + "1.ip6.arpa",
+		strings.Repeat("0.", 32) + "ip6.arpa",
+	}
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa", i))
+	}
+	for i := 64; i <= 127; i++ {
+		zones = append(zones, fmt.Sprintf("%d.100.in-addr.arpa", i))
+	}
+
+	t := domaintrie.New()
+	for _, zone := range zones {
+		t.Insert(zone, domaintrie.MatchDomain, zone)
+	}
+	return t
+}
+
+// privateReverseZone returns the locally-served reverse zone containing name.
+func privateReverseZone(name string) (string, bool) {
+	return privateReverseZones.Lookup(strings.ToLower(strings.TrimSuffix(name, ".")))
+}
+
+// privatePTRResponse answers names in private reverse zones that no local
+// resolver handles: they must never reach public resolvers (RFC 6761 6.1).
+func privatePTRResponse(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeNameError)
+	m.Authoritative = true
+	return m
+}
@@ -0,0 +1,82 @@
+package router
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	targetReject         = "reject"
+	targetRejectNXDomain = "reject-nxdomain"
+	targetRejectNoData   = "reject-nodata"
+	targetRejectRefused  = "reject-refused"
+	targetRejectSinkhole = "reject-sinkhole"
+
+	rejectTTL = 60
+)
+
+// isRejectTarget reports whether a rule target blocks the query instead of
+// naming an upstream group.
+func isRejectTarget(target string) bool {
+	switch strings.ToLower(target) {
+	case targetReject, targetRejectNXDomain, targetRejectNoData, targetRejectRefused, targetRejectSinkhole:
+		return true
+	}
+	return false
+}
+
+// rejectResponse builds the blocking answer for target. "reject" is an alias
+// of "reject-nxdomain"; the sinkhole answers A/AAAA with 0.0.0.0/:: and
+// every other type with NODATA.
+func rejectResponse(req *dns.Msg, target string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	switch strings.ToLower(target) {
+	case targetRejectNoData:
+	case targetRejectRefused:
+		m.Rcode = dns.RcodeRefused
+	case targetRejectSinkhole:
+		q := req.Question[0]
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: rejectTTL}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero.To4()})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	default:
+		m.Rcode = dns.RcodeNameError
+	}
+
+	return m
+}
+
+// reject answers a blocked query and records why as the extended DNS error:
+// Blocked for the operator's own rules, Filtered for subscribed blocklists.
+// The rule itself only goes to the query log, never to the client.
+func reject(ctx context.Context, req *dns.Msg, source, target string, code uint16) (*dns.Msg, string, error) {
+	text := "被规则拦截"
+	if code == dns.ExtendedErrorCodeFiltered {
+		text = "被拦截列表过滤"
+	}
+	setExtendedError(ctx, code, text)
+	return rejectResponse(req, target), rejectLabel(source, target), nil
+}
+
+// rejectLabel records why a query was blocked, e.g. "Block(GeoSite:category-ads-all/NXDOMAIN)".
+func rejectLabel(source, target string) string {
+	action := "NXDOMAIN"
+	switch strings.ToLower(target) {
+	case targetRejectNoData:
+		action = "NODATA"
+	case targetRejectRefused:
+		action = "REFUSED"
+	case targetRejectSinkhole:
+		action = "Sinkhole"
+	}
+	return "Block(" + source + "/" + action + ")"
+}
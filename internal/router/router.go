@@ -4,15 +4,24 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"doh-autoproxy/internal/blocklist"
+	"doh-autoproxy/internal/cache"
 	"doh-autoproxy/internal/client"
 	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/dnssec"
+	"doh-autoproxy/internal/domaintrie"
+	"doh-autoproxy/internal/learned"
+	"doh-autoproxy/internal/metrics"
 	"doh-autoproxy/internal/querylog"
 	"doh-autoproxy/internal/resolver"
+	"doh-autoproxy/internal/zone"
 
 	"github.com/miekg/dns"
 )
@@ -22,27 +31,90 @@ type RegexRule struct {
 	Target  string
 }
 
+// GeoSiteRule routes every domain of a GeoSite category to Target.
+type GeoSiteRule struct {
+	Category string
+	Target   string
+}
+
+type listenerKey struct{}
+
+// WithListener tags ctx with the protocol of the listener that received the
+// query (udp, tcp, dot, doh, doq); it labels the query metrics.
+func WithListener(ctx context.Context, proto string) context.Context {
+	return context.WithValue(ctx, listenerKey{}, proto)
+}
+
+func listenerFrom(ctx context.Context) string {
+	proto, _ := ctx.Value(listenerKey{}).(string)
+	return proto
+}
+
+type resolveFunc func(ctx context.Context, req *dns.Msg) (*dns.Msg, string, error)
+
 type Router struct {
-	config          *config.Config
-	geo             *GeoDataManager
-	logger          *querylog.QueryLogger
-	cnClients       []client.DNSClient
-	overseasClients []client.DNSClient
+	config *config.Config
+	geo    *GeoDataManager
+	logger *querylog.QueryLogger
+	cache  *cache.Cache
+
+	blocklist *blocklist.Manager
+	zones     *zone.Set
+	decisions *learned.Store
+	metrics   *metrics.Collector
+	dnssec    *dnssec.Validator
+
+	// ecsOverrides 按客户端地址指定 client/static ECS 模式发送的子网
+	ecsOverrides []ecsOverride
+
+	bootstrapper  *resolver.Bootstrapper
+	groups        map[string][]client.DNSClient
+	upstreamStats []*client.StatsClient
+	health        *client.HealthChecker
 
-	cnStats       []*client.StatsClient
-	overseasStats []*client.StatsClient
+	// geoSiteRules 按优先级排列，域名同属多个分类时取第一个命中的规则
+	geoSiteRules      []GeoSiteRule
+	geoSiteCategories []string
 
 	regexRules []RegexRule
+
+	// 规则与 hosts 的后缀树在首次查询时按 config 构建
+	matchersOnce sync.Once
+	ruleMatcher  *domainMatcher
+	hosts        *hostsTable
+	geoPolicy    *geoIPPolicy
+	poison       *poisonFilter
+
+	closed atomic.Bool
 }
 
-func NewRouter(cfg *config.Config, geoManager *GeoDataManager, logger *querylog.QueryLogger) *Router {
+func NewRouter(cfg *config.Config, geoManager *GeoDataManager, logger *querylog.QueryLogger, respCache *cache.Cache, blocklists *blocklist.Manager, decisions *learned.Store, series *client.SeriesStore, collector *metrics.Collector) *Router {
 	r := &Router{
-		config: cfg,
-		geo:    geoManager,
-		logger: logger,
+		config:    cfg,
+		geo:       geoManager,
+		logger:    logger,
+		cache:     respCache,
+		blocklist: blocklists,
+		zones:     zone.New(cfg.LocalZones, cfg.ConfigDir),
+		decisions: decisions,
+		metrics:   collector,
 	}
 
+	if action := blocklists.Action(); action != "" && !isRejectTarget(action) {
+		log.Printf("无效的拦截列表动作: %s，将使用 %s", action, targetReject)
+	}
+
+	geoSiteTargets := make(map[string]string)
 	for domain, target := range cfg.Rules {
+		if strings.HasPrefix(domain, "geosite:") {
+			category := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(domain, "geosite:")))
+			if category == "" {
+				log.Printf("忽略无效的 GeoSite 规则: %s", domain)
+				continue
+			}
+			geoSiteTargets[category] = strings.ToLower(target)
+			continue
+		}
 		if strings.HasPrefix(domain, "regexp:") {
 			pattern := strings.TrimPrefix(domain, "regexp:")
 			re, err := regexp.Compile(pattern)
@@ -56,41 +128,153 @@ func NewRouter(cfg *config.Config, geoManager *GeoDataManager, logger *querylog.
 			})
 		}
 	}
+	// 多条正则同时命中时按表达式字典序取第一条，避免 map 遍历顺序带来的随机性
+	sort.Slice(r.regexRules, func(i, j int) bool {
+		return r.regexRules[i].Pattern.String() < r.regexRules[j].Pattern.String()
+	})
+	r.buildMatchers()
 
 	bootstrapper := resolver.NewBootstrapper(cfg.BootstrapDNS)
+	r.bootstrapper = bootstrapper
+
+	r.groups = make(map[string][]client.DNSClient)
+	for _, name := range cfg.Upstreams.GroupNames() {
+		r.groups[name] = nil
+
+		label := config.GroupLabel(name)
+		var members []*client.StatsClient
+		var weights []int
+		for _, upstreamCfg := range cfg.Upstreams[name] {
+			upstreamCfg.Padding = cfg.Privacy.Padding
+			c, err := client.NewDNSClient(upstreamCfg, bootstrapper)
+			if err != nil {
+				log.Printf("Failed to initialize %s upstream %s: %v", label, upstreamCfg.Address, err)
+				continue
+			}
+			sc := client.NewStatsClient(c, upstreamCfg.Address, upstreamCfg.Protocol, label)
+			series.Attach(sc)
+			members = append(members, sc)
+			weights = append(weights, upstreamCfg.Weight)
+			r.groups[name] = append(r.groups[name], sc)
+			r.upstreamStats = append(r.upstreamStats, sc)
+		}
 
-	for _, upstreamCfg := range cfg.Upstreams.CN {
-		c, err := client.NewDNSClient(upstreamCfg, bootstrapper)
-		if err != nil {
-			log.Printf("Failed to initialize CN upstream %s: %v", upstreamCfg.Address, err)
-			continue
+		// 非竞速策略由 Group 统一调度，分组内只剩这一个客户端
+		if policy, ok := cfg.UpstreamPolicy[name]; ok && len(members) > 0 {
+			if group := client.NewGroup(policy, members, weights); group.Strategy() != config.StrategyRace {
+				r.groups[name] = []client.DNSClient{group}
+			}
 		}
-		sc := client.NewStatsClient(c, upstreamCfg.Address, upstreamCfg.Protocol, "CN")
-		r.cnClients = append(r.cnClients, sc)
-		r.cnStats = append(r.cnStats, sc)
 	}
 
-	for _, upstreamCfg := range cfg.Upstreams.Overseas {
+	// rule.txt 中直接写上游地址的条件转发，每个地址建一个临时分组，以地址为名
+	var forwardTargets []string
+	for _, target := range cfg.Rules {
+		if strings.Contains(target, "://") {
+			forwardTargets = append(forwardTargets, target)
+		}
+	}
+	if target := cfg.PrivatePTR.Upstream; strings.Contains(target, "://") {
+		forwardTargets = append(forwardTargets, target)
+	}
+	sort.Strings(forwardTargets)
+	for _, target := range forwardTargets {
+		upstreamCfg, ok := config.ParseUpstreamURL(target)
+		name := strings.ToLower(target)
+		if _, exists := r.groups[name]; !ok || exists {
+			continue
+		}
+		upstreamCfg.Padding = cfg.Privacy.Padding
 		c, err := client.NewDNSClient(upstreamCfg, bootstrapper)
 		if err != nil {
-			log.Printf("Failed to initialize Overseas upstream %s: %v", upstreamCfg.Address, err)
+			log.Printf("Failed to initialize forwarding upstream %s: %v", target, err)
 			continue
 		}
-		sc := client.NewStatsClient(c, upstreamCfg.Address, upstreamCfg.Protocol, "Overseas")
-		r.overseasClients = append(r.overseasClients, sc)
-		r.overseasStats = append(r.overseasStats, sc)
+		sc := client.NewStatsClient(c, upstreamCfg.Address, upstreamCfg.Protocol, target)
+		series.Attach(sc)
+		r.groups[name] = []client.DNSClient{sc}
+		r.upstreamStats = append(r.upstreamStats, sc)
+	}
+
+	// 已从配置中移除的上游不再保留统计
+	series.Retain(r.upstreamStats)
+
+	r.health = client.NewHealthChecker(cfg.HealthCheck, r.upstreamStats)
+	r.health.Start()
+
+	r.geoSiteRules = buildGeoSiteRules(geoSiteTargets, cfg.Upstreams.GroupNames(), cfg.GeoData.GeoSitePriority)
+	for _, rule := range r.geoSiteRules {
+		r.geoSiteCategories = append(r.geoSiteCategories, rule.Category)
+	}
+
+	for domain, target := range cfg.Rules {
+		if _, ok := r.groups[strings.ToLower(target)]; !ok && !isRejectTarget(target) {
+			log.Printf("规则 %s 指向未定义的上游分组: %s", domain, target)
+		}
+	}
+
+	if upstream := strings.ToLower(cfg.PrivatePTR.Upstream); upstream != "" && len(r.groups[upstream]) == 0 {
+		log.Printf("私有地址反向解析的上游不可用: %s，将返回 NXDOMAIN", cfg.PrivatePTR.Upstream)
 	}
 
+	r.dnssec = newValidator(cfg, r.groups)
+	r.ecsOverrides = buildECSOverrides(cfg.ECS)
+
 	return r
 }
 
 func (r *Router) GetUpstreamStats() []interface{} {
 	var stats []interface{}
-	for _, s := range r.cnStats {
+	for _, s := range r.upstreamStats {
 		stats = append(stats, s.GetStats())
 	}
-	for _, s := range r.overseasStats {
-		stats = append(stats, s.GetStats())
+	return stats
+}
+
+// GetUpstreamSeries returns the per-minute history of every upstream.
+func (r *Router) GetUpstreamSeries() []interface{} {
+	now := time.Now()
+	var series []interface{}
+	for _, s := range r.upstreamStats {
+		series = append(series, map[string]interface{}{
+			"address":  s.Address,
+			"protocol": s.Protocol,
+			"group":    s.Group,
+			"points":   s.Series().Points(now),
+		})
+	}
+	return series
+}
+
+// GetGroupStats aggregates upstream counters per group.
+func (r *Router) GetGroupStats() []interface{} {
+	var stats []interface{}
+	for _, name := range r.config.Upstreams.GroupNames() {
+		var upstreams int
+		var queries, errs int64
+		label := config.GroupLabel(name)
+		for _, s := range r.upstreamStats {
+			if s.Group != label {
+				continue
+			}
+			st := s.GetStats()
+			upstreams++
+			queries += st["total_queries"].(int64)
+			errs += st["total_errors"].(int64)
+		}
+		strategy := config.StrategyRace
+		if clients := r.groups[name]; len(clients) == 1 {
+			if group, ok := clients[0].(*client.Group); ok {
+				strategy = group.Strategy()
+			}
+		}
+		stats = append(stats, map[string]interface{}{
+			"group":         label,
+			"strategy":      strategy,
+			"upstreams":     upstreams,
+			"total_queries": queries,
+			"total_errors":  errs,
+		})
 	}
 	return stats
 }
@@ -99,14 +283,11 @@ func (r *Router) Close() error {
 	if r == nil {
 		return nil
 	}
+	r.closed.Store(true)
+	r.health.Stop()
 
 	var firstErr error
-	for _, s := range r.cnStats {
-		if err := s.Close(); err != nil && firstErr == nil {
-			firstErr = err
-		}
-	}
-	for _, s := range r.overseasStats {
+	for _, s := range r.upstreamStats {
 		if err := s.Close(); err != nil && firstErr == nil {
 			firstErr = err
 		}
@@ -122,12 +303,27 @@ func (r *Router) Route(ctx context.Context, req *dns.Msg, clientIP string) (*dns
 	}
 
 	downstreamECS := client.ExtractECS(req)
+	req = forwardableRequest(req, r.config.Privacy.StripClientOptions)
+	ctx, info := withQueryInfo(r.withClient(ctx, clientIP))
 	resp, upstream, err := r.routeInternal(ctx, req)
-	if err == nil && resp != nil {
+	ede := info.ede
+	if err != nil {
+		ede = extendedErrorFor(err)
+	} else if resp != nil {
 		resp, upstream = r.normalizeServiceBindingNegativeResponse(ctx, req, resp, upstream)
+		if r.dnssec != nil {
+			shapeDNSSECResponse(req, resp)
+		}
+		echoClientECS(req, resp)
+		if ede != nil {
+			attachExtendedError(req, resp, ede)
+		} else {
+			ede = extendedErrorOf(resp)
+		}
 	}
 
-	duration := time.Since(start).Milliseconds()
+	elapsed := time.Since(start)
+	duration := elapsed.Milliseconds()
 
 	qName := req.Question[0].Name
 	qType := dns.Type(req.Question[0].Qtype).String()
@@ -178,8 +374,12 @@ func (r *Router) Route(ctx context.Context, req *dns.Msg, clientIP string) (*dns
 			AnswerRecords: answerRecords,
 			DurationMs:    duration,
 			Status:        status,
+			DNSSEC:        info.dnssec,
+			EDE:           edeCode(ede),
+			EDEText:       edeText(ede),
 		})
 	}
+	r.metrics.ObserveQuery(listenerFrom(ctx), upstream, status, elapsed)
 
 	if resp != nil && resp.Rcode == dns.RcodeNameError {
 		for _, ans := range resp.Answer {
@@ -205,9 +405,17 @@ func isServiceBindingQuestion(req *dns.Msg) bool {
 	return qType == dns.TypeHTTPS || qType == dns.TypeSVCB
 }
 
-func newExistenceCheckRequest(req *dns.Msg, qName string) *dns.Msg {
+func newExistenceCheckRequest(req *dns.Msg, qName string, minimal bool) *dns.Msg {
 	checkReq := new(dns.Msg)
 	checkReq.SetQuestion(dns.Fqdn(qName), dns.TypeA)
+	if minimal {
+		// 与 QNAME 最小化解析器的探测一致（RFC 9156）：独立的 ID、A 类型、不沿用客户端的 CD 与 DO
+		checkReq.RecursionDesired = true
+		if req.IsEdns0() != nil {
+			checkReq.SetEdns0(1232, false)
+		}
+		return checkReq
+	}
 	checkReq.Id = req.Id
 	checkReq.RecursionDesired = req.RecursionDesired
 	checkReq.CheckingDisabled = req.CheckingDisabled
@@ -222,6 +430,8 @@ func newExistenceCheckRequest(req *dns.Msg, qName string) *dns.Msg {
 func synthesizeNoDataResponse(req *dns.Msg, resp *dns.Msg) *dns.Msg {
 	normalized := resp.Copy()
 	normalized.Rcode = dns.RcodeSuccess
+	// 合成的 NODATA 没有否定证明，不能再声称已验证
+	normalized.AuthenticatedData = false
 	normalized.Answer = nil
 	normalized.Ns = nil
 	normalized.Extra = nil
@@ -245,8 +455,15 @@ func (r *Router) normalizeServiceBindingNegativeResponse(ctx context.Context, re
 	}
 
 	originName := candidates[len(candidates)-1]
-	checkReq := newExistenceCheckRequest(req, originName)
-	checkResp, _, err := r.routeInternal(ctx, checkReq)
+	minimal := r.config.Privacy.MinimalExistenceCheck
+	checkReq := newExistenceCheckRequest(req, originName, minimal)
+	if minimal {
+		// 探测与客户端无关，不按客户端子网发送 ECS
+		ctx = client.WithClient(ctx, nil, nil)
+	}
+	// 探测查询的验证状态不应覆盖原查询的记录
+	checkCtx, _ := withQueryInfo(ctx)
+	checkResp, _, err := r.routeInternal(checkCtx, checkReq)
 	if err != nil || checkResp == nil || checkResp.Rcode != dns.RcodeSuccess {
 		return resp, upstream
 	}
@@ -288,162 +505,411 @@ func matchNames(qName string) []string {
 	return names
 }
 
+func (r *Router) buildMatchers() {
+	r.matchersOnce.Do(func() {
+		r.ruleMatcher = newDomainMatcher(r.config.Rules, domaintrie.MatchDomain)
+		r.hosts = newHostsTable(r.config.Hosts, r.config.HostsOptions)
+		r.geoPolicy = newGeoIPPolicy(r.config.GeoData.GeoIPPolicy)
+		r.poison = newPoisonFilter(r.config.AntiPoison, r.config.ConfigDir)
+	})
+}
+
 func (r *Router) lookupRule(names []string) (string, bool) {
+	r.buildMatchers()
 	for _, name := range names {
-		if rule, ok := r.config.Rules[name]; ok {
+		if rule, ok := r.ruleMatcher.lookup(name); ok {
 			return rule, true
 		}
 	}
 	return "", false
 }
 
-func (r *Router) lookupRegexRule(names []string) (string, bool) {
+func (r *Router) lookupRegexRule(names []string) (RegexRule, bool) {
 	for _, name := range names {
 		for _, rr := range r.regexRules {
 			if rr.Pattern.MatchString(name) {
-				return rr.Target, true
+				return rr, true
 			}
 		}
 	}
+	return RegexRule{}, false
+}
+
+// buildGeoSiteRules orders GeoSite rules deterministically: categories listed
+// in priority come first, then explicit geosite: rules from rule.txt in lexical
+// order, then the implicit mapping of a category to the group of the same name.
+func buildGeoSiteRules(explicit map[string]string, groups []string, priority []string) []GeoSiteRule {
+	targets := make(map[string]string, len(explicit)+len(groups))
+	var explicitCats, implicitCats []string
+	for category, target := range explicit {
+		targets[category] = target
+		explicitCats = append(explicitCats, category)
+	}
+	for _, name := range groups {
+		if name == config.GroupOverseas {
+			continue
+		}
+		if _, ok := targets[name]; ok {
+			continue
+		}
+		targets[name] = name
+		implicitCats = append(implicitCats, name)
+	}
+	sort.Strings(explicitCats)
+	sort.Strings(implicitCats)
+
+	var rules []GeoSiteRule
+	seen := make(map[string]bool, len(targets))
+	add := func(category string) {
+		target, ok := targets[category]
+		if !ok || seen[category] {
+			return
+		}
+		seen[category] = true
+		rules = append(rules, GeoSiteRule{Category: category, Target: target})
+	}
+	for _, category := range priority {
+		add(strings.ToLower(strings.TrimSpace(category)))
+	}
+	for _, category := range explicitCats {
+		add(category)
+	}
+	for _, category := range implicitCats {
+		add(category)
+	}
+	return rules
+}
+
+func (r *Router) lookupBlocklist(names []string) (string, bool) {
+	for _, name := range names {
+		if list, ok := r.blocklist.Match(name); ok {
+			return list, true
+		}
+	}
 	return "", false
 }
 
-func (r *Router) lookupGeoSite(names []string) string {
+func (r *Router) lookupGeoSite(names []string) (GeoSiteRule, bool) {
 	for _, name := range names {
-		if geoSiteRule := r.geo.LookupGeoSite(name); geoSiteRule != "" {
-			return geoSiteRule
+		category := r.geo.LookupGeoSite(name, r.geoSiteCategories)
+		if category == "" {
+			continue
+		}
+		for _, rule := range r.geoSiteRules {
+			if rule.Category == category {
+				return rule, true
+			}
 		}
 	}
-	return ""
+	return GeoSiteRule{}, false
 }
 
-func hostOverrideResponse(req *dns.Msg, ip net.IP) (*dns.Msg, bool) {
-	if ip == nil || len(req.Question) == 0 {
-		return nil, false
+func (r *Router) routeInternal(ctx context.Context, req *dns.Msg) (*dns.Msg, string, error) {
+	qName := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	matchCandidates := matchNames(qName)
+
+	r.buildMatchers()
+	if resp, ok := r.hosts.answer(req); ok {
+		return resp, "Hosts", nil
 	}
 
-	qType := req.Question[0].Qtype
-	isIPv4 := ip.To4() != nil
-	if qType != dns.TypeANY &&
-		((qType == dns.TypeA && !isIPv4) ||
-			(qType == dns.TypeAAAA && isIPv4) ||
-			(qType != dns.TypeA && qType != dns.TypeAAAA)) {
-		return nil, false
+	// 本地权威区域内的名字一律本地应答，不会发往任何上游
+	if resp, origin, ok := r.zones.Answer(req); ok {
+		return resp, "Zone(" + origin + ")", nil
 	}
 
-	m := new(dns.Msg)
-	m.SetReply(req)
-	rrHeader := dns.RR_Header{
-		Name:  req.Question[0].Name,
-		Class: dns.ClassINET,
-		Ttl:   60,
+	if rule, ok := r.lookupRule(matchCandidates); ok {
+		rule = strings.ToLower(rule)
+		if isRejectTarget(rule) {
+			return reject(ctx, req, "Rule", rule, dns.ExtendedErrorCodeBlocked)
+		}
+		if clients, ok := r.groups[rule]; ok {
+			return r.resolveGroup(ctx, req, clients, "Rule("+config.GroupLabel(rule)+")")
+		}
 	}
-	if isIPv4 {
-		rrHeader.Rrtype = dns.TypeA
-		m.Answer = append(m.Answer, &dns.A{Hdr: rrHeader, A: ip.To4()})
-	} else {
-		rrHeader.Rrtype = dns.TypeAAAA
-		m.Answer = append(m.Answer, &dns.AAAA{Hdr: rrHeader, AAAA: ip})
+
+	if regexRule, ok := r.lookupRegexRule(matchCandidates); ok {
+		target := strings.ToLower(regexRule.Target)
+		if isRejectTarget(target) {
+			return reject(ctx, req, "Regex:"+regexRule.Pattern.String(), target, dns.ExtendedErrorCodeBlocked)
+		}
+		if clients, ok := r.groups[target]; ok {
+			return r.resolveGroup(ctx, req, clients, "Rule(Regex/"+config.GroupLabel(target)+")")
+		}
 	}
 
-	return m, true
-}
+	if _, ok := privateReverseZone(qName); ok && r.config.PrivatePTR.Enabled {
+		upstream := strings.ToLower(r.config.PrivatePTR.Upstream)
+		if clients, ok := r.groups[upstream]; ok && len(clients) > 0 {
+			return r.resolveGroup(ctx, req, clients, "PrivatePTR("+config.GroupLabel(upstream)+")")
+		}
+		return privatePTRResponse(req), "PrivatePTR(NXDOMAIN)", nil
+	}
 
-func (r *Router) routeInternal(ctx context.Context, req *dns.Msg) (*dns.Msg, string, error) {
-	qName := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
-	matchCandidates := matchNames(qName)
+	if name, ok := r.lookupBlocklist(matchCandidates); ok {
+		action := r.blocklist.Action()
+		if !isRejectTarget(action) {
+			action = targetReject
+		}
+		return reject(ctx, req, "Blocklist:"+name, action, dns.ExtendedErrorCodeFiltered)
+	}
 
-	if ipStr, ok := r.config.Hosts[qName]; ok {
-		ip := net.ParseIP(ipStr)
-		if ip == nil {
-			return nil, "Hosts", fmt.Errorf("自定义Hosts中存在无效IP地址: %s for %s", ipStr, qName)
+	if rule, ok := r.lookupGeoSite(matchCandidates); ok {
+		if isRejectTarget(rule.Target) {
+			return reject(ctx, req, "GeoSite:"+rule.Category, rule.Target, dns.ExtendedErrorCodeBlocked)
+		}
+		if clients, ok := r.groups[rule.Target]; ok {
+			label := config.GroupLabel(rule.Target)
+			if rule.Category != rule.Target {
+				label = rule.Category + "/" + label
+			}
+			return r.resolveGroup(ctx, req, clients, "GeoSite("+label+")")
 		}
+	}
 
-		if resp, ok := hostOverrideResponse(req, ip); ok {
-			return resp, "Hosts", nil
+	// 此前由 GeoIP 判定过的注册域名直接走学习到的分组，跳过双路查询
+	origin := matchCandidates[len(matchCandidates)-1]
+	if target, ok := r.decisions.Lookup(origin); ok {
+		if clients, ok := r.groups[target]; ok {
+			return r.resolveGroup(ctx, req, clients, "Learned("+config.GroupLabel(target)+")")
 		}
 	}
 
-	if rule, ok := r.lookupRule(matchCandidates); ok {
-		switch strings.ToLower(rule) {
-		case "cn":
-			resp, err := client.RaceResolve(ctx, req, r.cnClients)
-			return resp, "Rule(CN)", err
-		case "overseas":
-			resp, err := client.RaceResolve(ctx, req, r.overseasClients)
-			return resp, "Rule(Overseas)", err
-		default:
+	resp, upstream, err := r.resolveCached(ctx, req, "GeoIP", r.resolveDual)
+	if err == nil {
+		r.learnDecision(origin, resp, upstream)
+	}
+	return resp, upstream, err
+}
+
+// resolveCached serves req from the response cache when possible and stores
+// fresh upstream answers under the given routing decision. When upstreams
+// fail, an expired answer still inside the serve-stale window is returned
+// instead of an error (RFC 8767).
+func (r *Router) resolveCached(ctx context.Context, req *dns.Msg, route string, resolve resolveFunc) (*dns.Msg, string, error) {
+	key := r.cache.Match(cache.NewKey(req, route), client.ClientAddr(ctx, req))
+	if resp, upstream, ok := r.cache.Get(key); ok {
+		if r.cache.ShouldPrefetch(key) {
+			ip, subnet := client.ClientFrom(ctx)
+			go r.prefetch(client.WithClient(context.Background(), ip, subnet), key, req.Copy(), resolve)
 		}
+		setDNSSECStatus(ctx, r.cachedDNSSECStatus(req, resp))
+		return reuseCachedResponse(req, resp), upstream + "/Cache", nil
 	}
 
-	if regexRule, ok := r.lookupRegexRule(matchCandidates); ok {
-		switch strings.ToLower(regexRule) {
-		case "cn":
-			resp, err := client.RaceResolve(ctx, req, r.cnClients)
-			return resp, "Rule(Regex/CN)", err
-		case "overseas":
-			resp, err := client.RaceResolve(ctx, req, r.overseasClients)
-			return resp, "Rule(Regex/Overseas)", err
+	resp, upstream, status, err := r.resolveValidated(ctx, req, resolve)
+	if err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure {
+		if stale, staleUpstream, ok := r.cache.GetStale(key); ok {
+			log.Printf("上游解析失败，返回过期缓存: %s (%v)", req.Question[0].Name, err)
+			setDNSSECStatus(ctx, r.cachedDNSSECStatus(req, stale))
+			if stale.Rcode == dns.RcodeNameError {
+				setExtendedError(ctx, dns.ExtendedErrorCodeStaleNXDOMAINAnswer, "上游不可用，返回过期缓存")
+			} else {
+				setExtendedError(ctx, dns.ExtendedErrorCodeStaleAnswer, "上游不可用，返回过期缓存")
+			}
+			return reuseCachedResponse(req, stale), staleUpstream + "/Stale", nil
 		}
+		setDNSSECStatus(ctx, status)
+		return resp, upstream, err
 	}
+	setDNSSECStatus(ctx, status)
+	// CD 客户端拿到的未验证数据不进缓存
+	if status == dnssec.StatusBogus || status == dnssec.StatusIndeterminate {
+		return resp, upstream, nil
+	}
+
+	r.cache.Set(key, resp, upstream)
+	return resp, upstream, nil
+}
+
+// prefetch refreshes a popular cache entry in the background so clients keep
+// hitting the cache instead of waiting on upstreams when it expires.
+func (r *Router) prefetch(ctx context.Context, key cache.Key, req *dns.Msg, resolve resolveFunc) {
+	defer r.cache.PrefetchDone(key)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
-	if geoSiteRule := r.lookupGeoSite(matchCandidates); geoSiteRule != "" {
-		switch strings.ToLower(geoSiteRule) {
-		case "cn":
-			resp, err := client.RaceResolve(ctx, req, r.cnClients)
-			return resp, "GeoSite(CN)", err
-		default:
-			resp, err := client.RaceResolve(ctx, req, r.overseasClients)
-			return resp, "GeoSite(Overseas)", err
+	resp, upstream, status, err := r.resolveValidated(ctx, req, resolve)
+	if err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure || r.closed.Load() {
+		return
+	}
+	if status == dnssec.StatusBogus || status == dnssec.StatusIndeterminate {
+		return
+	}
+	r.cache.Set(key, resp, upstream)
+}
+
+func reuseCachedResponse(req, resp *dns.Msg) *dns.Msg {
+	resp.Id = req.Id
+	resp.Question = append([]dns.Question(nil), req.Question...)
+	return resp
+}
+
+func (r *Router) resolveGroup(ctx context.Context, req *dns.Msg, clients []client.DNSClient, route string) (*dns.Msg, string, error) {
+	r.buildMatchers()
+	return r.resolveCached(ctx, req, route, func(ctx context.Context, req *dns.Msg) (*dns.Msg, string, error) {
+		raceCtx, win := client.WithWinner(ctx)
+		resp, err := client.RaceResolve(raceCtx, req, clients)
+		if err == nil && r.poison.isBogus(resp) {
+			setExtendedError(ctx, dns.ExtendedErrorCodeForgedAnswer, "应答包含 bogus-nxdomain 地址")
+			return bogusResponse(req), route + "/Bogus", nil
+		}
+		win.Credit()
+		return resp, route, err
+	})
+}
+
+// learnDecision remembers a definite GeoIP classification. Fallbacks and
+// answers without addresses say nothing about where the domain is served
+// from, so they are not learned.
+func (r *Router) learnDecision(name string, resp *dns.Msg, upstream string) {
+	var target string
+	switch upstream {
+	case "GeoIP(CN)":
+		target = config.GroupCN
+	case "GeoIP(Overseas)":
+		target = config.GroupOverseas
+	default:
+		return
+	}
+	if resp == nil || resp.Rcode != dns.RcodeSuccess {
+		return
+	}
+	for _, ans := range resp.Answer {
+		if t := ans.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			r.decisions.Learn(name, target)
+			return
 		}
 	}
+}
+
+type dualResult struct {
+	resp   *dns.Msg
+	err    error
+	source string
+	// win 为该路应答来自的上游，只有被采用的一路计入胜出次数
+	win *client.Winner
+
+	// ok 表示成功应答；domestic 为按 GeoIP 策略判定的结果
+	ok       bool
+	domestic bool
+}
+
+// resolveDual queries the CN and overseas groups concurrently and returns as
+// soon as the outcome is known, cancelling the query still in flight: an
+// overseas answer pointing abroad settles it unless trust_cn is set, in which
+// case a domestic CN answer settles it, and an overseas answer only after the
+// cn_grace_ms window.
+func (r *Router) resolveDual(ctx context.Context, req *dns.Msg) (*dns.Msg, string, error) {
+	qName := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	r.buildMatchers()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	// GeoSite 未命中：同时查询国内和海外 DNS，根据结果判断
-	type dualResult struct {
-		resp   *dns.Msg
-		err    error
-		source string
+	dualCh := make(chan *dualResult, 2)
+	for _, source := range []string{config.GroupOverseas, config.GroupCN} {
+		go func(source string) {
+			raceCtx, win := client.WithWinner(ctx)
+			resp, err := client.RaceResolve(raceCtx, req.Copy(), r.groups[source])
+			dualCh <- &dualResult{resp: resp, err: err, source: source, win: win}
+		}(source)
 	}
 
-	dualCh := make(chan dualResult, 2)
+	var overseasResult, cnResult *dualResult
+	var grace <-chan time.Time
+	for overseasResult == nil || cnResult == nil {
+		select {
+		case res := <-dualCh:
+			r.screenDualResult(req, qName, res)
+			if res.source == config.GroupOverseas {
+				overseasResult = res
+			} else {
+				cnResult = res
+			}
+		case <-grace:
+			// 宽限期内国内结果仍未返回，采用海外结果
+			overseasResult.win.Credit()
+			return overseasResult.resp, "GeoIP(Overseas)", nil
+		}
 
-	go func() {
-		resp, err := client.RaceResolve(ctx, req.Copy(), r.overseasClients)
-		dualCh <- dualResult{resp: resp, err: err, source: "overseas"}
-	}()
-	go func() {
-		resp, err := client.RaceResolve(ctx, req.Copy(), r.cnClients)
-		dualCh <- dualResult{resp: resp, err: err, source: "cn"}
-	}()
+		if resp, upstream, ok := r.decideDualEarly(overseasResult, cnResult); ok {
+			creditDual(resp, overseasResult, cnResult)
+			return resp, upstream, nil
+		}
+		if grace == nil && cnResult == nil && r.geoPolicy.cnGrace > 0 && overseasResult.ok && !overseasResult.domestic {
+			timer := time.NewTimer(r.geoPolicy.cnGrace)
+			defer timer.Stop()
+			grace = timer.C
+		}
+	}
 
-	var overseasResult, cnResult *dualResult
-	for i := 0; i < 2; i++ {
-		r := <-dualCh
-		rCopy := r
-		if r.source == "overseas" {
-			overseasResult = &rCopy
-		} else {
-			cnResult = &rCopy
+	resp, upstream, err := r.decideDual(qName, overseasResult, cnResult)
+	creditDual(resp, overseasResult, cnResult)
+	return resp, upstream, err
+}
+
+// creditDual counts a win for the side whose answer was chosen.
+func creditDual(resp *dns.Msg, results ...*dualResult) {
+	if resp == nil {
+		return
+	}
+	for _, res := range results {
+		if res != nil && res.resp == resp {
+			res.win.Credit()
 		}
 	}
+}
 
-	// 海外成功且有应答
-	if overseasResult.err == nil && overseasResult.resp != nil && overseasResult.resp.Rcode == dns.RcodeSuccess {
-		var resolvedIP net.IP
-		for _, ans := range overseasResult.resp.Answer {
-			if a, ok := ans.(*dns.A); ok {
-				resolvedIP = a.A
-				break
-			}
-			if aaaa, ok := ans.(*dns.AAAA); ok {
-				resolvedIP = aaaa.AAAA
-				break
-			}
+// screenDualResult applies the anti-poisoning checks and the GeoIP policy to
+// one side of the dual query as soon as it arrives.
+func (r *Router) screenDualResult(req *dns.Msg, qName string, res *dualResult) {
+	// 命中 bogus-nxdomain 列表的应答按 NXDOMAIN 处理
+	if res.err == nil && r.poison.isBogus(res.resp) {
+		log.Printf("%s DNS 应答包含 bogus-nxdomain 地址，按 NXDOMAIN 处理: %s", res.source, qName)
+		res.resp = bogusResponse(req)
+		res.win = nil
+	}
+
+	res.ok = res.err == nil && res.resp != nil && res.resp.Rcode == dns.RcodeSuccess
+	if !res.ok {
+		return
+	}
+	domestic, judged := r.geoPolicy.domestic(r.geo, res.resp)
+	res.domestic = domestic
+
+	// 走到双路查询的域名不属于国内 GeoSite，若国内 DNS 给出境外地址，多半是被劫持的应答
+	if res.source == config.GroupCN && judged && !domestic && r.poison.verifyCN && r.geoPolicy.canJudge(r.geo) {
+		log.Printf("国内DNS应答未指向国内地址，疑似被污染，已丢弃: %s", qName)
+		res.resp = nil
+		res.err = fmt.Errorf("国内DNS应答疑似被污染")
+		res.ok = false
+	}
+}
+
+// decideDualEarly reports a final answer before both sides have arrived.
+func (r *Router) decideDualEarly(overseasResult, cnResult *dualResult) (*dns.Msg, string, bool) {
+	// trust_cn：国内应答指向国内地址时直接采用，不再参考海外结果
+	if r.geoPolicy.preferCN() && cnResult != nil && cnResult.ok && cnResult.domestic {
+		return cnResult.resp, "GeoIP(CN)", true
+	}
+	// 海外应答指向境外地址时国内结果已无关紧要；trust_cn 下则需等待国内结果或宽限期
+	if overseasResult != nil && overseasResult.ok && !overseasResult.domestic {
+		if !r.geoPolicy.preferCN() || cnResult != nil {
+			return overseasResult.resp, "GeoIP(Overseas)", true
 		}
+	}
+	return nil, "", false
+}
 
+func (r *Router) decideDual(qName string, overseasResult, cnResult *dualResult) (*dns.Msg, string, error) {
+	// 海外成功且有应答
+	if overseasResult.ok {
 		// 如果解析出的 IP 是国内的，用国内 DNS 的结果（更准确）
-		if resolvedIP != nil && r.geo.IsCNIP(resolvedIP) {
-			if cnResult.err == nil && cnResult.resp != nil && cnResult.resp.Rcode == dns.RcodeSuccess {
+		if overseasResult.domestic {
+			if cnResult.ok {
 				return cnResult.resp, "GeoIP(CN)", nil
 			}
 			// 国内 DNS 失败，仍然返回海外结果
@@ -454,7 +920,7 @@ func (r *Router) routeInternal(ctx context.Context, req *dns.Msg) (*dns.Msg, str
 	}
 
 	// 海外失败或 NXDOMAIN/SERVFAIL，尝试用国内结果
-	if cnResult.err == nil && cnResult.resp != nil && cnResult.resp.Rcode == dns.RcodeSuccess {
+	if cnResult.ok {
 		log.Printf("海外DNS解析失败或无结果，使用国内DNS结果: %s", qName)
 		return cnResult.resp, "GeoIP(Fallback/CN)", nil
 	}
@@ -2,12 +2,25 @@ package router
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"doh-autoproxy/internal/cache"
 	"doh-autoproxy/internal/client"
 	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/dnssec"
+	"doh-autoproxy/internal/domaintrie"
+	"doh-autoproxy/internal/learned"
+	"doh-autoproxy/internal/zone"
 
 	"github.com/miekg/dns"
 )
@@ -84,10 +97,12 @@ func TestRouteInternalMatchesRuleForHTTPSServiceName(t *testing.T) {
 			Rules: map[string]string{
 				"xxjsbigdata.scbdc.edu.cn": "overseas",
 			},
-			Hosts: map[string]string{},
+			Hosts: map[string][]string{},
 		},
-		overseasClients: []client.DNSClient{
-			fakeDNSClient{resp: overseasResp},
+		groups: map[string][]client.DNSClient{
+			config.GroupOverseas: {
+				fakeDNSClient{resp: overseasResp},
+			},
 		},
 	}
 
@@ -113,7 +128,7 @@ func TestRouteInternalMatchesRegexForServiceNameAlias(t *testing.T) {
 	r := &Router{
 		config: &config.Config{
 			Rules: map[string]string{},
-			Hosts: map[string]string{},
+			Hosts: map[string][]string{},
 		},
 		regexRules: []RegexRule{
 			{
@@ -121,8 +136,10 @@ func TestRouteInternalMatchesRegexForServiceNameAlias(t *testing.T) {
 				Target:  "cn",
 			},
 		},
-		cnClients: []client.DNSClient{
-			fakeDNSClient{resp: cnResp},
+		groups: map[string][]client.DNSClient{
+			config.GroupCN: {
+				fakeDNSClient{resp: cnResp},
+			},
 		},
 	}
 
@@ -138,11 +155,48 @@ func TestRouteInternalMatchesRegexForServiceNameAlias(t *testing.T) {
 	}
 }
 
+func TestRouteInternalRoutesRuleToCustomGroup(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("corp.example.", dns.TypeA)
+
+	corpResp := new(dns.Msg)
+	corpResp.SetReply(req)
+
+	r := &Router{
+		config: &config.Config{
+			Rules: map[string]string{
+				"corp.example": "corp",
+			},
+			Hosts: map[string][]string{},
+		},
+		groups: map[string][]client.DNSClient{
+			config.GroupOverseas: {
+				fakeDNSClient{err: errors.New("should not be queried")},
+			},
+			"corp": {
+				fakeDNSClient{resp: corpResp},
+			},
+		},
+	}
+
+	resp, upstream, err := r.routeInternal(context.Background(), req)
+	if err != nil {
+		t.Fatalf("routeInternal returned error: %v", err)
+	}
+	if upstream != "Rule(corp)" {
+		t.Fatalf("expected Rule(corp), got %q", upstream)
+	}
+	if resp == nil || resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected successful response, got %#v", resp)
+	}
+}
+
 func TestHostOverrideOnlyAppliesToAddressQueries(t *testing.T) {
 	req := new(dns.Msg)
 	req.SetQuestion("example.com.", dns.TypeHTTPS)
 
-	resp, ok := hostOverrideResponse(req, net.ParseIP("1.2.3.4"))
+	hosts := newHostsTable(map[string][]string{"example.com": {"1.2.3.4"}}, config.HostsConfig{})
+	resp, ok := hosts.answer(req)
 	if ok {
 		t.Fatalf("expected HTTPS query not to be answered by hosts override, got %#v", resp)
 	}
@@ -160,12 +214,14 @@ func TestRouteConvertsServiceBindingNXDOMAINToNoDataWhenOriginExists(t *testing.
 			Rules: map[string]string{
 				"broadcast.chat.bilibili.com": "cn",
 			},
-			Hosts: map[string]string{
-				"broadcast.chat.bilibili.com": "1.2.3.4",
+			Hosts: map[string][]string{
+				"broadcast.chat.bilibili.com": {"1.2.3.4"},
 			},
 		},
-		cnClients: []client.DNSClient{
-			fakeDNSClient{resp: nxResp},
+		groups: map[string][]client.DNSClient{
+			config.GroupCN: {
+				fakeDNSClient{resp: nxResp},
+			},
 		},
 	}
 
@@ -199,10 +255,12 @@ func TestRouteKeepsServiceBindingNXDOMAINWhenOriginMissing(t *testing.T) {
 			Rules: map[string]string{
 				"broadcast.chat.bilibili.com": "cn",
 			},
-			Hosts: map[string]string{},
+			Hosts: map[string][]string{},
 		},
-		cnClients: []client.DNSClient{
-			fakeDNSClient{resp: nxResp},
+		groups: map[string][]client.DNSClient{
+			config.GroupCN: {
+				fakeDNSClient{resp: nxResp},
+			},
 		},
 	}
 
@@ -217,3 +275,1077 @@ func TestRouteKeepsServiceBindingNXDOMAINWhenOriginMissing(t *testing.T) {
 		t.Fatalf("expected NXDOMAIN to be preserved, got %d", resp.Rcode)
 	}
 }
+
+type countingDNSClient struct {
+	resp  *dns.Msg
+	calls int
+}
+
+func (c *countingDNSClient) Resolve(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+	c.calls++
+	resp := c.resp.Copy()
+	resp.Id = req.Id
+	return resp, nil
+}
+
+func TestRouteInternalServesRepeatedQueriesFromCache(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("cached.example.com.", dns.TypeA)
+
+	upstreamResp := new(dns.Msg)
+	upstreamResp.SetReply(req)
+	upstreamResp.Answer = append(upstreamResp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "cached.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("1.2.3.4").To4(),
+	})
+	upstream := &countingDNSClient{resp: upstreamResp}
+
+	r := &Router{
+		config: &config.Config{
+			Rules: map[string]string{
+				"cached.example.com": "overseas",
+			},
+			Hosts: map[string][]string{},
+		},
+		cache:  cache.New(config.CacheConfig{Enabled: true}),
+		groups: map[string][]client.DNSClient{config.GroupOverseas: {upstream}},
+	}
+
+	if _, label, err := r.routeInternal(context.Background(), req); err != nil || label != "Rule(Overseas)" {
+		t.Fatalf("unexpected first route result: label=%q err=%v", label, err)
+	}
+
+	second := req.Copy()
+	second.Id = req.Id + 1
+	resp, label, err := r.routeInternal(context.Background(), second)
+	if err != nil {
+		t.Fatalf("routeInternal returned error: %v", err)
+	}
+	if label != "Rule(Overseas)/Cache" {
+		t.Fatalf("expected cached label, got %q", label)
+	}
+	if resp.Id != second.Id {
+		t.Fatalf("expected cached response to carry the new query ID %d, got %d", second.Id, resp.Id)
+	}
+	if upstream.calls != 1 {
+		t.Fatalf("expected a single upstream query, got %d", upstream.calls)
+	}
+}
+
+func TestRouteInternalServesStaleAnswerWhenUpstreamsFail(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("stale.example.com.", dns.TypeA)
+
+	staleResp := new(dns.Msg)
+	staleResp.SetReply(req)
+	staleResp.Answer = append(staleResp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "stale.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+		A:   net.ParseIP("1.2.3.4").To4(),
+	})
+
+	now := time.Now()
+	respCache := cache.New(config.CacheConfig{Enabled: true, MinTTL: 1, ServeStale: true})
+	respCache.SetClock(func() time.Time { return now })
+	respCache.Set(cache.NewKey(req, "Rule(Overseas)"), staleResp, "Rule(Overseas)")
+	now = now.Add(2 * time.Second)
+
+	r := &Router{
+		config: &config.Config{
+			Rules: map[string]string{
+				"stale.example.com": "overseas",
+			},
+			Hosts: map[string][]string{},
+		},
+		cache: respCache,
+		groups: map[string][]client.DNSClient{
+			config.GroupOverseas: {
+				fakeDNSClient{err: errors.New("upstream down")},
+			},
+		},
+	}
+
+	ctx, info := withQueryInfo(context.Background())
+	resp, label, err := r.routeInternal(ctx, req)
+	if err != nil {
+		t.Fatalf("expected stale answer instead of error, got %v", err)
+	}
+	if label != "Rule(Overseas)/Stale" {
+		t.Fatalf("expected stale label, got %q", label)
+	}
+	if info.ede == nil || info.ede.InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Fatalf("expected stale answer EDE, got %v", info.ede)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 30 {
+		t.Fatalf("expected one stale answer with TTL 30, got %v", resp.Answer)
+	}
+}
+
+func TestBuildGeoSiteRulesUsesDeterministicPriority(t *testing.T) {
+	explicit := map[string]string{
+		"google":           "overseas",
+		"category-ads-all": "corp",
+		"apple-cn":         "cn",
+	}
+	groups := []string{config.GroupCN, config.GroupOverseas, "corp", "google"}
+
+	rules := buildGeoSiteRules(explicit, groups, []string{"Google", "missing"})
+
+	expected := []GeoSiteRule{
+		{Category: "google", Target: "overseas"},
+		{Category: "apple-cn", Target: "cn"},
+		{Category: "category-ads-all", Target: "corp"},
+		{Category: "cn", Target: "cn"},
+		{Category: "corp", Target: "corp"},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %v", len(expected), rules)
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Fatalf("expected rules %v, got %v", expected, rules)
+		}
+	}
+}
+
+func TestRouteInternalRejectsBlockedDomains(t *testing.T) {
+	tests := []struct {
+		name   string
+		qType  uint16
+		target string
+		rcode  int
+		answer string
+		label  string
+	}{
+		{name: "default reject", qType: dns.TypeA, target: "reject", rcode: dns.RcodeNameError, label: "Block(Rule/NXDOMAIN)"},
+		{name: "nodata", qType: dns.TypeA, target: "reject-nodata", rcode: dns.RcodeSuccess, label: "Block(Rule/NODATA)"},
+		{name: "refused", qType: dns.TypeAAAA, target: "reject-refused", rcode: dns.RcodeRefused, label: "Block(Rule/REFUSED)"},
+		{name: "sinkhole v4", qType: dns.TypeA, target: "reject-sinkhole", rcode: dns.RcodeSuccess, answer: "0.0.0.0", label: "Block(Rule/Sinkhole)"},
+		{name: "sinkhole v6", qType: dns.TypeAAAA, target: "reject-sinkhole", rcode: dns.RcodeSuccess, answer: "::", label: "Block(Rule/Sinkhole)"},
+		{name: "sinkhole other type", qType: dns.TypeHTTPS, target: "reject-sinkhole", rcode: dns.RcodeSuccess, label: "Block(Rule/Sinkhole)"},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("ads.example.com.", tc.qType)
+
+			r := &Router{
+				config: &config.Config{
+					Rules: map[string]string{
+						"ads.example.com": tc.target,
+					},
+					Hosts: map[string][]string{},
+				},
+				groups: map[string][]client.DNSClient{
+					config.GroupOverseas: {
+						fakeDNSClient{err: errors.New("should not be queried")},
+					},
+				},
+			}
+
+			resp, upstream, err := r.routeInternal(context.Background(), req)
+			if err != nil {
+				t.Fatalf("routeInternal returned error: %v", err)
+			}
+			if upstream != tc.label {
+				t.Fatalf("expected label %q, got %q", tc.label, upstream)
+			}
+			if resp.Rcode != tc.rcode {
+				t.Fatalf("expected rcode %d, got %d", tc.rcode, resp.Rcode)
+			}
+			if tc.answer == "" {
+				if len(resp.Answer) != 0 {
+					t.Fatalf("expected no answers, got %v", resp.Answer)
+				}
+				return
+			}
+			if len(resp.Answer) != 1 {
+				t.Fatalf("expected one sinkhole answer, got %v", resp.Answer)
+			}
+			var got net.IP
+			switch rr := resp.Answer[0].(type) {
+			case *dns.A:
+				got = rr.A
+			case *dns.AAAA:
+				got = rr.AAAA
+			}
+			if !got.Equal(net.ParseIP(tc.answer)) {
+				t.Fatalf("expected sinkhole address %s, got %v", tc.answer, resp.Answer[0])
+			}
+		})
+	}
+}
+
+func TestRouteInternalRejectsByRegexRule(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("ad.tracker.example.", dns.TypeA)
+
+	r := &Router{
+		config: &config.Config{
+			Rules: map[string]string{},
+			Hosts: map[string][]string{},
+		},
+		regexRules: []RegexRule{
+			{
+				Pattern: regexp.MustCompile(`^ad\.`),
+				Target:  "reject-refused",
+			},
+		},
+	}
+
+	ctx, info := withQueryInfo(context.Background())
+	resp, upstream, err := r.routeInternal(ctx, req)
+	if err != nil {
+		t.Fatalf("routeInternal returned error: %v", err)
+	}
+	if upstream != `Block(Regex:^ad\./REFUSED)` {
+		t.Fatalf("unexpected block label %q", upstream)
+	}
+	if resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected REFUSED, got %d", resp.Rcode)
+	}
+	// 规则内容只记入查询日志，不通过扩展错误透露给客户端
+	if info.ede == nil || info.ede.InfoCode != dns.ExtendedErrorCodeBlocked || strings.Contains(info.ede.ExtraText, "ad") {
+		t.Fatalf("expected a fixed Blocked text without the rule, got %+v", info.ede)
+	}
+}
+
+func TestDomainMatcherPrecedence(t *testing.T) {
+	m := newDomainMatcher(map[string]string{
+		"example.com":             "plain",
+		"full:www.example.com":    "full",
+		"domain:api.example.com":  "domain",
+		"*.cdn.example.com":       "wildcard",
+		"keyword:track":           "keyword",
+		"keyword:tracker":         "longer-keyword",
+		"regexp:^ignored$":        "regexp",
+		"geosite:category-ads":    "geosite",
+		"full:tracker.example.io": "full-over-keyword",
+	}, domaintrie.MatchDomain)
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{name: "example.com", value: "plain", ok: true},
+		{name: "a.b.example.com", value: "plain", ok: true},
+		{name: "www.example.com", value: "full", ok: true},
+		{name: "x.www.example.com", value: "plain", ok: true},
+		{name: "v1.api.example.com", value: "domain", ok: true},
+		{name: "cdn.example.com", value: "plain", ok: true},
+		{name: "img.cdn.example.com", value: "wildcard", ok: true},
+		{name: "tracker.example.io", value: "full-over-keyword", ok: true},
+		{name: "ads.tracker.net", value: "longer-keyword", ok: true},
+		{name: "mytrack.net", value: "keyword", ok: true},
+		{name: "ignored", ok: false},
+		{name: "example.org", ok: false},
+	}
+
+	for _, tc := range tests {
+		value, ok := m.lookup(tc.name)
+		if ok != tc.ok || value != tc.value {
+			t.Fatalf("lookup(%q) = %q, %v; want %q, %v", tc.name, value, ok, tc.value, tc.ok)
+		}
+	}
+}
+
+func TestRouteInternalMatchesSuffixRuleAndWildcardHosts(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.corp.example.", dns.TypeA)
+
+	corpResp := new(dns.Msg)
+	corpResp.SetReply(req)
+
+	r := &Router{
+		config: &config.Config{
+			Rules: map[string]string{
+				"corp.example": "corp",
+			},
+			Hosts: map[string][]string{
+				"*.dev.local":    {"10.0.0.1"},
+				"dev.local.test": {"10.0.0.2"},
+			},
+		},
+		groups: map[string][]client.DNSClient{
+			"corp": {
+				fakeDNSClient{resp: corpResp},
+			},
+		},
+	}
+
+	if _, upstream, err := r.routeInternal(context.Background(), req); err != nil || upstream != "Rule(corp)" {
+		t.Fatalf("expected suffix rule to route to corp, got %q (err=%v)", upstream, err)
+	}
+
+	hostReq := new(dns.Msg)
+	hostReq.SetQuestion("api.dev.local.", dns.TypeA)
+	resp, upstream, err := r.routeInternal(context.Background(), hostReq)
+	if err != nil || upstream != "Hosts" {
+		t.Fatalf("expected wildcard hosts match, got %q (err=%v)", upstream, err)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || !a.A.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("unexpected hosts answer %v", resp.Answer)
+	}
+
+	exactReq := new(dns.Msg)
+	exactReq.SetQuestion("www.dev.local.test.", dns.TypeA)
+	if _, upstream, _ := r.routeInternal(context.Background(), exactReq); upstream == "Hosts" {
+		t.Fatal("expected plain hosts entries to stay exact matches")
+	}
+}
+
+func TestHostsMultipleAndTypedRecords(t *testing.T) {
+	hosts := newHostsTable(map[string][]string{
+		"app.lan":    {"10.0.0.1", "10.0.0.2", "fd00::1"},
+		"svc.lan":    {"CNAME app.lan."},
+		"lan":        {"MX 10 mail.lan.", "TXT \"v=spf1 -all\""},
+		"*.wild.lan": {"10.0.0.9"},
+		"broken.lan": {"not a record"},
+	}, config.HostsConfig{})
+
+	query := func(name string, qtype uint16) (*dns.Msg, bool) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		return hosts.answer(req)
+	}
+
+	first, ok := query("app.lan.", dns.TypeA)
+	if !ok || len(first.Answer) != 2 {
+		t.Fatalf("expected two A records, got %v", first)
+	}
+	second, _ := query("app.lan.", dns.TypeA)
+	if first.Answer[0].(*dns.A).A.Equal(second.Answer[0].(*dns.A).A) {
+		t.Fatalf("expected round-robin ordering, got %v then %v", first.Answer, second.Answer)
+	}
+
+	if resp, ok := query("app.lan.", dns.TypeAAAA); !ok || len(resp.Answer) != 1 {
+		t.Fatalf("expected one AAAA record, got %v", resp)
+	}
+
+	resp, ok := query("svc.lan.", dns.TypeA)
+	if !ok || len(resp.Answer) != 3 {
+		t.Fatalf("expected CNAME followed by two A records, got %v", resp)
+	}
+	if cname, ok := resp.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "svc.lan." || cname.Target != "app.lan." {
+		t.Fatalf("unexpected CNAME answer %v", resp.Answer[0])
+	}
+	if resp.Answer[1].Header().Name != "app.lan." {
+		t.Fatalf("expected chased records to be owned by the target, got %v", resp.Answer[1])
+	}
+
+	if resp, ok := query("lan.", dns.TypeMX); !ok || resp.Answer[0].(*dns.MX).Mx != "mail.lan." {
+		t.Fatalf("unexpected MX answer %v", resp)
+	}
+	if resp, ok := query("lan.", dns.TypeTXT); !ok || resp.Answer[0].(*dns.TXT).Txt[0] != "v=spf1 -all" {
+		t.Fatalf("unexpected TXT answer %v", resp)
+	}
+
+	resp, ok = query("2.0.0.10.in-addr.arpa.", dns.TypePTR)
+	if !ok || resp.Answer[0].(*dns.PTR).Ptr != "app.lan." {
+		t.Fatalf("expected synthesized reverse PTR, got %v", resp)
+	}
+	if _, ok := query("9.0.0.10.in-addr.arpa.", dns.TypePTR); ok {
+		t.Fatal("expected no reverse PTR for wildcard entries")
+	}
+	if _, ok := query("broken.lan.", dns.TypeA); ok {
+		t.Fatal("expected invalid hosts records to be ignored")
+	}
+}
+
+func TestRotateSurvivesCounterWraparound(t *testing.T) {
+	ips := []hostAddr{{ip: net.ParseIP("10.0.0.1")}, {ip: net.ParseIP("10.0.0.2")}, {ip: net.ParseIP("10.0.0.3")}}
+	var next atomic.Uint32
+	next.Store(math.MaxUint32 - 1)
+
+	for i, want := range []uint32{math.MaxUint32 - 1, math.MaxUint32, 0} {
+		rotated := rotate(ips, &next)
+		if len(rotated) != len(ips) || !rotated[0].ip.Equal(ips[want%3].ip) {
+			t.Fatalf("query %d: expected rotation starting at %s, got %v", i, ips[want%3].ip, rotated)
+		}
+	}
+}
+
+func TestHostsTTLAndNoData(t *testing.T) {
+	hosts := newHostsTable(map[string][]string{
+		"v4.lan":  {"10.0.0.1", "300 10.0.0.2"},
+		"txt.lan": {"TXT \"only\""},
+	}, config.HostsConfig{TTL: 120, NoDataHTTPS: true})
+
+	query := func(name string, qtype uint16) (*dns.Msg, bool) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		return hosts.answer(req)
+	}
+
+	resp, ok := query("v4.lan.", dns.TypeA)
+	if !ok || len(resp.Answer) != 2 || !resp.Authoritative {
+		t.Fatalf("expected two authoritative A records, got %v", resp)
+	}
+	ttls := map[string]uint32{}
+	for _, rr := range resp.Answer {
+		ttls[rr.(*dns.A).A.String()] = rr.Header().Ttl
+	}
+	if ttls["10.0.0.1"] != 120 || ttls["10.0.0.2"] != 300 {
+		t.Fatalf("unexpected TTLs %v", ttls)
+	}
+
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeHTTPS} {
+		resp, ok := query("v4.lan.", qtype)
+		if !ok || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || !resp.Authoritative {
+			t.Fatalf("expected authoritative NODATA for %s, got %v", dns.TypeToString[qtype], resp)
+		}
+		if soa, ok := resp.Ns[0].(*dns.SOA); !ok || soa.Minttl != 120 {
+			t.Fatalf("expected SOA carrying the hosts TTL, got %v", resp.Ns)
+		}
+	}
+
+	if _, ok := query("txt.lan.", dns.TypeAAAA); ok {
+		t.Fatal("expected names without address overrides to fall through")
+	}
+
+	plain := newHostsTable(map[string][]string{"v4.lan": {"10.0.0.1"}}, config.HostsConfig{})
+	req := new(dns.Msg)
+	req.SetQuestion("v4.lan.", dns.TypeHTTPS)
+	if _, ok := plain.answer(req); ok {
+		t.Fatal("expected HTTPS to fall through unless nodata_https is enabled")
+	}
+}
+
+func TestLocalZoneAnsweredBeforeRules(t *testing.T) {
+	z, err := zone.Parse(strings.NewReader("@ 3600 IN SOA ns hostmaster 1 7200 900 1209600 300\nnas 3600 IN A 192.168.1.10\n"), "home.arpa.", "")
+	if err != nil {
+		t.Fatalf("zone.Parse() error = %v", err)
+	}
+
+	r := &Router{
+		config: &config.Config{
+			Rules: map[string]string{"home.arpa": "overseas"},
+		},
+		zones: zone.NewFromZones(false, z),
+		groups: map[string][]client.DNSClient{
+			config.GroupOverseas: {fakeDNSClient{err: errors.New("must not leave the box")}},
+		},
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("missing.home.arpa.", dns.TypeA)
+	resp, upstream, err := r.routeInternal(context.Background(), req)
+	if err != nil || upstream != "Zone(home.arpa)" {
+		t.Fatalf("expected local zone answer, got %q (err=%v)", upstream, err)
+	}
+	if resp.Rcode != dns.RcodeNameError || !resp.Authoritative {
+		t.Fatalf("expected authoritative NXDOMAIN, got %v", resp)
+	}
+}
+
+func TestConditionalForwardingCreatesAdHocUpstreams(t *testing.T) {
+	r := NewRouter(&config.Config{
+		Rules: map[string]string{
+			"corp.example.com": "udp://10.0.0.53",
+			"lan":              "dot://192.168.1.1",
+			"other.corp":       "udp://10.0.0.53",
+			"bad.example":      "ftp://10.0.0.1",
+		},
+	}, nil, nil, nil, nil, nil, nil, nil)
+	defer r.Close()
+
+	if got := len(r.GetUpstreamStats()); got != 2 {
+		t.Fatalf("expected one shared client per forwarding address, got %d", got)
+	}
+	clients, ok := r.groups["udp://10.0.0.53"]
+	if !ok || len(clients) != 1 {
+		t.Fatalf("expected forwarding group for udp://10.0.0.53, got %v", r.groups)
+	}
+	if sc := clients[0].(*client.StatsClient); sc.Address != "10.0.0.53" || sc.Protocol != "udp" {
+		t.Fatalf("unexpected forwarding client %+v", sc)
+	}
+	if _, ok := r.groups["ftp://10.0.0.1"]; ok {
+		t.Fatal("expected unsupported schemes to be ignored")
+	}
+}
+
+func TestUpstreamPolicyWrapsGroupMembers(t *testing.T) {
+	r := NewRouter(&config.Config{
+		Upstreams: config.UpstreamsConfig{
+			config.GroupCN:       {{Address: "223.5.5.5:53", Protocol: "udp"}, {Address: "119.29.29.29:53", Protocol: "udp"}},
+			config.GroupOverseas: {{Address: "8.8.8.8:53", Protocol: "udp"}, {Address: "1.1.1.1:53", Protocol: "udp", Weight: 3}},
+		},
+		UpstreamPolicy: config.UpstreamPolicies{
+			config.GroupOverseas: {Strategy: config.StrategyWeighted},
+		},
+	}, nil, nil, nil, nil, nil, nil, nil)
+	defer r.Close()
+
+	if got := len(r.groups[config.GroupCN]); got != 2 {
+		t.Fatalf("expected race group to keep its clients, got %d", got)
+	}
+	overseas := r.groups[config.GroupOverseas]
+	if len(overseas) != 1 {
+		t.Fatalf("expected weighted group behind a single client, got %d", len(overseas))
+	}
+	if g, ok := overseas[0].(*client.Group); !ok || g.Strategy() != config.StrategyWeighted {
+		t.Fatalf("unexpected overseas client %T", overseas[0])
+	}
+	if got := len(r.GetUpstreamStats()); got != 4 {
+		t.Fatalf("expected per-upstream stats to stay visible, got %d", got)
+	}
+
+	strategies := map[string]string{}
+	for _, st := range r.GetGroupStats() {
+		m := st.(map[string]interface{})
+		strategies[m["group"].(string)] = m["strategy"].(string)
+	}
+	if strategies["CN"] != config.StrategyRace || strategies["Overseas"] != config.StrategyWeighted {
+		t.Fatalf("unexpected group strategies %v", strategies)
+	}
+}
+
+func TestPrivatePTRStaysLocal(t *testing.T) {
+	for name, want := range map[string]bool{
+		"1.1.168.192.in-addr.arpa.": true,
+		"5.0.16.172.in-addr.arpa.":  true,
+		"5.0.15.172.in-addr.arpa.":  false,
+		"8.8.8.8.in-addr.arpa.":     false,
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.": true,
+	} {
+		if _, got := privateReverseZone(name); got != want {
+			t.Errorf("privateReverseZone(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	localResp := new(dns.Msg)
+	localResp.Answer = []dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: "20.1.168.192.in-addr.arpa.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+		Ptr: "printer.lan.",
+	}}
+	publicErr := fakeDNSClient{err: errors.New("must not reach public upstreams")}
+
+	newRouter := func(upstream string) *Router {
+		return &Router{
+			config: &config.Config{
+				Hosts:      map[string][]string{"nas.lan": {"192.168.1.10"}},
+				PrivatePTR: config.PrivatePTRConfig{Enabled: true, Upstream: upstream},
+			},
+			groups: map[string][]client.DNSClient{
+				config.GroupCN:       {publicErr},
+				config.GroupOverseas: {publicErr},
+				"lan":                {fakeDNSClient{resp: localResp}},
+			},
+		}
+	}
+	query := func(r *Router, name string) (*dns.Msg, string) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypePTR)
+		resp, upstream, err := r.routeInternal(context.Background(), req)
+		if err != nil {
+			t.Fatalf("routeInternal(%s) error = %v", name, err)
+		}
+		return resp, upstream
+	}
+
+	if _, upstream := query(newRouter("lan"), "10.1.168.192.in-addr.arpa."); upstream != "Hosts" {
+		t.Fatalf("expected hosts to answer its own reverse names, got %q", upstream)
+	}
+	if resp, upstream := query(newRouter("lan"), "20.1.168.192.in-addr.arpa."); upstream != "PrivatePTR(lan)" || len(resp.Answer) != 1 {
+		t.Fatalf("expected private PTR forwarded to the local resolver, got %q %v", upstream, resp)
+	}
+	if resp, upstream := query(newRouter(""), "20.1.168.192.in-addr.arpa."); upstream != "PrivatePTR(NXDOMAIN)" || resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN without a local resolver, got %q %v", upstream, resp)
+	}
+}
+
+func addressResponse(name string, ips ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.Response = true
+	for _, ip := range ips {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip).To4(),
+		})
+	}
+	return m
+}
+
+func TestGeoIPPolicyModes(t *testing.T) {
+	mixed := addressResponse("cdn.example.", "10.1.0.1", "192.0.2.1", "10.1.0.2")
+
+	tests := []struct {
+		mode string
+		want bool
+	}{
+		{"", true},
+		{"any", true},
+		{"majority", true},
+		{"all", false},
+		{"first", true},
+	}
+	for _, tt := range tests {
+		p := newGeoIPPolicy(config.GeoIPPolicyConfig{Mode: tt.mode, CIDRs: []string{"10.1.0.0/16"}})
+		if got, ok := p.domestic(nil, mixed); !ok || got != tt.want {
+			t.Errorf("mode %q: domestic = %v (ok=%v), want %v", tt.mode, got, ok, tt.want)
+		}
+	}
+
+	p := newGeoIPPolicy(config.GeoIPPolicyConfig{Mode: "majority", CIDRs: []string{"192.0.2.0/24"}})
+	if got, _ := p.domestic(nil, mixed); got {
+		t.Error("expected minority match to be rejected in majority mode")
+	}
+	if _, ok := p.domestic(nil, addressResponse("empty.example.")); ok {
+		t.Error("expected answers without addresses to be undecided")
+	}
+}
+
+func TestResolveDualTrustsCNAnswerFirst(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("mixed.example.", dns.TypeA)
+
+	newRouter := func(policy config.GeoIPPolicyConfig) *Router {
+		return &Router{
+			config: &config.Config{GeoData: config.GeoDataConfig{GeoIPPolicy: policy}},
+			groups: map[string][]client.DNSClient{
+				config.GroupCN:       {fakeDNSClient{resp: addressResponse("mixed.example.", "10.1.0.1")}},
+				config.GroupOverseas: {fakeDNSClient{resp: addressResponse("mixed.example.", "192.0.2.1")}},
+			},
+		}
+	}
+
+	if _, upstream, _ := newRouter(config.GeoIPPolicyConfig{CIDRs: []string{"10.1.0.0/16"}}).resolveDual(context.Background(), req); upstream != "GeoIP(Overseas)" {
+		t.Fatalf("expected overseas answer to be judged by default, got %q", upstream)
+	}
+	resp, upstream, _ := newRouter(config.GeoIPPolicyConfig{CIDRs: []string{"10.1.0.0/16"}, TrustCN: true}).resolveDual(context.Background(), req)
+	if upstream != "GeoIP(CN)" || resp.Answer[0].(*dns.A).A.String() != "10.1.0.1" {
+		t.Fatalf("expected trusted CN answer, got %q %v", upstream, resp)
+	}
+}
+
+func TestResolveDualCreditsOnlyTheChosenSide(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("mixed.example.", dns.TypeA)
+
+	// 两路都成功应答，海外应答指向国内地址时采用国内结果
+	cn := client.NewStatsClient(fakeDNSClient{resp: addressResponse("mixed.example.", "10.1.0.1")}, "cn", "udp", "CN")
+	overseas := client.NewStatsClient(fakeDNSClient{resp: addressResponse("mixed.example.", "10.1.0.2")}, "overseas", "udp", "Overseas")
+	r := &Router{
+		config: &config.Config{GeoData: config.GeoDataConfig{GeoIPPolicy: config.GeoIPPolicyConfig{CIDRs: []string{"10.1.0.0/16"}}}},
+		groups: map[string][]client.DNSClient{
+			config.GroupCN:       {cn},
+			config.GroupOverseas: {overseas},
+		},
+	}
+
+	if _, upstream, err := r.resolveDual(context.Background(), req); err != nil || upstream != "GeoIP(CN)" {
+		t.Fatalf("expected CN answer, got %q (err=%v)", upstream, err)
+	}
+	if wins := cn.GetStats()["wins"]; wins != int64(1) {
+		t.Fatalf("expected the chosen CN upstream credited once, got %v", wins)
+	}
+	if wins := overseas.GetStats()["wins"]; wins != int64(0) {
+		t.Fatalf("expected the discarded overseas upstream not credited, got %v", wins)
+	}
+}
+
+func TestPoisonedCNAnswersAreDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bogus.txt"), []byte("# ISP hijack pages\nbogus-nxdomain=198.51.100.7\n203.0.113.0/24\n"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("foreign.example.", dns.TypeA)
+	overseasFail := fakeDNSClient{err: errors.New("overseas timeout")}
+
+	newRouter := func(cnIP string, antiPoison config.AntiPoisonConfig) *Router {
+		return &Router{
+			config: &config.Config{
+				ConfigDir:  dir,
+				AntiPoison: antiPoison,
+				GeoData:    config.GeoDataConfig{GeoIPPolicy: config.GeoIPPolicyConfig{CIDRs: []string{"10.1.0.0/16"}}},
+			},
+			groups: map[string][]client.DNSClient{
+				config.GroupCN:       {fakeDNSClient{resp: addressResponse("foreign.example.", cnIP)}},
+				config.GroupOverseas: {overseasFail},
+				"corp":               {fakeDNSClient{resp: addressResponse("foreign.example.", cnIP)}},
+			},
+		}
+	}
+
+	bogusCfg := config.AntiPoisonConfig{BogusNXDomain: []string{"192.0.2.53"}, BogusNXDomainFile: "bogus.txt"}
+	for _, ip := range []string{"192.0.2.53", "198.51.100.7", "203.0.113.9"} {
+		resp, _, err := newRouter(ip, bogusCfg).resolveDual(context.Background(), req)
+		if err == nil && resp != nil && resp.Rcode != dns.RcodeNameError {
+			t.Fatalf("expected bogus answer %s to be dropped, got %v", ip, resp)
+		}
+	}
+
+	resp, upstream, err := newRouter("203.0.113.9", bogusCfg).resolveGroup(context.Background(), req, []client.DNSClient{fakeDNSClient{resp: addressResponse("foreign.example.", "203.0.113.9")}}, "Rule(corp)")
+	if err != nil || resp.Rcode != dns.RcodeNameError || upstream != "Rule(corp)/Bogus" {
+		t.Fatalf("expected bogus group answer turned into NXDOMAIN, got %q %v (err=%v)", upstream, resp, err)
+	}
+
+	if _, upstream, _ := newRouter("192.0.2.1", config.AntiPoisonConfig{}).resolveDual(context.Background(), req); upstream != "GeoIP(Fallback/CN)" {
+		t.Fatalf("expected CN fallback without verification, got %q", upstream)
+	}
+	if _, _, err := newRouter("192.0.2.1", config.AntiPoisonConfig{VerifyCNAnswer: true}).resolveDual(context.Background(), req); err == nil {
+		t.Fatal("expected foreign CN answer for a non-CN domain to be discarded")
+	}
+	if _, upstream, _ := newRouter("10.1.0.1", config.AntiPoisonConfig{VerifyCNAnswer: true}).resolveDual(context.Background(), req); upstream != "GeoIP(Fallback/CN)" {
+		t.Fatalf("expected domestic CN answer to pass verification, got %q", upstream)
+	}
+}
+
+// blockingDNSClient answers after delay, or fails once ctx is cancelled and
+// reports the cancellation on cancelled.
+type blockingDNSClient struct {
+	resp      *dns.Msg
+	delay     time.Duration
+	cancelled chan struct{}
+}
+
+func (b blockingDNSClient) Resolve(ctx context.Context, _ *dns.Msg) (*dns.Msg, error) {
+	select {
+	case <-time.After(b.delay):
+		return b.resp.Copy(), nil
+	case <-ctx.Done():
+		if b.cancelled != nil {
+			close(b.cancelled)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func TestResolveDualDecidesEarly(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("mixed.example.", dns.TypeA)
+	policy := config.GeoIPPolicyConfig{CIDRs: []string{"10.1.0.0/16"}}
+
+	cancelled := make(chan struct{})
+	r := &Router{
+		config: &config.Config{GeoData: config.GeoDataConfig{GeoIPPolicy: policy}},
+		groups: map[string][]client.DNSClient{
+			config.GroupCN:       {blockingDNSClient{resp: addressResponse("mixed.example.", "10.1.0.1"), delay: 5 * time.Second, cancelled: cancelled}},
+			config.GroupOverseas: {fakeDNSClient{resp: addressResponse("mixed.example.", "192.0.2.1")}},
+		},
+	}
+
+	start := time.Now()
+	if _, upstream, err := r.resolveDual(context.Background(), req); err != nil || upstream != "GeoIP(Overseas)" {
+		t.Fatalf("expected overseas answer, got %q (err=%v)", upstream, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected early decision, waited %v", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the CN query to be cancelled")
+	}
+
+	policy.TrustCN = true
+	policy.CNGraceMs = 20
+	r = &Router{
+		config: &config.Config{GeoData: config.GeoDataConfig{GeoIPPolicy: policy}},
+		groups: map[string][]client.DNSClient{
+			config.GroupCN:       {blockingDNSClient{resp: addressResponse("mixed.example.", "10.1.0.1"), delay: 5 * time.Second}},
+			config.GroupOverseas: {fakeDNSClient{resp: addressResponse("mixed.example.", "192.0.2.1")}},
+		},
+	}
+	start = time.Now()
+	if _, upstream, _ := r.resolveDual(context.Background(), req); upstream != "GeoIP(Overseas)" || time.Since(start) > time.Second {
+		t.Fatalf("expected overseas answer after the grace window, got %q after %v", upstream, time.Since(start))
+	}
+
+	r.groups[config.GroupCN] = []client.DNSClient{blockingDNSClient{resp: addressResponse("mixed.example.", "10.1.0.1"), delay: 5 * time.Millisecond}}
+	if _, upstream, _ := r.resolveDual(context.Background(), req); upstream != "GeoIP(CN)" {
+		t.Fatalf("expected CN answer within the grace window, got %q", upstream)
+	}
+}
+
+func TestLearnedDecisionSkipsDualResolve(t *testing.T) {
+	decisions := learned.New(config.LearnedRoutesConfig{Enabled: true}, "")
+	cn := &countingDNSClient{resp: addressResponse("www.shop.example.", "10.1.0.1")}
+	overseas := &countingDNSClient{resp: addressResponse("www.shop.example.", "192.0.2.1")}
+
+	r := &Router{
+		config: &config.Config{
+			Hosts:   map[string][]string{},
+			GeoData: config.GeoDataConfig{GeoIPPolicy: config.GeoIPPolicyConfig{CIDRs: []string{"10.1.0.0/16"}}},
+		},
+		decisions: decisions,
+		groups: map[string][]client.DNSClient{
+			config.GroupCN:       {cn},
+			config.GroupOverseas: {overseas},
+		},
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.shop.example.", dns.TypeA)
+	if _, label, err := r.routeInternal(context.Background(), req); err != nil || label != "GeoIP(Overseas)" {
+		t.Fatalf("unexpected first route result: label=%q err=%v", label, err)
+	}
+	if entry, ok := decisions.Get("shop.example"); !ok || entry.Target != config.GroupOverseas {
+		t.Fatalf("expected decision learned for the registrable domain, got %+v", entry)
+	}
+
+	req.SetQuestion("api.shop.example.", dns.TypeA)
+	if _, label, err := r.routeInternal(context.Background(), req); err != nil || label != "Learned(Overseas)" {
+		t.Fatalf("expected learned route for sibling name, got %q (err=%v)", label, err)
+	}
+	if overseas.calls != 2 {
+		t.Fatalf("expected the learned query to go to the overseas group, got %d calls", overseas.calls)
+	}
+}
+
+type recordingDNSClient struct {
+	resp *dns.Msg
+	reqs []*dns.Msg
+}
+
+func (c *recordingDNSClient) Resolve(_ context.Context, req *dns.Msg) (*dns.Msg, error) {
+	c.reqs = append(c.reqs, req.Copy())
+	resp := c.resp.Copy()
+	resp.Id = req.Id
+	return resp, nil
+}
+
+func TestDNSSECFailureReturnsServfail(t *testing.T) {
+	validator, err := dnssec.New(config.DNSSECConfig{Enabled: true}, "", func(context.Context, *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("upstream down")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &recordingDNSClient{resp: addressResponse("signed.example.", "192.0.2.1")}
+	r := &Router{
+		config: &config.Config{
+			Rules: map[string]string{"signed.example": "overseas"},
+			Hosts: map[string][]string{},
+		},
+		cache:  cache.New(config.CacheConfig{Enabled: true}),
+		dnssec: validator,
+		groups: map[string][]client.DNSClient{config.GroupOverseas: {upstream}},
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("signed.example.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	ctx, info := withQueryInfo(context.Background())
+	resp, _, err := r.routeInternal(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeServerFailure || info.dnssec != dnssec.StatusIndeterminate {
+		t.Fatalf("expected SERVFAIL with indeterminate status, got %s / %q", dns.RcodeToString[resp.Rcode], info.dnssec)
+	}
+	if info.ede == nil || info.ede.InfoCode != dns.ExtendedErrorCodeNetworkError {
+		t.Fatalf("expected network error EDE, got %v", info.ede)
+	}
+	sent := upstream.reqs[0]
+	if !sent.CheckingDisabled || !sent.IsEdns0().Do() {
+		t.Fatalf("expected DO and CD towards upstreams, got %v", sent)
+	}
+
+	// CD 客户端拿到未验证数据，但不写入缓存
+	req.CheckingDisabled = true
+	ctx, info = withQueryInfo(context.Background())
+	resp, _, _ = r.routeInternal(ctx, req)
+	if resp.Rcode != dns.RcodeSuccess || resp.AuthenticatedData || info.dnssec != dnssec.StatusIndeterminate {
+		t.Fatalf("expected raw answer for CD query, got %s AD=%v status=%q", dns.RcodeToString[resp.Rcode], resp.AuthenticatedData, info.dnssec)
+	}
+	r.routeInternal(context.Background(), req)
+	if len(upstream.reqs) != 3 {
+		t.Fatalf("expected unvalidated answers to bypass the cache, got %d upstream queries", len(upstream.reqs))
+	}
+}
+
+func TestShapeDNSSECResponseForNonDOClients(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("signed.example.", dns.TypeA)
+
+	resp := addressResponse("signed.example.", "192.0.2.1")
+	resp.AuthenticatedData = true
+	resp.Answer = append(resp.Answer, &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "signed.example.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		TypeCovered: dns.TypeA,
+	})
+	resp.SetEdns0(1232, true)
+
+	shapeDNSSECResponse(req, resp)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Fatalf("expected RRSIG stripped, got %v", resp.Answer)
+	}
+	if resp.AuthenticatedData || resp.IsEdns0() != nil {
+		t.Fatalf("expected AD and OPT removed for a plain client, got AD=%v OPT=%v", resp.AuthenticatedData, resp.IsEdns0())
+	}
+
+	req.SetEdns0(1232, true)
+	resp = addressResponse("signed.example.", "192.0.2.1")
+	resp.AuthenticatedData = true
+	resp.SetEdns0(1232, true)
+	shapeDNSSECResponse(req, resp)
+	if !resp.AuthenticatedData || !resp.IsEdns0().Do() {
+		t.Fatalf("expected AD and DO kept for a DO client")
+	}
+}
+
+func TestExtendedErrorForRoutingErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code uint16
+	}{
+		{client.ErrNoUpstream, dns.ExtendedErrorCodeNoReachableAuthority},
+		{fmt.Errorf("wrapped: %w", client.ErrRaceTimeout), dns.ExtendedErrorCodeNoReachableAuthority},
+		{context.DeadlineExceeded, dns.ExtendedErrorCodeNoReachableAuthority},
+		{errors.New("connection refused"), dns.ExtendedErrorCodeNetworkError},
+	} {
+		if ede := extendedErrorFor(tc.err); ede == nil || ede.InfoCode != tc.code {
+			t.Errorf("%v: expected EDE %d, got %v", tc.err, tc.code, ede)
+		}
+	}
+	if extendedErrorFor(nil) != nil {
+		t.Fatal("expected no EDE without an error")
+	}
+}
+
+func TestECSClientSubnetOverridesAndEcho(t *testing.T) {
+	r := &Router{ecsOverrides: buildECSOverrides(config.ECSConfig{
+		ClientSubnets: []config.ECSClientSubnet{
+			{Clients: []string{"10.8.0.0/16", "10.9.0.1"}, Subnet: "192.0.2.0/24"},
+			{Clients: []string{"bogus"}, Subnet: "198.51.100.0/24"},
+		},
+	})}
+	if len(r.ecsOverrides) != 1 {
+		t.Fatalf("expected invalid entries dropped, got %d overrides", len(r.ecsOverrides))
+	}
+	if subnet := r.ecsSubnetFor(net.ParseIP("10.9.0.1")); subnet == nil || subnet.String() != "192.0.2.0/24" {
+		t.Fatalf("expected branch subnet, got %v", subnet)
+	}
+	if subnet := r.ecsSubnetFor(net.ParseIP("10.10.0.1")); subnet != nil {
+		t.Fatalf("expected no override, got %v", subnet)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("cdn.example.", dns.TypeA)
+	resp := addressResponse("cdn.example.", "192.0.2.10")
+	resp.SetEdns0(1232, false)
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 16, Address: net.ParseIP("192.0.2.0").To4(),
+	})
+
+	plain := resp.Copy()
+	echoClientECS(req, plain)
+	if client.ExtractECS(plain) != "" {
+		t.Fatalf("expected ECS removed for a client that sent none, got %v", plain.IsEdns0())
+	}
+
+	req.SetEdns0(1232, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 20, Address: net.ParseIP("203.0.112.0").To4(),
+	})
+	echoClientECS(req, resp)
+	subnet := resp.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+	if client.ExtractECS(resp) != "203.0.112.0/20" || subnet.SourceScope != 16 {
+		t.Fatalf("expected the client's subnet echoed with the upstream scope, got %v", subnet)
+	}
+}
+
+func TestRouteStripsClientOptionsBeforeForwarding(t *testing.T) {
+	newReq := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(1232, false)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option,
+			&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+			&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+			&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("203.0.113.0").To4()},
+			&dns.EDNS0_PADDING{Padding: make([]byte, 16)},
+		)
+		return req
+	}
+
+	for _, tc := range []struct {
+		strip bool
+		want  []uint16
+	}{
+		{true, []uint16{dns.EDNS0SUBNET}},
+		{false, []uint16{dns.EDNS0COOKIE, dns.EDNS0NSID, dns.EDNS0SUBNET}},
+	} {
+		upstream := &recordingDNSClient{resp: addressResponse("example.com.", "192.0.2.1")}
+		r := &Router{
+			config: &config.Config{
+				Rules:   map[string]string{"example.com": "overseas"},
+				Privacy: config.PrivacyConfig{StripClientOptions: tc.strip},
+			},
+			groups: map[string][]client.DNSClient{config.GroupOverseas: {upstream}},
+		}
+		req := newReq()
+		if _, err := r.Route(context.Background(), req, "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if len(req.IsEdns0().Option) != 4 {
+			t.Fatalf("expected the client's request left untouched, got %v", req.IsEdns0())
+		}
+
+		var got []uint16
+		for _, o := range upstream.reqs[0].IsEdns0().Option {
+			got = append(got, o.Option())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("strip=%v: expected options %v forwarded, got %v", tc.strip, tc.want, got)
+		}
+	}
+}
+
+func TestMinimalExistenceCheckRequest(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("_443._https.example.com.", dns.TypeHTTPS)
+	req.CheckingDisabled = true
+	req.SetEdns0(4096, true)
+
+	legacy := newExistenceCheckRequest(req, "example.com", false)
+	if legacy.Id != req.Id || !legacy.CheckingDisabled || !legacy.IsEdns0().Do() {
+		t.Fatalf("expected the legacy check to mirror the client query, got %v", legacy)
+	}
+
+	check := newExistenceCheckRequest(req, "example.com", true)
+	if check.Question[0].Name != "example.com." || check.Question[0].Qtype != dns.TypeA {
+		t.Fatalf("expected an A query for the origin, got %v", check.Question[0])
+	}
+	if check.CheckingDisabled || !check.RecursionDesired {
+		t.Fatalf("expected RD without CD, got %v", check)
+	}
+	if opt := check.IsEdns0(); opt == nil || opt.Do() || len(opt.Option) != 0 {
+		t.Fatalf("expected a bare OPT without DO, got %v", opt)
+	}
+}
+
+func TestDomainMatcherConflictsAreDeterministic(t *testing.T) {
+	entries := map[string]string{
+		"example.com":        "plain",
+		"domain:example.com": "domain",
+		"domain:x.com":       "domain-x",
+		"*.x.com":            "wildcard-x",
+		"full:y.com":         "full-y",
+		"y.com":              "plain-y",
+		"*.y.com":            "wildcard-y",
+	}
+
+	for i := 0; i < 50; i++ {
+		m := newDomainMatcher(entries, domaintrie.MatchDomain)
+		for name, want := range map[string]string{
+			"example.com":   "domain",
+			"a.example.com": "domain",
+			"x.com":         "domain-x",
+			"a.x.com":       "domain-x",
+			"y.com":         "full-y",
+			"a.y.com":       "plain-y",
+		} {
+			if value, _ := m.lookup(name); value != want {
+				t.Fatalf("run %d: lookup(%q) = %q, want %q", i, name, value, want)
+			}
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/edns"
 	"doh-autoproxy/internal/router"
 
 	"github.com/miekg/dns"
@@ -20,16 +21,14 @@ type DNSServer struct {
 }
 
 func NewDNSServer(cfg *config.Config, r *router.Router) *DNSServer {
-	handler := &DNSRequestHandler{router: r}
-
 	var udpServer, tcpServer *dns.Server
 
 	if addr := cfg.Listen.DNSUDPAddr(); addr != "" {
-		udpServer = &dns.Server{Addr: addr, Net: "udp", Handler: handler, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+		udpServer = &dns.Server{Addr: addr, Net: "udp", Handler: &DNSRequestHandler{router: r, listener: "udp"}, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
 	}
 
 	if addr := cfg.Listen.DNSTCPAddr(); addr != "" {
-		tcpServer = &dns.Server{Addr: addr, Net: "tcp", Handler: handler, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+		tcpServer = &dns.Server{Addr: addr, Net: "tcp", Handler: &DNSRequestHandler{router: r, listener: "tcp"}, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
 	}
 
 	return &DNSServer{
@@ -77,6 +76,10 @@ func (s *DNSServer) Stop() error {
 
 type DNSRequestHandler struct {
 	router *router.Router
+	// listener 为指标中的监听协议标签，为空时取连接的网络类型
+	listener string
+	// padding 仅用于加密监听 (DoT)
+	padding bool
 }
 
 func (h *DNSRequestHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
@@ -89,15 +92,34 @@ func (h *DNSRequestHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 
 	clientIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	listener := h.listener
+	if listener == "" {
+		listener = w.RemoteAddr().Network()
+	}
+	ctx, cancel := context.WithTimeout(router.WithListener(context.Background(), listener), 10*time.Second)
 	defer cancel()
 
 	resp, err := h.router.Route(ctx, req, clientIP)
 	if err != nil {
 		log.Printf("Error routing DNS query for %s: %v", qName, err)
-		dns.HandleFailed(w, req)
-		return
+		resp = router.FailureResponse(req, err)
+	}
+	if h.padding {
+		padResponse(req, resp)
 	}
 
 	w.WriteMsg(resp)
 }
+
+// padResponse pads a response on an encrypted listener to the block size of
+// RFC 8467, for clients that sent EDNS.
+func padResponse(req, resp *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return
+	}
+	if resp.IsEdns0() == nil {
+		resp.SetEdns0(1232, opt.Do())
+	}
+	edns.Pad(resp, edns.ResponseBlockSize)
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"bytes"
 	"net"
+	"strings"
 	"testing"
 
 	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/metrics"
 	"doh-autoproxy/internal/router"
 
 	"github.com/miekg/dns"
@@ -50,14 +53,14 @@ func (w *captureResponseWriter) Hijack() {}
 
 func TestServeDNSPreservesAnswersFromRouter(t *testing.T) {
 	cfg := &config.Config{
-		Hosts: map[string]string{
-			"example.com": "1.2.3.4",
+		Hosts: map[string][]string{
+			"example.com": {"1.2.3.4"},
 		},
 		Rules: map[string]string{},
 	}
 
 	handler := &DNSRequestHandler{
-		router: router.NewRouter(cfg, nil, nil),
+		router: router.NewRouter(cfg, nil, nil, nil, nil, nil, nil, nil),
 	}
 
 	req := new(dns.Msg)
@@ -84,3 +87,111 @@ func TestServeDNSPreservesAnswersFromRouter(t *testing.T) {
 		t.Fatalf("expected 1.2.3.4, got %s", a.A)
 	}
 }
+
+func TestServeDNSLabelsMetricsWithListener(t *testing.T) {
+	cfg := &config.Config{
+		Hosts: map[string][]string{
+			"example.com": {"1.2.3.4"},
+		},
+		Rules: map[string]string{},
+	}
+	collector := metrics.NewCollector()
+	r := router.NewRouter(cfg, nil, nil, nil, nil, nil, nil, collector)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	(&DNSRequestHandler{router: r, listener: "dot"}).ServeDNS(&captureResponseWriter{}, req)
+	// 未指定协议时取连接的网络类型
+	(&DNSRequestHandler{router: r}).ServeDNS(&captureResponseWriter{}, req)
+
+	var buf bytes.Buffer
+	w := metrics.NewWriter(&buf)
+	collector.Write(w)
+	w.Flush()
+	for _, listener := range []string{"dot", "udp"} {
+		line := `doh_queries_total{listener="` + listener + `",route="Hosts",rcode="NOERROR"} 1`
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("missing %q in:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestServeDNSAttachesExtendedErrors(t *testing.T) {
+	cfg := &config.Config{
+		Hosts: map[string][]string{},
+		Rules: map[string]string{
+			"ads.example":  "reject",
+			"down.example": "overseas",
+		},
+	}
+	handler := &DNSRequestHandler{
+		router: router.NewRouter(cfg, nil, nil, nil, nil, nil, nil, nil),
+	}
+
+	for _, tc := range []struct {
+		name  string
+		rcode int
+		code  uint16
+	}{
+		{"ads.example.", dns.RcodeNameError, dns.ExtendedErrorCodeBlocked},
+		{"down.example.", dns.RcodeServerFailure, dns.ExtendedErrorCodeNoReachableAuthority},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.name, dns.TypeA)
+		req.SetEdns0(1232, false)
+
+		writer := &captureResponseWriter{}
+		handler.ServeDNS(writer, req)
+		if writer.msg == nil || writer.msg.Rcode != tc.rcode {
+			t.Fatalf("%s: expected rcode %d, got %v", tc.name, tc.rcode, writer.msg)
+		}
+		var ede *dns.EDNS0_EDE
+		if opt := writer.msg.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_EDE); ok {
+					ede = e
+				}
+			}
+		}
+		if ede == nil || ede.InfoCode != tc.code {
+			t.Fatalf("%s: expected EDE %d, got %v", tc.name, tc.code, ede)
+		}
+	}
+
+	// 未使用 EDNS 的客户端收不到 OPT 选项
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.", dns.TypeA)
+	writer := &captureResponseWriter{}
+	handler.ServeDNS(writer, req)
+	if writer.msg.IsEdns0() != nil {
+		t.Fatalf("expected no OPT record for a plain client, got %v", writer.msg)
+	}
+}
+
+func TestServeDNSPadsEncryptedResponses(t *testing.T) {
+	cfg := &config.Config{
+		Hosts: map[string][]string{
+			"example.com": {"1.2.3.4"},
+		},
+		Rules: map[string]string{},
+	}
+	r := router.NewRouter(cfg, nil, nil, nil, nil, nil, nil, nil)
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	writer := &captureResponseWriter{}
+	(&DNSRequestHandler{router: r, listener: "dot", padding: true}).ServeDNS(writer, req)
+	if writer.msg == nil || writer.msg.Len()%468 != 0 {
+		t.Fatalf("expected a response padded to a multiple of 468, got %v", writer.msg)
+	}
+
+	// 未协商 EDNS 的客户端不能收到 OPT
+	req = new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	writer = &captureResponseWriter{}
+	(&DNSRequestHandler{router: r, listener: "dot", padding: true}).ServeDNS(writer, req)
+	if writer.msg == nil || writer.msg.IsEdns0() != nil {
+		t.Fatalf("expected no OPT for a non-EDNS client, got %v", writer.msg)
+	}
+}
@@ -35,8 +35,9 @@ func NewDoHServer(cfg *config.Config, r *router.Router, cm *util.CertManager) *D
 	}
 
 	dohHandler := &DoHRequestHandler{
-		router: r,
-		path:   dohPath,
+		router:  r,
+		path:    dohPath,
+		padding: cfg.Privacy.Padding,
 	}
 
 	var tlsConfig *tls.Config
@@ -149,8 +150,9 @@ func (s *DoHServer) Stop() error {
 }
 
 type DoHRequestHandler struct {
-	router *router.Router
-	path   string
+	router  *router.Router
+	path    string
+	padding bool
 }
 
 func (h *DoHRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -210,14 +212,16 @@ func (h *DoHRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(router.WithListener(r.Context(), "doh"), 10*time.Second)
 	defer cancel()
 
 	resp, err := h.router.Route(ctx, req, clientIP)
 	if err != nil {
 		log.Printf("Error routing DoH query for %s: %v", qName, err)
-		resp = new(dns.Msg)
-		resp.SetRcode(req, dns.RcodeServerFailure)
+		resp = router.FailureResponse(req, err)
+	}
+	if h.padding {
+		padResponse(req, resp)
 	}
 
 	packedResp, err := resp.Pack()
@@ -148,14 +148,16 @@ func (s *DoQServer) handleQuicStream(stream *quic.Stream, remoteAddr net.Addr) {
 
 	clientIP, _, _ := net.SplitHostPort(remoteAddr.String())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(router.WithListener(context.Background(), "doq"), 10*time.Second)
 	defer cancel()
 
 	resp, err := s.router.Route(ctx, req, clientIP)
 	if err != nil {
 		log.Printf("DoQ: Error routing DNS query for %s: %v", qName, err)
-		resp = new(dns.Msg)
-		resp.SetRcode(req, dns.RcodeServerFailure)
+		resp = router.FailureResponse(req, err)
+	}
+	if s.cfg.Privacy.Padding {
+		padResponse(req, resp)
 	}
 
 	packedResp, err := resp.Pack()
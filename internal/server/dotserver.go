@@ -19,7 +19,7 @@ type DoTServer struct {
 }
 
 func NewDoTServer(cfg *config.Config, r *router.Router, cm *util.CertManager) *DoTServer {
-	handler := &DNSRequestHandler{router: r}
+	handler := &DNSRequestHandler{router: r, listener: "dot", padding: cfg.Privacy.Padding}
 
 	var tlsConfig *tls.Config
 
@@ -0,0 +1,94 @@
+package web
+
+import (
+	"crypto/subtle"
+	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/manager"
+	"doh-autoproxy/internal/metrics"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// StartMetricsServer serves /metrics on its own address when metrics.address
+// is set; otherwise StartWebServer mounts it on the web UI. The manager
+// restarts the listener whenever the config is reloaded.
+func StartMetricsServer(mgr *manager.ServiceManager) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(mgr, nil))
+	mgr.SetMetricsHandler(mux)
+}
+
+// metricsHandler renders the metrics. checkAuth is the web UI session check
+// when mounted on the web UI, nil on a dedicated listener; the web UI only
+// answers while no dedicated address is configured.
+func metricsHandler(mgr *manager.ServiceManager, checkAuth func(*http.Request) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := mgr.Config
+		if !cfg.Metrics.Enabled || (checkAuth != nil && cfg.Metrics.Address != "") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !metricsAuthorized(cfg, r, checkAuth) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		mw := metrics.NewWriter(w)
+		mgr.Metrics.Write(mw)
+		if router := mgr.Router; router != nil {
+			router.WriteMetrics(mw)
+		}
+
+		queue := mgr.QueryLog.QueueStats()
+		mw.Header("doh_querylog_queue_length", "gauge", "Entries waiting in the query log file write queue.")
+		mw.Value("doh_querylog_queue_length", float64(queue.Length))
+		mw.Header("doh_querylog_queue_capacity", "gauge", "Capacity of the query log file write queue.")
+		mw.Value("doh_querylog_queue_capacity", float64(queue.Capacity))
+		mw.Header("doh_querylog_queue_overflows_total", "counter", "Query log entries written synchronously because the write queue was full.")
+		mw.Value("doh_querylog_queue_overflows_total", float64(queue.Overflows))
+		mw.Header("doh_querylog_queue_drops_total", "counter", "Query log entries not written to file because the log was closing.")
+		mw.Value("doh_querylog_queue_drops_total", float64(queue.Drops))
+
+		metrics.WriteRuntime(mw)
+		if err := mw.Flush(); err != nil {
+			log.Printf("写入指标失败: %v", err)
+		}
+	}
+}
+
+// metricsAuthorized applies the metrics credentials when configured. Without
+// them the web UI rules apply on the web UI (guest mode, a session or basic
+// auth with the web UI account), while a dedicated listener is open.
+func metricsAuthorized(cfg *config.Config, r *http.Request, checkAuth func(*http.Request) bool) bool {
+	m := cfg.Metrics
+	if m.BearerToken != "" || (m.Username != "" && m.Password != "") {
+		if m.BearerToken != "" {
+			if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, m.BearerToken) {
+				return true
+			}
+		}
+		if m.Username != "" && m.Password != "" {
+			if user, pass, ok := r.BasicAuth(); ok && secureEqual(user, m.Username) && secureEqual(pass, m.Password) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if checkAuth == nil || cfg.WebUI.GuestMode || checkAuth(r) {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	return ok && secureEqual(user, cfg.WebUI.Username) && secureEqual(pass, cfg.WebUI.Password)
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"doh-autoproxy/internal/client"
 	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/learned"
 	"doh-autoproxy/internal/manager"
 	"doh-autoproxy/internal/resolver"
 	"embed"
@@ -39,6 +40,7 @@ type DashboardStats struct {
 	TotalQueries     int64            `json:"total_queries"`
 	TotalCN          int64            `json:"total_cn"`
 	TotalOverseas    int64            `json:"total_overseas"`
+	TotalBlocked     int64            `json:"total_blocked"`
 	ListenDNSUDP     string           `json:"listen_dns_udp"`
 	ListenDNSTCP     string           `json:"listen_dns_tcp"`
 	ListenDOH        string           `json:"listen_doh"`
@@ -46,7 +48,11 @@ type DashboardStats struct {
 	ListenDOQ        string           `json:"listen_doq"`
 	UpstreamCN       int              `json:"upstream_cn_count"`
 	UpstreamOverseas int              `json:"upstream_overseas_count"`
+	UpstreamGroups   map[string]int   `json:"upstream_groups"`
 	UpstreamStats    []interface{}    `json:"upstream_stats,omitempty"`
+	GroupStats       []interface{}    `json:"group_stats,omitempty"`
+	CacheStats       interface{}      `json:"cache_stats,omitempty"`
+	BlocklistStats   []interface{}    `json:"blocklist_stats,omitempty"`
 	TopClients       map[string]int64 `json:"top_clients"`
 	TopDomains       map[string]int64 `json:"top_domains"`
 }
@@ -196,9 +202,9 @@ func StartWebServer(mgr *manager.ServiceManager) {
 				newCfg.WebUI.Password = mgr.Config.WebUI.Password
 			}
 
-			newCfg.Hosts = make(map[string]string)
+			newCfg.Hosts = make(map[string][]string)
 			for k, v := range mgr.Config.Hosts {
-				newCfg.Hosts[k] = v
+				newCfg.Hosts[k] = append([]string(nil), v...)
 			}
 
 			configPath := config.GetDefaultConfigPath()
@@ -249,14 +255,17 @@ func StartWebServer(mgr *manager.ServiceManager) {
 				IP     string `json:"ip"`
 			}
 
+			// 每条记录单独成行，IP 字段同时承载 "CNAME target." 等类型化记录
 			var allHosts []HostEntry
-			for k, v := range mgr.Config.Hosts {
-				if q == "" || strings.Contains(k, q) || strings.Contains(v, q) {
-					allHosts = append(allHosts, HostEntry{Domain: k, IP: v})
+			for k, values := range mgr.Config.Hosts {
+				for _, v := range values {
+					if q == "" || strings.Contains(k, q) || strings.Contains(strings.ToLower(v), q) {
+						allHosts = append(allHosts, HostEntry{Domain: k, IP: v})
+					}
 				}
 			}
 
-			sort.Slice(allHosts, func(i, j int) bool {
+			sort.SliceStable(allHosts, func(i, j int) bool {
 				return allHosts[i].Domain < allHosts[j].Domain
 			})
 
@@ -293,13 +302,13 @@ func StartWebServer(mgr *manager.ServiceManager) {
 			}
 
 			newCfg := *mgr.Config
-			newCfg.Hosts = make(map[string]string)
+			newCfg.Hosts = make(map[string][]string)
 			for k, v := range mgr.Config.Hosts {
-				newCfg.Hosts[k] = v
+				newCfg.Hosts[k] = append([]string(nil), v...)
 			}
 
 			for _, h := range payload.Hosts {
-				newCfg.Hosts[strings.ToLower(h.Domain)] = h.IP
+				config.AddHost(newCfg.Hosts, h.Domain, strings.TrimSpace(h.IP))
 			}
 
 			configPath := config.GetDefaultConfigPath()
@@ -318,6 +327,10 @@ func StartWebServer(mgr *manager.ServiceManager) {
 		if r.Method == http.MethodDelete {
 			var payload struct {
 				Domains []string `json:"domains"`
+				Entries []struct {
+					Domain string `json:"domain"`
+					IP     string `json:"ip"`
+				} `json:"entries"`
 			}
 			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
@@ -325,14 +338,28 @@ func StartWebServer(mgr *manager.ServiceManager) {
 			}
 
 			newCfg := *mgr.Config
-			newCfg.Hosts = make(map[string]string)
+			newCfg.Hosts = make(map[string][]string)
 			for k, v := range mgr.Config.Hosts {
-				newCfg.Hosts[k] = v
+				newCfg.Hosts[k] = append([]string(nil), v...)
 			}
 
 			for _, d := range payload.Domains {
 				delete(newCfg.Hosts, strings.ToLower(d))
 			}
+			for _, e := range payload.Entries {
+				domain := strings.ToLower(e.Domain)
+				var kept []string
+				for _, v := range newCfg.Hosts[domain] {
+					if v != e.IP {
+						kept = append(kept, v)
+					}
+				}
+				if len(kept) == 0 {
+					delete(newCfg.Hosts, domain)
+				} else {
+					newCfg.Hosts[domain] = kept
+				}
+			}
 
 			configPath := config.GetDefaultConfigPath()
 			if err := newCfg.Save(configPath); err != nil {
@@ -409,13 +436,15 @@ func StartWebServer(mgr *manager.ServiceManager) {
 			mu.Unlock()
 		}
 
-		for _, s := range tempCfg.Upstreams.CN {
-			wg.Add(1)
-			go testServer(s, "CN", "www.baidu.com")
-		}
-		for _, s := range tempCfg.Upstreams.Overseas {
-			wg.Add(1)
-			go testServer(s, "Overseas", "www.google.com")
+		for _, name := range tempCfg.Upstreams.GroupNames() {
+			target := "www.google.com"
+			if name == config.GroupCN {
+				target = "www.baidu.com"
+			}
+			for _, s := range tempCfg.Upstreams[name] {
+				wg.Add(1)
+				go testServer(s, config.GroupLabel(name), target)
+			}
 		}
 
 		wg.Wait()
@@ -424,6 +453,152 @@ func StartWebServer(mgr *manager.ServiceManager) {
 		json.NewEncoder(w).Encode(results)
 	})
 
+	mux.HandleFunc("/api/blocklists/update", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !checkAuth(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// 下载可能较慢，在后台进行，完成后直接生效
+		go mgr.Blocklists.Update(true)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(mgr.Blocklists.Stats())
+	})
+
+	mux.HandleFunc("/api/learned", func(w http.ResponseWriter, r *http.Request) {
+		if !checkAuth(r) && (!mgr.Config.WebUI.GuestMode || r.Method != http.MethodGet) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			q := strings.ToLower(r.URL.Query().Get("q"))
+			entries := []learned.Entry{}
+			for _, e := range mgr.Learned.List() {
+				if q == "" || strings.Contains(e.Domain, q) || strings.Contains(e.Target, q) {
+					entries = append(entries, e)
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"enabled": mgr.Learned != nil,
+				"data":    entries,
+				"total":   len(entries),
+			})
+			return
+		}
+
+		if mgr.Learned == nil {
+			http.Error(w, "Learned routes are disabled", http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			var payload struct {
+				Domain string `json:"domain"`
+				Target string `json:"target"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			target := strings.ToLower(strings.TrimSpace(payload.Target))
+			if _, ok := mgr.Config.Upstreams[target]; !ok && target != config.GroupCN && target != config.GroupOverseas {
+				http.Error(w, "Unknown upstream group: "+payload.Target, http.StatusBadRequest)
+				return
+			}
+			if strings.TrimSpace(payload.Domain) == "" {
+				http.Error(w, "Domain is required", http.StatusBadRequest)
+				return
+			}
+
+			mgr.Learned.Set(payload.Domain, target)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if r.Method == http.MethodDelete {
+			var payload struct {
+				Domains []string `json:"domains"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			mgr.Learned.Delete(payload.Domains...)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+
+	// 将学习到的分流结果写入 rule.txt，成为永久规则
+	mux.HandleFunc("/api/learned/promote", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !checkAuth(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var payload struct {
+			Domains []string `json:"domains"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		newCfg := *mgr.Config
+		newCfg.Rules = make(map[string]string, len(mgr.Config.Rules)+len(payload.Domains))
+		for k, v := range mgr.Config.Rules {
+			newCfg.Rules[k] = v
+		}
+
+		promoted := []string{}
+		for _, domain := range payload.Domains {
+			entry, ok := mgr.Learned.Get(domain)
+			if !ok {
+				continue
+			}
+			newCfg.Rules[entry.Domain] = entry.Target
+			promoted = append(promoted, entry.Domain)
+		}
+		if len(promoted) == 0 {
+			http.Error(w, "No learned route matched", http.StatusBadRequest)
+			return
+		}
+
+		configPath := config.GetDefaultConfigPath()
+		if err := newCfg.Save(configPath); err != nil {
+			http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mgr.Learned.Delete(promoted...)
+		if err := mgr.Reload(&newCfg); err != nil {
+			http.Error(w, "Failed to reload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"promoted": promoted,
+		})
+	})
+
 	mux.HandleFunc("/api/logs", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -487,25 +662,58 @@ func StartWebServer(mgr *manager.ServiceManager) {
 			TotalQueries:     stats.TotalQueries,
 			TotalCN:          stats.TotalCN,
 			TotalOverseas:    stats.TotalOverseas,
+			TotalBlocked:     stats.TotalBlocked,
 			ListenDNSUDP:     currentCfg.Listen.DNSUDPAddr(),
 			ListenDNSTCP:     currentCfg.Listen.DNSTCPAddr(),
 			ListenDOH:        currentCfg.Listen.DOHAddr(),
 			ListenDOT:        currentCfg.Listen.DOTAddr(),
 			ListenDOQ:        currentCfg.Listen.DOQAddr(),
-			UpstreamCN:       len(currentCfg.Upstreams.CN),
-			UpstreamOverseas: len(currentCfg.Upstreams.Overseas),
+			UpstreamCN:       len(currentCfg.Upstreams[config.GroupCN]),
+			UpstreamOverseas: len(currentCfg.Upstreams[config.GroupOverseas]),
+			UpstreamGroups:   make(map[string]int),
 			TopClients:       limitCountMap(stats.TopClients, topStatsLimit),
 			TopDomains:       limitCountMap(stats.TopDomains, topStatsLimit),
 		}
 
+		for _, name := range currentCfg.Upstreams.GroupNames() {
+			resp.UpstreamGroups[name] = len(currentCfg.Upstreams[name])
+		}
+
 		if mgr.Router != nil {
 			resp.UpstreamStats = mgr.Router.GetUpstreamStats()
+			resp.GroupStats = mgr.Router.GetGroupStats()
 		}
+		resp.CacheStats = mgr.Cache.Stats()
+		resp.BlocklistStats = mgr.Blocklists.Stats()
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	})
 
+	mux.HandleFunc("/api/stats/series", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !mgr.Config.WebUI.GuestMode && !checkAuth(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var series []interface{}
+		if mgr.Router != nil {
+			series = mgr.Router.GetUpstreamSeries()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": series,
+		})
+	})
+
+	mux.Handle("/metrics", metricsHandler(mgr, checkAuth))
+
 	uiAssets, err := fs.Sub(uiFS, "ui")
 	if err != nil {
 		log.Fatalf("Failed to embed UI: %v", err)
@@ -0,0 +1,99 @@
+package zone
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// Set holds every configured local zone.
+type Set struct {
+	// zones 按标签数降序排列，父子区域同时存在时优先匹配更具体的区域
+	zones         []*Zone
+	allowTransfer bool
+}
+
+// New loads the configured zone files, skipping (and logging) those that fail
+// to parse. It returns nil when no zone could be loaded; all methods treat a
+// nil *Set as empty.
+func New(cfg config.LocalZonesConfig, dir string) *Set {
+	var zones []*Zone
+	for _, zc := range cfg.Zones {
+		if zc.File == "" {
+			continue
+		}
+		path := zc.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		z, err := Load(path, zc.Origin)
+		if err != nil {
+			log.Printf("加载本地区域 %s 失败: %v", zc.File, err)
+			continue
+		}
+		zones = append(zones, z)
+	}
+
+	if len(zones) == 0 {
+		return nil
+	}
+	return NewFromZones(cfg.AllowTransfer, zones...)
+}
+
+// NewFromZones builds a Set from already parsed zones.
+func NewFromZones(allowTransfer bool, zones ...*Zone) *Set {
+	s := &Set{zones: zones, allowTransfer: allowTransfer}
+	sort.SliceStable(s.zones, func(i, j int) bool {
+		return dns.CountLabel(s.zones[i].origin) > dns.CountLabel(s.zones[j].origin)
+	})
+	return s
+}
+
+// Match returns the most specific zone containing name.
+func (s *Set) Match(name string) (*Zone, bool) {
+	if s == nil {
+		return nil, false
+	}
+	for _, z := range s.zones {
+		if z.Contains(name) {
+			return z, true
+		}
+	}
+	return nil, false
+}
+
+// Answer responds to req when its name falls inside a local zone. The
+// returned origin (without the trailing dot) identifies the zone.
+func (s *Set) Answer(req *dns.Msg) (*dns.Msg, string, bool) {
+	if s == nil || len(req.Question) == 0 {
+		return nil, "", false
+	}
+
+	q := req.Question[0]
+	z, ok := s.Match(q.Name)
+	if !ok {
+		return nil, "", false
+	}
+	origin := strings.TrimSuffix(z.Origin(), ".")
+
+	switch q.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		m := new(dns.Msg)
+		switch {
+		case !s.allowTransfer:
+			m.SetRcode(req, dns.RcodeRefused)
+		case dns.CanonicalName(q.Name) != z.Origin():
+			m.SetRcode(req, dns.RcodeNotAuth)
+		default:
+			m = z.Transfer(req)
+		}
+		return m, origin, true
+	}
+
+	return z.Answer(req), origin, true
+}
@@ -0,0 +1,264 @@
+package zone
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain 限制区域内 CNAME 链的跟随深度，防止循环
+const maxCNAMEChain = 8
+
+// Zone is an in-memory copy of one zone file, answered following the
+// algorithm of RFC 1034 section 4.3.2 (with RFC 4592 wildcards).
+type Zone struct {
+	origin string
+	soa    *dns.SOA
+
+	rrsets map[string]map[uint16][]dns.RR
+	// names 包含所有存在的名字，含空非终端节点（只有子域名而自身无记录）
+	names map[string]bool
+	// records 按文件顺序保存，供 AXFR 使用
+	records []dns.RR
+}
+
+// Load parses a zone file. origin may be empty when the file sets $ORIGIN or
+// uses absolute names; the SOA owner then becomes the origin.
+func Load(path, origin string) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, origin, path)
+}
+
+func Parse(r io.Reader, origin, file string) (*Zone, error) {
+	if origin != "" {
+		origin = dns.CanonicalName(origin)
+	}
+
+	var records []dns.RR
+	zp := dns.NewZoneParser(r, origin, file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	z := &Zone{
+		origin: origin,
+		rrsets: make(map[string]map[uint16][]dns.RR),
+		names:  make(map[string]bool),
+	}
+	for _, rr := range records {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if z.soa != nil {
+				return nil, fmt.Errorf("区域包含多条 SOA 记录")
+			}
+			z.soa = soa
+		}
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("区域缺少 SOA 记录")
+	}
+	if z.origin == "" {
+		z.origin = z.soa.Hdr.Name
+	}
+	if z.soa.Hdr.Name != z.origin {
+		return nil, fmt.Errorf("SOA 所有者 %s 与区域 %s 不一致", z.soa.Hdr.Name, z.origin)
+	}
+
+	for _, rr := range records {
+		name := rr.Header().Name
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("记录 %s 不在区域 %s 内", name, z.origin)
+		}
+		if z.rrsets[name] == nil {
+			z.rrsets[name] = make(map[uint16][]dns.RR)
+		}
+		rrtype := rr.Header().Rrtype
+		z.rrsets[name][rrtype] = append(z.rrsets[name][rrtype], rr)
+		z.records = append(z.records, rr)
+
+		for n := name; ; {
+			z.names[n] = true
+			if n == z.origin {
+				break
+			}
+			n = parent(n)
+		}
+	}
+
+	return z, nil
+}
+
+// Origin returns the fully qualified, lower-case zone name.
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// Contains reports whether name is at or below the zone apex.
+func (z *Zone) Contains(name string) bool {
+	return dns.IsSubDomain(z.origin, dns.CanonicalName(name))
+}
+
+// Answer builds an authoritative response for the first question of req,
+// which must be inside the zone.
+func (z *Zone) Answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	z.resolve(m, q.Name, q.Qtype, 0)
+	return m
+}
+
+// Transfer returns the whole zone framed by its SOA, as sent in an AXFR.
+func (z *Zone) Transfer(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.Answer = append(m.Answer, dns.Copy(z.soa))
+	for _, rr := range z.records {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			m.Answer = append(m.Answer, dns.Copy(rr))
+		}
+	}
+	m.Answer = append(m.Answer, dns.Copy(z.soa))
+	return m
+}
+
+func (z *Zone) resolve(m *dns.Msg, qname string, qtype uint16, depth int) {
+	name := dns.CanonicalName(qname)
+
+	if cut, ok := z.delegation(name, qtype); ok {
+		if depth == 0 {
+			m.Authoritative = false
+		}
+		for _, ns := range z.rrsets[cut][dns.TypeNS] {
+			m.Ns = append(m.Ns, dns.Copy(ns))
+			m.Extra = append(m.Extra, z.glue(ns.(*dns.NS).Ns)...)
+		}
+		return
+	}
+
+	set, ok := z.rrsets[name]
+	if !ok && !z.names[name] {
+		wildcard, found := z.wildcard(name)
+		if !found {
+			m.Rcode = dns.RcodeNameError
+			m.Ns = []dns.RR{z.negativeSOA()}
+			return
+		}
+		set = z.rrsets[wildcard]
+	}
+
+	if qtype == dns.TypeANY {
+		types := make([]int, 0, len(set))
+		for t := range set {
+			types = append(types, int(t))
+		}
+		sort.Ints(types)
+		for _, t := range types {
+			m.Answer = append(m.Answer, withOwner(set[uint16(t)], qname)...)
+		}
+	} else if rrs := set[qtype]; len(rrs) > 0 {
+		m.Answer = append(m.Answer, withOwner(rrs, qname)...)
+	} else if cname := set[dns.TypeCNAME]; len(cname) > 0 && qtype != dns.TypeCNAME {
+		m.Answer = append(m.Answer, withOwner(cname, qname)...)
+		target := cname[0].(*dns.CNAME).Target
+		if depth < maxCNAMEChain && z.Contains(target) {
+			z.resolve(m, target, qtype, depth+1)
+		}
+		return
+	}
+
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{z.negativeSOA()}
+	}
+}
+
+// delegation returns the topmost zone cut at or above name. DS records live
+// in the parent, so a DS query for the cut itself is answered here.
+func (z *Zone) delegation(name string, qtype uint16) (string, bool) {
+	if name == z.origin {
+		return "", false
+	}
+
+	var chain []string
+	for n := name; n != z.origin; n = parent(n) {
+		chain = append(chain, n)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		n := chain[i]
+		if n == name && qtype == dns.TypeDS {
+			break
+		}
+		if len(z.rrsets[n][dns.TypeNS]) > 0 {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+// wildcard looks up "*.<closest encloser>" as described in RFC 4592.
+func (z *Zone) wildcard(name string) (string, bool) {
+	encloser := name
+	for encloser != z.origin && !z.names[encloser] {
+		encloser = parent(encloser)
+	}
+	wildcard := "*." + encloser
+	_, ok := z.rrsets[wildcard]
+	return wildcard, ok
+}
+
+func (z *Zone) glue(target string) []dns.RR {
+	target = dns.CanonicalName(target)
+	if !z.Contains(target) {
+		return nil
+	}
+	var glue []dns.RR
+	for _, rrtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, rr := range z.rrsets[target][rrtype] {
+			glue = append(glue, dns.Copy(rr))
+		}
+	}
+	return glue
+}
+
+// negativeSOA uses min(SOA TTL, MINIMUM) as the negative caching TTL
+// (RFC 2308 section 3).
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+func withOwner(rrs []dns.RR, owner string) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		cp := dns.Copy(rr)
+		cp.Header().Name = owner
+		out = append(out, cp)
+	}
+	return out
+}
+
+func parent(name string) string {
+	if name == "." {
+		return name
+	}
+	if i := strings.Index(name, "."); i >= 0 && i+1 < len(name) {
+		return name[i+1:]
+	}
+	return "."
+}
@@ -0,0 +1,110 @@
+package zone
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN home.arpa.
+$TTL 3600
+@       IN SOA  ns.home.arpa. hostmaster.home.arpa. 1 7200 900 1209600 300
+@       IN NS   ns
+ns      IN A    192.168.1.1
+nas     IN A    192.168.1.10
+        IN AAAA fd00::10
+www     IN CNAME nas
+*.apps  IN A    192.168.1.20
+a.b     IN TXT  "deep"
+lab     IN NS   ns.lab
+ns.lab  IN A    192.168.2.1
+`
+
+func mustParse(t *testing.T) *Zone {
+	t.Helper()
+	z, err := Parse(strings.NewReader(testZone), "", "test.zone")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return z
+}
+
+func query(s *Set, name string, qtype uint16) (*dns.Msg, bool) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	resp, _, ok := s.Answer(req)
+	return resp, ok
+}
+
+func TestZoneAnswers(t *testing.T) {
+	s := NewFromZones(false, mustParse(t))
+
+	resp, ok := query(s, "NAS.home.arpa.", dns.TypeAAAA)
+	if !ok || !resp.Authoritative || len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "NAS.home.arpa." {
+		t.Fatalf("unexpected AAAA answer %v", resp)
+	}
+
+	resp, _ = query(s, "www.home.arpa.", dns.TypeA)
+	if len(resp.Answer) != 2 || resp.Answer[0].Header().Rrtype != dns.TypeCNAME || resp.Answer[1].(*dns.A).A.String() != "192.168.1.10" {
+		t.Fatalf("expected CNAME chased inside the zone, got %v", resp.Answer)
+	}
+
+	resp, _ = query(s, "x.apps.home.arpa.", dns.TypeA)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "x.apps.home.arpa." {
+		t.Fatalf("expected wildcard synthesis, got %v", resp.Answer)
+	}
+
+	resp, _ = query(s, "nas.home.arpa.", dns.TypeMX)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Fatalf("expected NODATA with SOA, got %v", resp)
+	}
+	if soa := resp.Ns[0].(*dns.SOA); soa.Hdr.Ttl != 300 {
+		t.Fatalf("expected negative TTL from SOA minimum, got %d", soa.Hdr.Ttl)
+	}
+
+	resp, _ = query(s, "b.home.arpa.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Fatalf("expected NODATA for empty non-terminal, got %v", resp)
+	}
+
+	resp, _ = query(s, "missing.home.arpa.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 {
+		t.Fatalf("expected NXDOMAIN with SOA, got %v", resp)
+	}
+
+	resp, _ = query(s, "host.lab.home.arpa.", dns.TypeA)
+	if resp.Authoritative || len(resp.Answer) != 0 || len(resp.Ns) != 1 || len(resp.Extra) != 1 {
+		t.Fatalf("expected referral with glue, got %v", resp)
+	}
+
+	if _, ok := query(s, "example.com.", dns.TypeA); ok {
+		t.Fatal("expected names outside local zones to be ignored")
+	}
+}
+
+func TestZoneTransfer(t *testing.T) {
+	z := mustParse(t)
+
+	resp, _ := query(NewFromZones(false, z), "home.arpa.", dns.TypeAXFR)
+	if resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("expected AXFR to be refused by default, got %v", resp)
+	}
+
+	resp, _ = query(NewFromZones(true, z), "home.arpa.", dns.TypeAXFR)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != len(z.records)+1 {
+		t.Fatalf("unexpected AXFR response %v", resp)
+	}
+	if resp.Answer[0].Header().Rrtype != dns.TypeSOA || resp.Answer[len(resp.Answer)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatal("expected AXFR framed by SOA records")
+	}
+}
+
+func TestParseRejectsInvalidZones(t *testing.T) {
+	if _, err := Parse(strings.NewReader("www 3600 IN A 10.0.0.1\n"), "home.arpa.", ""); err == nil {
+		t.Fatal("expected error for zone without SOA")
+	}
+	if _, err := Parse(strings.NewReader(testZone+"example.com. 60 IN A 10.0.0.1\n"), "", ""); err == nil {
+		t.Fatal("expected error for out-of-zone data")
+	}
+}